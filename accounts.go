@@ -0,0 +1,99 @@
+package tagd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+const defaultRoleSessionName = "tagd"
+
+// AccountConfig is another AWS account whose ASGs are managed by assuming a role
+// in it. TaggingConfigs select the account by name.
+type AccountConfig struct {
+	Name       string `yaml:"name"`
+	RoleARN    string `yaml:"roleARN"`
+	ExternalID string `yaml:"externalID,omitempty"`
+	// SessionName is the role session name, shown in CloudTrail. Defaults to tagd.
+	SessionName string `yaml:"sessionName,omitempty"`
+	// Duration of the assumed role's credentials, defaults to 15 minutes.
+	Duration time.Duration `yaml:"duration,omitempty"`
+}
+
+func (a *AccountConfig) validate() error {
+	if a.Name == "" {
+		return fmt.Errorf("account name is required")
+	}
+	if a.id() == "" || !strings.HasPrefix(a.RoleARN, "arn:") {
+		return fmt.Errorf("account %s: invalid roleARN %q", a.Name, a.RoleARN)
+	}
+	if a.Duration < 0 {
+		return fmt.Errorf("account %s: duration must not be negative", a.Name)
+	}
+	return nil
+}
+
+// id returns the account ID of the role, or an empty string for a nil account.
+func (a *AccountConfig) id() string {
+	if a == nil {
+		return ""
+	}
+	parts := strings.SplitN(a.RoleARN, ":", 6)
+	if len(parts) < 6 {
+		return ""
+	}
+	return parts[4]
+}
+
+// credentials returns credentials assuming the account's role with sess. They
+// are refreshed automatically before they expire.
+func (a *AccountConfig) credentials(sess *session.Session) *credentials.Credentials {
+	return stscreds.NewCredentials(sess, a.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+		if a.ExternalID != "" {
+			p.ExternalID = aws.String(a.ExternalID)
+		}
+		p.RoleSessionName = a.SessionName
+		if p.RoleSessionName == "" {
+			p.RoleSessionName = defaultRoleSessionName
+		}
+		if a.Duration > 0 {
+			p.Duration = a.Duration
+		}
+	})
+}
+
+// account returns the AccountConfig called name, or nil for the session's own account.
+func (c *Config) account(name string) *AccountConfig {
+	for i := range c.Accounts {
+		if c.Accounts[i].Name == name {
+			return &c.Accounts[i]
+		}
+	}
+	return nil
+}
+
+// validateAccounts checks the AccountConfigs and the accounts the TaggingConfigs refer to.
+func (c *Config) validateAccounts() error {
+	names := make(map[string]bool)
+	for i := range c.Accounts {
+		a := &c.Accounts[i]
+		if err := a.validate(); err != nil {
+			return err
+		}
+		if names[a.Name] {
+			return fmt.Errorf("duplicate account %s", a.Name)
+		}
+		names[a.Name] = true
+	}
+	for _, conf := range c.TaggingConfigs {
+		if conf.Account != "" && !names[conf.Account] {
+			return fmt.Errorf("tagConfig %s: unknown account %s", conf.ASGName, conf.Account)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package tagd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultAttachTimeout is how long to wait for an instance's block devices to attach.
+	DefaultAttachTimeout = 2 * time.Minute
+	// DefaultRecheckAfter is when to look for volumes attached after launch.
+	DefaultRecheckAfter = 10 * time.Minute
+
+	attachInitialBackoff = 2 * time.Second
+	attachMaxBackoff     = 30 * time.Second
+	// attachUnmappedPolls is how many times a running instance may report no
+	// block devices before it's assumed to have none, e.g. instance store only.
+	attachUnmappedPolls = 3
+)
+
+// attachTimeout returns the configured attach timeout, or the default if unset.
+// A negative value disables waiting.
+func (c *TaggingConfig) attachTimeout() time.Duration {
+	if c.AttachTimeout == 0 {
+		return DefaultAttachTimeout
+	}
+	return c.AttachTimeout
+}
+
+// recheckAfter returns the configured re-check delay, or the default if unset.
+// A negative value disables the re-check.
+func (c *TaggingConfig) recheckAfter() time.Duration {
+	if c.RecheckAfter == 0 {
+		return DefaultRecheckAfter
+	}
+	return c.RecheckAfter
+}
+
+// waitForVolumes polls with backoff until every EBS volume in the instance's
+// BlockDeviceMappings is attached, or the attach timeout passes. It returns the
+// volumes attached so far either way, or an error if ctx is cancelled first.
+// A running instance without EBS block devices is only polled a few times.
+func (l *AutoscalingTagger) waitForVolumes(ctx context.Context, instanceID string) ([]*ec2.Volume, error) {
+	timeout := l.tags.attachTimeout()
+	deadline := time.Now().Add(timeout)
+	backoff := attachInitialBackoff
+	unmappedPolls := 0
+	for {
+		volumes, pending, unmapped, err := l.attachedVolumes(ctx, instanceID)
+		if err != nil {
+			return nil, err
+		}
+		if pending == 0 {
+			return volumes, nil
+		}
+		if unmapped {
+			unmappedPolls++
+			if unmappedPolls >= attachUnmappedPolls {
+				l.log.Debug(fmt.Sprintf("Instance %s has no EBS block devices", instanceID), zap.String("asg", l.asgName))
+				return volumes, nil
+			}
+		}
+		if timeout < 0 || time.Now().Add(backoff).After(deadline) {
+			l.log.Warn(fmt.Sprintf("Timed out waiting for %d block device(s) to attach to %s", pending, instanceID),
+				zap.String("asg", l.asgName))
+			return volumes, nil
+		}
+		l.log.Debug(fmt.Sprintf("Waiting %s for %d block device(s) to attach to %s", backoff, pending, instanceID),
+			zap.String("asg", l.asgName))
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > attachMaxBackoff {
+			backoff = attachMaxBackoff
+		}
+	}
+}
+
+// attachedVolumes returns the volumes attached to instanceID and how many of the
+// instance's expected block devices are still not attached. unmapped is true if
+// the instance is running but reports no block devices yet.
+func (l *AutoscalingTagger) attachedVolumes(ctx context.Context, instanceID string) (volumes []*ec2.Volume, pending int, unmapped bool, err error) {
+	describeCtx, cancel := context.WithTimeout(ctx, l.timeouts.describe())
+	defer cancel()
+	out, err := l.ec2Client.DescribeInstancesWithContext(describeCtx, &ec2.DescribeInstancesInput{
+		InstanceIds: aws.StringSlice([]string{instanceID}),
+	})
+	if err != nil {
+		return nil, 0, false, err
+	}
+	var mappings []*ec2.InstanceBlockDeviceMapping
+	running := false
+	for _, res := range out.Reservations {
+		for _, inst := range res.Instances {
+			mappings = append(mappings, inst.BlockDeviceMappings...)
+			if inst.State != nil && aws.StringValue(inst.State.Name) == ec2.InstanceStateNameRunning {
+				running = true
+			}
+		}
+	}
+
+	described, err := l.describeVolumes(ctx, instanceID)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	attached := make(map[string]*ec2.Volume, len(described))
+	for _, vol := range described {
+		for _, a := range vol.Attachments {
+			if aws.StringValue(a.InstanceId) == instanceID && aws.StringValue(a.State) == ec2.VolumeAttachmentStateAttached {
+				attached[aws.StringValue(vol.VolumeId)] = vol
+			}
+		}
+	}
+
+	// A freshly launched instance may not report its mappings yet
+	if len(mappings) == 0 && len(attached) == 0 {
+		return nil, 1, running, nil
+	}
+
+	for _, m := range mappings {
+		if m.Ebs == nil {
+			continue
+		}
+		if _, ok := attached[aws.StringValue(m.Ebs.VolumeId)]; !ok {
+			pending++
+		}
+	}
+
+	volumes = make([]*ec2.Volume, 0, len(attached))
+	for _, vol := range attached {
+		volumes = append(volumes, vol)
+	}
+	return volumes, pending, false, nil
+}
+
+// scheduleRecheck tags the instance's volumes again after the re-check delay,
+// catching volumes attached late, for example by user-data. The re-check is
+// dropped when the handlers drain, and skipped if the ASG is no longer owned.
+func (l *AutoscalingTagger) scheduleRecheck(instanceID string, extraTags map[string]string) {
+	delay := l.tags.recheckAfter()
+	if delay < 0 {
+		return
+	}
+	l.log.Debug(fmt.Sprintf("Re-checking volumes of %s in %s", instanceID, delay), zap.String("asg", l.asgName))
+	l.handlers.afterFunc(delay, func(work context.Context) {
+		if l.owns != nil && !l.owns(l.asgName) {
+			l.log.Debug(fmt.Sprintf("Skipping re-check of %s, ASG owned by another replica", instanceID), zap.String("asg", l.asgName))
+			return
+		}
+		ctx, cancel := l.timeouts.eventContext(work)
+		defer cancel()
+		if err := l.handle(ctx, instanceID, CauseRecheck, extraTags); err != nil {
+			l.log.Error(fmt.Sprintf("failed to re-check volumes of instance %s", instanceID),
+				zap.String("asg", l.asgName), zap.Error(err))
+		}
+	})
+}
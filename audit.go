@@ -0,0 +1,342 @@
+package tagd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+)
+
+// Cause is the event or handler that caused a tag change.
+type Cause string
+
+const (
+	// CauseLaunch is an ASG launch notification.
+	CauseLaunch Cause = "launch"
+	// CauseBackfill is backfilling existing instances, on startup or by apply.
+	CauseBackfill Cause = "backfill"
+	// CauseRecheck is the re-check for volumes attached after launch.
+	CauseRecheck Cause = "recheck"
+	// CauseAttachVolume is an AttachVolume CloudTrail event.
+	CauseAttachVolume Cause = "attach-volume"
+	// CauseNode is a Kubernetes Node matching a node selector.
+	CauseNode Cause = "node"
+	// CauseNodeLaunch is a newly created Kubernetes Node matching a node selector.
+	CauseNodeLaunch Cause = "node-launch"
+	// CauseSnapshot is a snapshot event or scan.
+	CauseSnapshot Cause = "snapshot"
+	// CausePVC is a Kubernetes PersistentVolume bound to a claim.
+	CausePVC Cause = "pvc"
+	// CauseOrphan is marking an orphaned volume.
+	CauseOrphan Cause = "orphan"
+	// CauseRollback is rolling back earlier changes from the change journal.
+	CauseRollback Cause = "rollback"
+)
+
+// launch returns true if the cause is a new instance whose volumes may still be attaching.
+func (c Cause) launch() bool {
+	return c == CauseLaunch || c == CauseNodeLaunch
+}
+
+const (
+	// AuditCreateTags is a record of tags added or changed.
+	AuditCreateTags = "create-tags"
+	// AuditDeleteTags is a record of tags deleted.
+	AuditDeleteTags = "delete-tags"
+)
+
+// AuditRecord is a tag change of a single resource, written to the audit sink.
+type AuditRecord struct {
+	ID string `json:"id"`
+	// Change is the ID of the change in the change journal, shared by the
+	// records of all resources changed together.
+	Change   string    `json:"change,omitempty"`
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Account  string    `json:"account,omitempty"`
+	Region   string    `json:"region,omitempty"`
+	Resource string    `json:"resource"`
+	// Tags are the tags written, or the keys deleted.
+	Tags map[string]string `json:"tags"`
+	// Previous holds the values the tags had before the change, for those that existed.
+	Previous map[string]string `json:"previous,omitempty"`
+	ASG      string            `json:"asg,omitempty"`
+	// Config is the asgName or nodeSelector of the TaggingConfig that caused the change.
+	Config   string `json:"config,omitempty"`
+	Cause    Cause  `json:"cause,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// Error is set if the change failed.
+	Error string `json:"error,omitempty"`
+}
+
+// AuditConfig selects the sink audit records are written to. Auditing is
+// disabled without a Sink.
+type AuditConfig struct {
+	// Sink is stdout, file or s3.
+	Sink string `yaml:"sink,omitempty"`
+	// Path of the JSONL file written by the file sink.
+	Path string `yaml:"path,omitempty"`
+	// MaxSize in MiB at which the file is rotated, defaults to 100.
+	MaxSize int `yaml:"maxSize,omitempty"`
+	// MaxBackups is the number of rotated files to keep, defaults to 5.
+	MaxBackups int `yaml:"maxBackups,omitempty"`
+	// Bucket and Prefix of the objects written by the s3 sink.
+	Bucket string `yaml:"bucket,omitempty"`
+	Prefix string `yaml:"prefix,omitempty"`
+	// Region of the bucket, defaults to the session's.
+	Region string `yaml:"region,omitempty"`
+	// Endpoint and PathStyle select an S3-compatible store instead of S3.
+	Endpoint  string `yaml:"endpoint,omitempty"`
+	PathStyle bool   `yaml:"pathStyle,omitempty"`
+	// FlushInterval is how often buffered records are uploaded, defaults to 1 minute.
+	FlushInterval time.Duration `yaml:"flushInterval,omitempty"`
+	// MaxBufferedRecords is how many records the s3 sink buffers while uploads
+	// fail, defaults to 10000. Further records are dropped.
+	MaxBufferedRecords int `yaml:"maxBufferedRecords,omitempty"`
+}
+
+func (c *AuditConfig) validate() error {
+	switch c.Sink {
+	case "", auditSinkStdout:
+	case auditSinkFile:
+		if c.Path == "" {
+			return fmt.Errorf("audit: path is required for the file sink")
+		}
+	case auditSinkS3:
+		if c.Bucket == "" {
+			return fmt.Errorf("audit: bucket is required for the s3 sink")
+		}
+	default:
+		return fmt.Errorf("audit: unknown sink %q", c.Sink)
+	}
+	if c.MaxSize < 0 || c.MaxBackups < 0 || c.FlushInterval < 0 || c.MaxBufferedRecords < 0 {
+		return fmt.Errorf("audit: maxSize, maxBackups, flushInterval and maxBufferedRecords must not be negative")
+	}
+	return nil
+}
+
+// Auditor writes an AuditRecord for every tag change to an AuditSink, and the
+// previous values of the tags to the change journal before the change is made.
+// A nil Auditor doesn't record anything, so callers don't need to check if
+// auditing is enabled.
+type Auditor struct {
+	sink    AuditSink
+	journal *Journal
+	scope   Scope
+	log     *zap.Logger
+}
+
+// NewAuditor returns an Auditor writing to sink and journal, either of which may be nil.
+func NewAuditor(sink AuditSink, journal *Journal, logger *zap.Logger) *Auditor {
+	return &Auditor{sink: sink, journal: journal, log: logger}
+}
+
+// OpenAuditor returns an Auditor for the configured audit sink and change
+// journal, or nil if both are disabled.
+func OpenAuditor(config *Config, sess *session.Session, logger *zap.Logger) (*Auditor, error) {
+	var sink AuditSink
+	var journal *Journal
+	var err error
+	if config.Audit.Sink != "" {
+		if sink, err = NewAuditSink(&config.Audit, sess); err != nil {
+			return nil, err
+		}
+	}
+	if config.Journal.Path != "" {
+		if journal, err = OpenJournal(config.Journal.Path); err != nil {
+			if sink != nil {
+				sink.Close()
+			}
+			return nil, err
+		}
+	}
+	if sink == nil && journal == nil {
+		return nil, nil
+	}
+	return NewAuditor(sink, journal, logger), nil
+}
+
+// ForScope returns an Auditor sharing the sink and journal that records changes in s.
+func (a *Auditor) ForScope(s Scope) *Auditor {
+	if a == nil {
+		return nil
+	}
+	scoped := *a
+	scoped.scope = s
+	return &scoped
+}
+
+// tagResources tags resourceIDs with svc and records the change of each resource,
+// with the previous values of its tags. rec holds the fields common to all records.
+// current are the tags of the resources if the caller looked them up already, as
+// from describeResourceTags, or nil.
+func (a *Auditor) tagResources(ctx context.Context, svc EC2Client, rec AuditRecord, resourceIDs []*string, tags map[string]string, current map[string]map[string]string) error {
+	if a == nil {
+		return tagResources(ctx, svc, resourceIDs, tags)
+	}
+	rec.Action = AuditCreateTags
+	return a.change(ctx, svc, rec, resourceIDs, tags, current, func() error {
+		return tagResources(ctx, svc, resourceIDs, tags)
+	})
+}
+
+// deleteTags deletes the keys of tags from resourceIDs with svc and records the change.
+func (a *Auditor) deleteTags(ctx context.Context, svc EC2Client, rec AuditRecord, resourceIDs []*string, tags map[string]string) error {
+	if a == nil {
+		return deleteTags(ctx, svc, resourceIDs, tags)
+	}
+	rec.Action = AuditDeleteTags
+	return a.change(ctx, svc, rec, resourceIDs, tags, nil, func() error {
+		return deleteTags(ctx, svc, resourceIDs, tags)
+	})
+}
+
+// change journals the previous tags of resourceIDs, looking them up unless given,
+// makes the change and records its result.
+func (a *Auditor) change(ctx context.Context, svc EC2Client, rec AuditRecord, resourceIDs []*string, tags map[string]string, previous map[string]map[string]string, apply func() error) error {
+	ids := aws.StringValueSlice(resourceIDs)
+	var err error
+	if previous == nil {
+		previous, err = describeResourceTags(ctx, svc, resourceIDs)
+	}
+	if err != nil {
+		// The change can't be rolled back without the previous values
+		if a.journal != nil {
+			return fmt.Errorf("failed to look up tags for the change journal: %w", err)
+		}
+		// but the change is more important than its audit record being complete
+		a.log.Warn("Failed to look up previous tags for the audit record", zap.Error(err))
+	}
+	rec.Change = newAuditID()
+	rec.Account = a.scope.Account
+	rec.Region = a.scope.Region
+	if a.journal != nil {
+		if err := a.journal.Append(newJournalEntry(&rec, ids, tags, previous)); err != nil {
+			return fmt.Errorf("failed to write change journal: %w", err)
+		}
+	}
+	err = apply()
+	a.record(rec, ids, tags, previous, err)
+	return err
+}
+
+// record writes a record of the change of tags to each resource. previous holds
+// the tags of each resource before the change and err the result of the change.
+func (a *Auditor) record(rec AuditRecord, resourceIDs []string, tags map[string]string, previous map[string]map[string]string, err error) {
+	if a == nil || a.sink == nil {
+		return
+	}
+	rec.Time = time.Now().UTC()
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	for _, id := range resourceIDs {
+		r := rec
+		r.ID = newAuditID()
+		r.Resource = id
+		r.Tags = tags
+		r.Previous = nil
+		for k := range tags {
+			if old, exists := previous[id][k]; exists {
+				if r.Previous == nil {
+					r.Previous = make(map[string]string)
+				}
+				r.Previous[k] = old
+			}
+		}
+		if err := a.sink.Write(&r); err != nil {
+			a.log.Error(fmt.Sprintf("Failed to write audit record for %s", id), zap.Error(err))
+		}
+	}
+}
+
+// AuditStats are the records the audit sink dropped since it was opened.
+type AuditStats struct {
+	Dropped uint64
+}
+
+// Stats returns the records the sink dropped. Only the s3 sink drops records.
+func (a *Auditor) Stats() AuditStats {
+	if a == nil {
+		return AuditStats{}
+	}
+	if s, ok := a.sink.(*S3AuditSink); ok {
+		return AuditStats{Dropped: s.Dropped()}
+	}
+	return AuditStats{}
+}
+
+// Flush writes buffered records to the sink's storage.
+func (a *Auditor) Flush() error {
+	if a == nil || a.sink == nil {
+		return nil
+	}
+	return a.sink.Flush()
+}
+
+// Close flushes and closes the sink and closes the journal.
+func (a *Auditor) Close() error {
+	if a == nil {
+		return nil
+	}
+	var err error
+	if a.sink != nil {
+		err = a.sink.Close()
+	}
+	if a.journal != nil {
+		if jerr := a.journal.Close(); err == nil {
+			err = jerr
+		}
+	}
+	return err
+}
+
+// name identifies the TaggingConfig in audit records.
+func (c *TaggingConfig) name() string {
+	if c.ASGName != "" {
+		return c.ASGName
+	}
+	return c.NodeSelector
+}
+
+func newAuditID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// describeResourceTags returns the tags of each resource, keyed by resource ID.
+// Every resource has an entry, even if it has no tags.
+func describeResourceTags(ctx context.Context, svc EC2Client, resourceIDs []*string) (map[string]map[string]string, error) {
+	current := make(map[string]map[string]string, len(resourceIDs))
+	for _, id := range aws.StringValueSlice(resourceIDs) {
+		current[id] = make(map[string]string)
+	}
+	input := &ec2.DescribeTagsInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("resource-id"),
+				Values: resourceIDs,
+			},
+		},
+	}
+	err := svc.DescribeTagsPagesWithContext(ctx, input, func(page *ec2.DescribeTagsOutput, lastPage bool) bool {
+		for _, t := range page.Tags {
+			id := aws.StringValue(t.ResourceId)
+			if current[id] == nil {
+				current[id] = make(map[string]string)
+			}
+			current[id][aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+		}
+		return true
+	})
+	return current, err
+}
@@ -0,0 +1,49 @@
+package tagd
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/leosunmo/tagd/tagdtest"
+	"go.uber.org/zap"
+)
+
+// recordingSink keeps the audit records written to it.
+type recordingSink struct {
+	mu      sync.Mutex
+	records []AuditRecord
+}
+
+func (s *recordingSink) Write(r *AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, *r)
+	return nil
+}
+
+func (s *recordingSink) Flush() error { return nil }
+func (s *recordingSink) Close() error { return nil }
+
+func TestTagLooksUpCurrentTagsOnce(t *testing.T) {
+	backend := tagdtest.NewBackend("", "")
+	vol := backend.CreateVolume(tagdtest.VolumeSpec{Tags: map[string]string{"env": "dev"}})
+	sink := &recordingSink{}
+	conf := &TaggingConfig{ASGName: "web", Tags: map[string]string{"env": "prod"}}
+	tagger := NewAutoscalingTagger("web", conf, nil, backend.Autoscaling(), backend.EC2(), zap.NewNop())
+	tagger.audit = NewAuditor(sink, nil, zap.NewNop())
+
+	if err := tagger.tag(context.Background(), CauseBackfill, "i-1", aws.StringSlice([]string{vol}), conf.Tags); err != nil {
+		t.Fatal(err)
+	}
+	if calls := backend.Calls("DescribeTags"); calls != 1 {
+		t.Errorf("DescribeTags calls = %d, want 1", calls)
+	}
+	if len(sink.records) != 1 || sink.records[0].Previous["env"] != "dev" {
+		t.Errorf("audit records = %+v, want one with the previous env tag", sink.records)
+	}
+	if got := backend.Tags(vol)["env"]; got != "prod" {
+		t.Errorf("env tag = %q, want prod", got)
+	}
+}
@@ -0,0 +1,357 @@
+package tagd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+const (
+	auditSinkStdout = "stdout"
+	auditSinkFile   = "file"
+	auditSinkS3     = "s3"
+
+	defaultAuditMaxSize       = 100 // MiB
+	defaultAuditMaxBackups    = 5
+	defaultAuditFlushInterval = time.Minute
+
+	// Buffered S3 records are uploaded early once there are this many.
+	auditUploadRecords = 1000
+	// S3 records buffered while uploads fail are dropped beyond this many.
+	defaultAuditMaxBuffered = 10000
+	// A hung upload must not block writing records or shutting down.
+	auditUploadTimeout = time.Minute
+)
+
+// AuditSink stores AuditRecords. Implementations must be safe for concurrent use.
+type AuditSink interface {
+	Write(r *AuditRecord) error
+	// Flush writes buffered records to storage.
+	Flush() error
+	Close() error
+}
+
+// NewAuditSink returns the sink selected by conf.
+func NewAuditSink(conf *AuditConfig, sess *session.Session) (AuditSink, error) {
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	switch conf.Sink {
+	case auditSinkFile:
+		maxSize, maxBackups := conf.MaxSize, conf.MaxBackups
+		if maxSize == 0 {
+			maxSize = defaultAuditMaxSize
+		}
+		if maxBackups == 0 {
+			maxBackups = defaultAuditMaxBackups
+		}
+		return NewFileAuditSink(conf.Path, int64(maxSize)<<20, maxBackups)
+	case auditSinkS3:
+		cfg := &aws.Config{S3ForcePathStyle: aws.Bool(conf.PathStyle)}
+		if conf.Region != "" {
+			cfg.Region = aws.String(conf.Region)
+		}
+		if conf.Endpoint != "" {
+			cfg.Endpoint = aws.String(conf.Endpoint)
+		}
+		interval := conf.FlushInterval
+		if interval == 0 {
+			interval = defaultAuditFlushInterval
+		}
+		maxBuffered := conf.MaxBufferedRecords
+		if maxBuffered == 0 {
+			maxBuffered = defaultAuditMaxBuffered
+		}
+		return NewS3AuditSink(s3.New(sess, cfg), conf.Bucket, conf.Prefix, interval, maxBuffered), nil
+	}
+	return NewWriterAuditSink(os.Stdout), nil
+}
+
+// WriterAuditSink writes records as JSON lines to a writer, e.g. stdout.
+type WriterAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterAuditSink returns a sink writing to w.
+func NewWriterAuditSink(w io.Writer) *WriterAuditSink {
+	return &WriterAuditSink{w: w}
+}
+
+func (s *WriterAuditSink) Write(r *AuditRecord) error {
+	line, err := marshalAuditRecord(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(line)
+	return err
+}
+
+func (s *WriterAuditSink) Flush() error { return nil }
+
+func (s *WriterAuditSink) Close() error { return nil }
+
+// FileAuditSink appends records as JSON lines to a file, rotating it once it
+// reaches a maximum size. Rotated files are renamed with a .1, .2, ... suffix,
+// the highest being the oldest.
+type FileAuditSink struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+// NewFileAuditSink opens or creates the file at path. It is rotated when it
+// would grow past maxSize bytes, keeping maxBackups rotated files.
+func NewFileAuditSink(path string, maxSize int64, maxBackups int) (*FileAuditSink, error) {
+	s := &FileAuditSink{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileAuditSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open audit file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open audit file: %w", err)
+	}
+	s.f, s.size = f, info.Size()
+	return nil
+}
+
+func (s *FileAuditSink) Write(r *AuditRecord) error {
+	line, err := marshalAuditRecord(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return fmt.Errorf("audit file %s is closed", s.path)
+	}
+	if s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// rotate shifts the backups by one, dropping the oldest, and starts a new file.
+func (s *FileAuditSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	s.f = nil
+	for i := s.maxBackups; i > 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", s.path, i-1), fmt.Sprintf("%s.%d", s.path, i))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	var err error
+	if s.maxBackups > 0 {
+		err = os.Rename(s.path, s.path+".1")
+	} else {
+		err = os.Remove(s.path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to rotate audit file: %w", err)
+	}
+	return s.open()
+}
+
+func (s *FileAuditSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Sync()
+}
+
+func (s *FileAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// S3AuditSink buffers records and uploads them as JSONL objects to an S3 or
+// S3-compatible bucket, every flush interval or once enough are buffered. Objects
+// are named <prefix>YYYY/MM/DD/HHMMSS.nnnnnnnnn-<sink ID>.jsonl, so several
+// instances of tagd can share a bucket.
+//
+// Uploads run in the background, so writing a record never waits for S3. While
+// uploads fail, records stay buffered up to a maximum, and records beyond it are
+// dropped and counted.
+type S3AuditSink struct {
+	// dropped is first for 64-bit alignment of atomic operations
+	dropped uint64
+
+	client      s3iface.S3API
+	bucket      string
+	prefix      string
+	id          string
+	maxBuffered int
+
+	mu    sync.Mutex
+	buf   bytes.Buffer
+	count int
+	// uploading serializes uploads, which run without holding mu
+	uploading sync.Mutex
+
+	upload chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+var errAuditBufferFull = errors.New("audit buffer full, record dropped")
+
+// NewS3AuditSink returns a sink uploading to bucket every interval, buffering
+// up to maxBuffered records.
+func NewS3AuditSink(client s3iface.S3API, bucket, prefix string, interval time.Duration, maxBuffered int) *S3AuditSink {
+	s := &S3AuditSink{
+		client:      client,
+		bucket:      bucket,
+		prefix:      prefix,
+		id:          newAuditID(),
+		maxBuffered: maxBuffered,
+		upload:      make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go s.run(interval)
+	return s
+}
+
+func (s *S3AuditSink) run(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		case <-s.upload:
+		}
+		// Failed uploads stay buffered and are retried on the next tick
+		s.Flush()
+	}
+}
+
+// Write buffers r, starting an upload in the background once enough records are
+// buffered. If the buffer is full, r is dropped and errAuditBufferFull returned.
+func (s *S3AuditSink) Write(r *AuditRecord) error {
+	line, err := marshalAuditRecord(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.count >= s.maxBuffered {
+		atomic.AddUint64(&s.dropped, 1)
+		return errAuditBufferFull
+	}
+	s.buf.Write(line)
+	s.count++
+	// Signal every auditUploadRecords records, so failing uploads aren't retried on every write
+	if s.count%auditUploadRecords == 0 {
+		select {
+		case s.upload <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Dropped returns the number of records dropped because the buffer was full.
+func (s *S3AuditSink) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Flush uploads the buffered records. Records written during the upload stay
+// buffered for the next one.
+func (s *S3AuditSink) Flush() error {
+	s.uploading.Lock()
+	defer s.uploading.Unlock()
+
+	s.mu.Lock()
+	count := s.count
+	data := append([]byte(nil), s.buf.Bytes()...)
+	s.mu.Unlock()
+	if count == 0 {
+		return nil
+	}
+
+	key := fmt.Sprintf("%s%s-%s.jsonl", s.prefix, time.Now().UTC().Format("2006/01/02/150405.000000000"), s.id)
+	ctx, cancel := context.WithTimeout(context.Background(), auditUploadTimeout)
+	defer cancel()
+	_, err := s.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/x-ndjson"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload audit records to s3://%s/%s: %w", s.bucket, key, err)
+	}
+
+	s.mu.Lock()
+	s.buf.Next(len(data))
+	s.count -= count
+	s.mu.Unlock()
+	return nil
+}
+
+// Close stops the periodic uploads and uploads the remaining records.
+func (s *S3AuditSink) Close() error {
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+	<-s.done
+	return s.Flush()
+}
+
+func marshalAuditRecord(r *AuditRecord) ([]byte, error) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
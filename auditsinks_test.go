@@ -0,0 +1,121 @@
+package tagd
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// fakeS3 records the objects put, failing while err is set and blocking while
+// block is open.
+type fakeS3 struct {
+	s3iface.S3API
+	mu      sync.Mutex
+	err     error
+	block   chan struct{}
+	objects [][]byte
+}
+
+func (f *fakeS3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	f.mu.Lock()
+	block, err := f.block, f.err
+	f.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, _ := ioutil.ReadAll(input.Body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects = append(f.objects, data)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) lines() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, o := range f.objects {
+		n += bytes.Count(o, []byte("\n"))
+	}
+	return n
+}
+
+func TestS3AuditSinkDropsRecordsWhenFull(t *testing.T) {
+	client := &fakeS3{err: errors.New("service unavailable")}
+	s := NewS3AuditSink(client, "bucket", "", time.Hour, 5)
+	defer s.Close()
+
+	var dropped int
+	for i := 0; i < 7; i++ {
+		if err := s.Write(&AuditRecord{Resource: "vol-1"}); err == errAuditBufferFull {
+			dropped++
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dropped != 2 || s.Dropped() != 2 {
+		t.Errorf("dropped %d records, Dropped() = %d, want 2", dropped, s.Dropped())
+	}
+	if err := s.Flush(); err == nil {
+		t.Fatal("Flush succeeded with a failing client")
+	}
+
+	// The buffered records are uploaded once S3 is back
+	client.mu.Lock()
+	client.err = nil
+	client.mu.Unlock()
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := client.lines(); n != 5 {
+		t.Errorf("uploaded %d records, want 5", n)
+	}
+	if err := s.Write(&AuditRecord{Resource: "vol-1"}); err != nil {
+		t.Errorf("Write after the upload = %v", err)
+	}
+}
+
+func TestS3AuditSinkUploadsInBackground(t *testing.T) {
+	client := &fakeS3{block: make(chan struct{})}
+	s := NewS3AuditSink(client, "bucket", "", time.Hour, 2*auditUploadRecords)
+
+	// Filling a batch starts an upload, which hangs without blocking writes
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < auditUploadRecords+10; i++ {
+			if err := s.Write(&AuditRecord{Resource: "vol-1"}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write blocked on a hung upload")
+	}
+
+	// Records written during the upload are uploaded by the next one
+	client.mu.Lock()
+	close(client.block)
+	client.block = nil
+	client.mu.Unlock()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := client.lines(); n != auditUploadRecords+10 {
+		t.Errorf("uploaded %d records, want %d", n, auditUploadRecords+10)
+	}
+}
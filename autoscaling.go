@@ -3,8 +3,9 @@
 package tagd
 
 import (
+	"context"
 	"fmt"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -15,6 +16,13 @@ import (
 	"go.uber.org/zap"
 )
 
+const (
+	// MarkerTagASG is added to every volume tagd tags and records the managing ASG.
+	MarkerTagASG = "tagd:asg"
+	// MarkerTagInstance records the instance a volume was attached to when it was tagged.
+	MarkerTagInstance = "tagd:instance-id"
+)
+
 // AutoscalingClient for testing purposes
 type AutoscalingClient autoscalingiface.AutoScalingAPI
 
@@ -53,6 +61,7 @@ type Message struct {
 	GroupName     string    `json:"AutoScalingGroupName"`
 	Event         string    `json:"Event"`
 	Cause         string    `json:"Cause"`
+	ActivityID    string    `json:"ActivityId"`
 	EC2InstanceID string    `json:"EC2InstanceId"`
 }
 
@@ -63,7 +72,16 @@ type AutoscalingTagger struct {
 	queue       *Queue
 	autoscaling AutoscalingClient
 	ec2Client   EC2Client
+	nodeLabeler *NodeLabeler
+	planner     *planner
+	audit       *Auditor
+	handlers    *drainGroup
+	owns        func(asgName string) bool
+	timeouts    TimeoutConfig
 	log         *zap.Logger
+
+	mu      sync.Mutex
+	asgTags map[string]string
 }
 
 // NewAutoscalingTagger returns a new AutoscalingTagger for an ASG
@@ -83,19 +101,93 @@ func (l *AutoscalingTagger) Name() string {
 	return l.asgName
 }
 
-func (l *AutoscalingTagger) Handle(InstanceID string) error {
-	tags, err := l.buildTags(InstanceID)
-	if err != nil {
+// Handle tags the configured resources of the instance as they are now.
+func (l *AutoscalingTagger) Handle(ctx context.Context, instanceID string) error {
+	return l.handle(ctx, instanceID, CauseBackfill, nil)
+}
+
+// HandleLaunch tags the configured resources of a newly launched instance. It waits
+// for the instance's block devices to attach before tagging volumes and schedules
+// a re-check for resources attached after boot.
+func (l *AutoscalingTagger) HandleLaunch(ctx context.Context, instanceID string) error {
+	if err := l.handle(ctx, instanceID, CauseLaunch, nil); err != nil {
 		return err
 	}
-	err = l.tagVolumes(InstanceID, tags)
+	l.scheduleRecheck(instanceID, nil)
+	return nil
+}
+
+// handle tags the configured resources of the instance for cause. extraTags are
+// applied over the copied instance tags, but the static tags take precedence.
+func (l *AutoscalingTagger) handle(ctx context.Context, instanceID string, cause Cause, extraTags map[string]string) error {
+	tags, err := l.buildTags(ctx, instanceID)
 	if err != nil {
 		return err
 	}
+	for k, v := range extraTags {
+		if _, static := l.tags.Tags[k]; !static {
+			tags[k] = v
+		}
+	}
+	for _, kind := range l.tags.resources() {
+		switch kind {
+		case ResourceInstance:
+			err = l.tagInstance(ctx, cause, instanceID, tags)
+		case ResourceVolumes:
+			var volumes []*ec2.Volume
+			if cause.launch() {
+				volumes, err = l.waitForVolumes(ctx, instanceID)
+			} else {
+				volumes, err = l.describeVolumes(ctx, instanceID)
+			}
+			if err == nil {
+				err = l.tagVolumes(ctx, cause, instanceID, volumes, tags)
+			}
+		case ResourceNetworkInterfaces:
+			err = l.tagNetworkInterfaces(ctx, cause, instanceID, tags)
+		case ResourceElasticIPs:
+			err = l.tagElasticIPs(ctx, cause, instanceID, tags)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to tag %s: %w", kind, err)
+		}
+	}
+	if l.nodeLabeler != nil {
+		if err := l.nodeLabeler.LabelNode(ctx, instanceID, tags); err != nil {
+			return fmt.Errorf("failed to label node: %w", err)
+		}
+	}
 	return nil
 }
 
-func (l *AutoscalingTagger) EnableNotifications() error {
+// HandleAttachedVolume tags a single volume attached to the instance after launch.
+func (l *AutoscalingTagger) HandleAttachedVolume(ctx context.Context, instanceID, volumeID string) error {
+	if !l.tags.tagsResource(ResourceVolumes) {
+		l.log.Debug(fmt.Sprintf("Skipping volume %s, volumes not configured", volumeID), zap.String("asg", l.asgName))
+		return nil
+	}
+	tags, err := l.buildTags(ctx, instanceID)
+	if err != nil {
+		return err
+	}
+	// Describe the volume for the volume selectors
+	describeCtx, cancel := context.WithTimeout(ctx, l.timeouts.describe())
+	defer cancel()
+	out, err := l.ec2Client.DescribeVolumesWithContext(describeCtx, &ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("volume-id"),
+				Values: aws.StringSlice([]string{volumeID}),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return l.tagVolumes(ctx, CauseAttachVolume, instanceID, out.Volumes, tags)
+}
+
+func (l *AutoscalingTagger) EnableNotifications(ctx context.Context) error {
 	l.log.Debug("Enabling SNS Notification", zap.String("asg", l.asgName))
 
 	svc := l.autoscaling
@@ -107,21 +199,23 @@ func (l *AutoscalingTagger) EnableNotifications() error {
 		TopicARN: aws.String(l.queue.topicArn),
 	}
 
-	_, err := svc.PutNotificationConfiguration(input)
+	ctx, cancel := context.WithTimeout(ctx, l.timeouts.notifications())
+	defer cancel()
+	_, err := svc.PutNotificationConfigurationWithContext(ctx, input)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (l *AutoscalingTagger) buildTags(instanceID string) (map[string]string, error) {
+func (l *AutoscalingTagger) buildTags(ctx context.Context, instanceID string) (map[string]string, error) {
 	l.log.Debug(fmt.Sprintf("Processing tags for instance %s", instanceID), zap.String("asg", l.asgName))
 	// final product
 	tagMap := make(map[string]string)
 
 	svc := l.ec2Client
 	input := ec2.DescribeTagsInput{
-		MaxResults: aws.Int64(50), // We only do 50 tags, not sure if that's a sane default
+		MaxResults: aws.Int64(1000),
 		Filters: []*ec2.Filter{
 			{
 				Name: aws.String("resource-id"),
@@ -132,24 +226,30 @@ func (l *AutoscalingTagger) buildTags(instanceID string) (map[string]string, err
 		},
 	}
 
-	result, err := svc.DescribeTags(&input)
+	// build tag map for easier handling
+	instanceTagMap := make(map[string]string)
+	describeCtx, cancel := context.WithTimeout(ctx, l.timeouts.describe())
+	defer cancel()
+	err := svc.DescribeTagsPagesWithContext(describeCtx, &input, func(page *ec2.DescribeTagsOutput, lastPage bool) bool {
+		for _, tagDesc := range page.Tags {
+			instanceTagMap[aws.StringValue(tagDesc.Key)] = aws.StringValue(tagDesc.Value)
+		}
+		return true
+	})
 	if err != nil {
 		return tagMap, err
 	}
-	// build tag map for easier handling
-	instanceTagMap := make(map[string]string, len(result.Tags))
-	for _, tagDesc := range result.Tags {
-		instanceTagMap[*tagDesc.Key] = *tagDesc.Value
-	}
 
-	// process prefixed tags first as the statically configured ones should override
-	for k, v := range instanceTagMap {
-		for _, prefix := range l.tags.KeyPrefix {
-			if strings.HasPrefix(strings.ToUpper(k), strings.ToUpper(prefix)) {
-				tagMap[k] = v
-			}
+	// process copied tags first as the statically configured ones should override,
+	// starting with the ASG's tags as the instance's own are more specific
+	if l.tags.InheritASGTags && l.asgName != "" {
+		asgTags, err := l.inheritedASGTags(ctx)
+		if err != nil {
+			return tagMap, fmt.Errorf("failed to look up ASG tags: %w", err)
 		}
+		l.tags.copier().copy(tagMap, asgTags)
 	}
+	l.tags.copier().copy(tagMap, instanceTagMap)
 	// then add the statically configured ones.
 	for staticK, staticV := range l.tags.Tags {
 		tagMap[staticK] = staticV
@@ -158,12 +258,14 @@ func (l *AutoscalingTagger) buildTags(instanceID string) (map[string]string, err
 }
 
 // Instances return all instance IDs belonging to the ASG
-func (l *AutoscalingTagger) instances() ([]string, error) {
+func (l *AutoscalingTagger) instances(ctx context.Context) ([]string, error) {
 	input := &autoscaling.DescribeAutoScalingGroupsInput{
 		AutoScalingGroupNames: aws.StringSlice([]string{l.asgName}),
 		MaxRecords:            aws.Int64(100),
 	}
-	result, err := l.autoscaling.DescribeAutoScalingGroups(input)
+	ctx, cancel := context.WithTimeout(ctx, l.timeouts.describe())
+	defer cancel()
+	result, err := l.autoscaling.DescribeAutoScalingGroupsWithContext(ctx, input)
 	if err != nil {
 		return []string{}, err
 	}
@@ -179,9 +281,8 @@ func (l *AutoscalingTagger) instances() ([]string, error) {
 	return instances, nil
 }
 
-// TagVolumes tags all volumes attached to instanceID with the configured tags for the AutoscalingTagger
-func (l *AutoscalingTagger) tagVolumes(instanceID string, tags map[string]string) error {
-	l.log.Info(fmt.Sprintf("Tagging disks attached to instance %s", instanceID), zap.String("asg", l.asgName))
+// describeVolumes returns the volumes attached, or attaching, to instanceID.
+func (l *AutoscalingTagger) describeVolumes(ctx context.Context, instanceID string) ([]*ec2.Volume, error) {
 	svc := l.ec2Client
 	input := &ec2.DescribeVolumesInput{
 		Filters: []*ec2.Filter{
@@ -193,50 +294,159 @@ func (l *AutoscalingTagger) tagVolumes(instanceID string, tags map[string]string
 			},
 		},
 	}
-	result, err := svc.DescribeVolumes(input)
+	ctx, cancel := context.WithTimeout(ctx, l.timeouts.describe())
+	defer cancel()
+	result, err := svc.DescribeVolumesWithContext(ctx, input)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return result.Volumes, nil
+}
+
+// tagVolumes tags volumes attached to instanceID with the configured tags for the AutoscalingTagger,
+// applying the volume selectors to each volume.
+func (l *AutoscalingTagger) tagVolumes(ctx context.Context, cause Cause, instanceID string, volumes []*ec2.Volume, tags map[string]string) error {
+	l.log.Info(fmt.Sprintf("Tagging disks attached to instance %s", instanceID), zap.String("asg", l.asgName))
 
-	if len(result.Volumes) == 0 {
+	if len(volumes) == 0 {
 		l.log.Debug(fmt.Sprintf("No volumes found on instance %s", instanceID))
 		return nil
 	}
 
-	var volumeIDs []*string
-	for _, vol := range result.Volumes {
-		l.log.Debug(fmt.Sprintf("Found volume %s", *vol.VolumeId))
-		volumeIDs = append(volumeIDs, vol.VolumeId)
+	var rootDevice string
+	if l.tags.usesRoot() {
+		var err error
+		if rootDevice, err = l.rootDeviceName(ctx, instanceID); err != nil {
+			return err
+		}
 	}
 
-	err = l.TagResources(volumeIDs, tags)
-	if err != nil {
+	// Group volumes getting the same tags to tag them in one call
+	type volumeGroup struct {
+		ids  []*string
+		tags map[string]string
+	}
+	groups := make(map[string]*volumeGroup)
+	var order []string
+	var reattached []*string
+	tagged := 0
+	for _, vol := range volumes {
+		if _, ok := ec2TagMap(vol.Tags)[MarkerTagOrphanedSince]; ok {
+			reattached = append(reattached, vol.VolumeId)
+		}
+		device := attachmentDevice(vol, instanceID)
+		l.log.Debug(fmt.Sprintf("Found volume %s (%s)", *vol.VolumeId, device))
+		volumeTags, ok := l.tags.volumeTags(vol, device, rootDevice, tags)
+		if !ok {
+			l.log.Debug(fmt.Sprintf("Volume %s excluded by volume selector", *vol.VolumeId))
+			continue
+		}
+
+		// Mark the volumes so they can be traced back to us once the instance is gone
+		if l.asgName != "" {
+			volumeTags[MarkerTagASG] = l.asgName
+		}
+		volumeTags[MarkerTagInstance] = instanceID
+
+		key := tagSetKey(volumeTags)
+		g, exists := groups[key]
+		if !exists {
+			g = &volumeGroup{tags: volumeTags}
+			groups[key] = g
+			order = append(order, key)
+		}
+		g.ids = append(g.ids, vol.VolumeId)
+		tagged++
+	}
+
+	for _, key := range order {
+		if err := l.tag(ctx, cause, instanceID, groups[key].ids, groups[key].tags); err != nil {
+			return err
+		}
+	}
+	if err := l.clearOrphanMarker(ctx, cause, instanceID, reattached); err != nil {
 		return err
 	}
 
-	l.log.Debug(fmt.Sprintf("Tagged %d volume(s) attached to %s", len(volumeIDs), instanceID))
+	l.log.Debug(fmt.Sprintf("Tagged %d volume(s) attached to %s", tagged, instanceID))
 	return nil
 }
 
-// TagResources takes a list of AWS resource IDs and tags them all with the provided tags
-func (l *AutoscalingTagger) TagResources(resourceIDs []*string, tags map[string]string) error {
-	ec2Tags := toEC2Tags(tags)
-	svc := l.ec2Client
+// clearOrphanMarker removes MarkerTagOrphanedSince from volumes attached again,
+// so they get a full retention period if they are ever orphaned again.
+func (l *AutoscalingTagger) clearOrphanMarker(ctx context.Context, cause Cause, instanceID string, volumeIDs []*string) error {
+	if len(volumeIDs) == 0 || l.planner != nil {
+		return nil
+	}
+	l.log.Info(fmt.Sprintf("Removing %s from %d reattached volume(s)", MarkerTagOrphanedSince, len(volumeIDs)), zap.String("asg", l.asgName))
+	ctx, cancel := context.WithTimeout(ctx, l.timeouts.tag())
+	defer cancel()
+	rec := AuditRecord{ASG: l.asgName, Config: l.tags.name(), Cause: cause, Instance: instanceID}
+	if err := l.audit.deleteTags(ctx, l.ec2Client, rec, volumeIDs, map[string]string{MarkerTagOrphanedSince: ""}); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", MarkerTagOrphanedSince, err)
+	}
+	return nil
+}
+
+// TagResources takes a list of AWS resource IDs and tags them all with the provided tags,
+// after dropping tags EC2 would reject and truncating them to the tag limit.
+func (l *AutoscalingTagger) TagResources(ctx context.Context, resourceIDs []*string, tags map[string]string) error {
+	return l.tag(ctx, "", "", resourceIDs, tags)
+}
+
+// tag is TagResources recording cause and the instance the resources belong to
+// in the audit records.
+func (l *AutoscalingTagger) tag(ctx context.Context, cause Cause, instanceID string, resourceIDs []*string, tags map[string]string) error {
+	// Tags already on the resources count towards the tag limit
+	describeCtx, cancel := context.WithTimeout(ctx, l.timeouts.describe())
+	current, err := describeResourceTags(describeCtx, l.ec2Client, resourceIDs)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("failed to look up current tags: %w", err)
+	}
+	set := l.tags.tagSet(tags)
+	if violations := set.Normalize(l.tags.maxTags(), current); len(violations) > 0 {
+		l.log.Warn(fmt.Sprintf("Dropped %d tag(s) for %d resource(s)", len(violations), len(resourceIDs)),
+			zap.String("asg", l.asgName), zap.Strings("violations", violationStrings(violations)))
+	}
+	ctx, cancel = context.WithTimeout(ctx, l.timeouts.tag())
+	defer cancel()
+	if l.planner != nil {
+		return l.planner.record(ctx, l, resourceIDs, set.Map())
+	}
+	rec := AuditRecord{ASG: l.asgName, Config: l.tags.name(), Cause: cause, Instance: instanceID}
+	return l.audit.tagResources(ctx, l.ec2Client, rec, resourceIDs, set.Map(), current)
+}
 
+// tagResources tags all resourceIDs with the provided tags
+func tagResources(ctx context.Context, svc EC2Client, resourceIDs []*string, tags map[string]string) error {
 	tagInput := &ec2.CreateTagsInput{
 		Resources: resourceIDs,
-		Tags:      ec2Tags,
+		Tags:      toEC2Tags(tags),
 	}
 
-	_, err := svc.CreateTags(tagInput)
+	_, err := svc.CreateTagsWithContext(ctx, tagInput)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// deleteTags deletes the keys of tags from all resourceIDs, whatever their values.
+func deleteTags(ctx context.Context, svc EC2Client, resourceIDs []*string, tags map[string]string) error {
+	keys := make([]*ec2.Tag, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, &ec2.Tag{Key: aws.String(k)})
+	}
+	_, err := svc.DeleteTagsWithContext(ctx, &ec2.DeleteTagsInput{
+		Resources: resourceIDs,
+		Tags:      keys,
+	})
+	return err
+}
+
 func toEC2Tags(tags map[string]string) []*ec2.Tag {
-	ec2Tags := make([]*ec2.Tag, len(tags))
+	ec2Tags := make([]*ec2.Tag, 0, len(tags))
 	for k, v := range tags {
 		ec2Tag := &ec2.Tag{
 			Key:   aws.String(k),
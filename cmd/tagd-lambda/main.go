@@ -0,0 +1,121 @@
+// Command tagd-lambda runs tagd as an AWS Lambda function consuming the SQS queue.
+//
+// The config is read from the TAGD_CONFIG environment variable if set, otherwise
+// from the file named by TAGD_CONFIG_FILE, by default config.yaml bundled with the
+// function. The function must have ReportBatchItemFailures enabled on its SQS
+// event source mapping for failed records to be retried on their own.
+//
+// To test locally, build with the replay tag and pass an SQS event fixture with
+// --event. The event is replayed offline against an in-memory fake of AWS holding
+// the resources it refers to, and the handler's response and the resulting tags
+// are printed instead of starting the Lambda runtime.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/leosunmo/tagd"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// replay handles the SQS event in a file offline and prints the response. It's
+// only built with the replay tag, keeping the fakes out of the function.
+var replay func(config *tagd.Config, path string, logger *zap.Logger) error
+
+func main() {
+	var eventFile string
+	if replay != nil {
+		flag.StringVar(&eventFile, "event", "", "Invoke the handler once with the SQS event in this file and print the response")
+	}
+	flag.Parse()
+
+	logger, err := newLogger(os.Getenv("TAGD_LEVEL"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create logger: %s\n", err.Error())
+		os.Exit(1)
+	}
+	defer logger.Sync()
+
+	config, err := loadConfig()
+	if err != nil {
+		logger.Fatal("failed to load config", zap.Error(err))
+	}
+	if eventFile != "" {
+		if err := replay(config, eventFile, logger); err != nil {
+			logger.Fatal("failed to replay event", zap.Error(err))
+		}
+		return
+	}
+
+	// Lambda runs one invocation per container, there is no leader to elect
+	// and Lambda scales out by itself
+	config.LeaderElection = tagd.LeaderElectionConfig{}
+	config.Sharding = tagd.ShardingConfig{}
+	// Each container would have a store of its own, which only sees the events of
+	// that container and may be locked by another invocation of it
+	if config.Dedupe.Path != "" {
+		logger.Warn("Ignoring the dedupe store, the Lambda function doesn't support it")
+		config.Dedupe = tagd.DedupeConfig{}
+	}
+	sess, err := session.NewSession()
+	if err != nil {
+		logger.Fatal("Failed to create new aws session", zap.Error(err))
+	}
+	d, err := tagd.New(config, sess, logger)
+	if err != nil {
+		logger.Fatal("failed to create daemon", zap.Error(err))
+	}
+	lambda.Start(newHandler(tagd.NewLambdaHandler(d)))
+}
+
+// newHandler returns a Lambda handler for SQS events that reports the records
+// that failed as batch item failures.
+func newHandler(h *tagd.LambdaHandler) func(context.Context, events.SQSEvent) (events.SQSEventResponse, error) {
+	return func(ctx context.Context, event events.SQSEvent) (events.SQSEventResponse, error) {
+		messages := make([]tagd.BatchMessage, len(event.Records))
+		for i, r := range event.Records {
+			messages[i] = tagd.BatchMessage{ID: r.MessageId, Body: r.Body, Source: r.EventSourceARN}
+		}
+		var resp events.SQSEventResponse
+		for _, id := range h.HandleBatch(ctx, messages) {
+			resp.BatchItemFailures = append(resp.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: id})
+		}
+		return resp, nil
+	}
+}
+
+func loadConfig() (*tagd.Config, error) {
+	if inline := os.Getenv("TAGD_CONFIG"); inline != "" {
+		return tagd.ParseConfig([]byte(inline))
+	}
+	path := os.Getenv("TAGD_CONFIG_FILE")
+	if path == "" {
+		path = "config.yaml"
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return tagd.ParseConfig(data)
+}
+
+func newLogger(level string) (*zap.Logger, error) {
+	config := zap.NewProductionConfig()
+	if level != "" {
+		var l zapcore.Level
+		if err := l.UnmarshalText([]byte(level)); err != nil {
+			return nil, err
+		}
+		config.Level = zap.NewAtomicLevelAt(l)
+	}
+	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	return config.Build()
+}
@@ -0,0 +1,89 @@
+//go:build replay
+// +build replay
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/leosunmo/tagd"
+	"github.com/leosunmo/tagd/tagdtest"
+	"go.uber.org/zap"
+)
+
+func init() {
+	replay = replayEvent
+}
+
+// replayResult is the handler's response to a replayed event, with the tags of
+// the resources the event refers to after handling it.
+type replayResult struct {
+	events.SQSEventResponse
+	Tags map[string]map[string]string `json:"tags"`
+}
+
+// replayEvent handles the SQS event in path against a tagdtest fake of AWS seeded with
+// the resources the event refers to, and prints the response and their tags. It
+// never calls AWS: the dedupe store, audit sinks, queue and Kubernetes are off.
+func replayEvent(config *tagd.Config, path string, logger *zap.Logger) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var event events.SQSEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return fmt.Errorf("failed to parse event %s: %w", path, err)
+	}
+	if err := config.Validate().Err(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	var region, account string
+	if len(event.Records) > 0 {
+		// arn:aws:sqs:<region>:<account>:<queue>
+		if parts := strings.SplitN(event.Records[0].EventSourceARN, ":", 6); len(parts) == 6 {
+			region, account = parts[3], parts[4]
+		}
+	}
+	backend := tagdtest.NewBackend(region, account)
+	var resources []string
+	for _, r := range event.Records {
+		ids, err := backend.Seed(r.Body)
+		if err != nil {
+			return fmt.Errorf("failed to seed the resources of message %s: %w", r.MessageId, err)
+		}
+		resources = append(resources, ids...)
+	}
+
+	config.SQSQueueName = ""
+	config.Dedupe = tagd.DedupeConfig{}
+	config.Audit = tagd.AuditConfig{}
+	config.Kubernetes = tagd.KubernetesConfig{}
+	for i := range config.TaggingConfigs {
+		config.TaggingConfigs[i].NodeSelector = ""
+	}
+	d, err := tagd.NewDaemon(config, backend.SQS(), backend.SNS(), backend.Autoscaling(), backend.EC2(), nil, nil, logger)
+	if err != nil {
+		return fmt.Errorf("failed to create daemon: %w", err)
+	}
+	resp, err := newHandler(tagd.NewLambdaHandler(d))(context.Background(), event)
+	if err != nil {
+		return err
+	}
+
+	result := replayResult{SQSEventResponse: resp, Tags: make(map[string]map[string]string)}
+	for _, id := range resources {
+		result.Tags[id] = backend.Tags(id)
+	}
+	out, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
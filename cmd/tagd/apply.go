@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/leosunmo/tagd"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// runApply tags the existing resources of all managed ASGs once and exits, for
+// running tagd as a CronJob instead of a daemon.
+func runApply(args []string) int {
+	fs := pflag.NewFlagSet("apply", pflag.ContinueOnError)
+	commonFlags(fs, "info")
+
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	env, err := newEnvironment()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitError
+	}
+	logger := env.log
+	defer logger.Sync()
+
+	// A running daemon holds the dedupe store's lock, and one-off runs tag everything
+	// anyway. They don't wait for leadership or shard ASGs either.
+	env.config.Dedupe = tagd.DedupeConfig{}
+	env.config.LeaderElection = tagd.LeaderElectionConfig{}
+	env.config.Sharding = tagd.ShardingConfig{}
+	d, err := tagd.New(env.config, env.sess, logger)
+	if err != nil {
+		logger.Error("failed to create daemon", zap.Error(err))
+		return exitError
+	}
+	defer func() {
+		if err := d.Close(); err != nil {
+			logger.Error("Failed to close audit sink", zap.Error(err))
+		}
+	}()
+
+	ctx, cancel := signalContext(logger)
+	defer cancel()
+
+	if err := d.Apply(ctx); err != nil {
+		logger.Error("Apply failed", zap.Error(err))
+		return exitError
+	}
+	return exitOK
+}
+
+// runPlan prints the tags apply would write without writing them.
+func runPlan(args []string) int {
+	fs := pflag.NewFlagSet("plan", pflag.ContinueOnError)
+	commonFlags(fs, "warn")
+	fs.Bool("detailed-exitcode", false, fmt.Sprintf("Exit with %d instead of %d if there are changes to apply", exitChanges, exitOK))
+
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	env, err := newEnvironment()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitError
+	}
+	logger := env.log
+	defer logger.Sync()
+
+	// A running daemon holds the dedupe store's lock, and one-off runs tag everything
+	// anyway. They don't wait for leadership or shard ASGs either. A plan writes no
+	// tags, so there are no changes to audit or journal.
+	env.config.Dedupe = tagd.DedupeConfig{}
+	env.config.LeaderElection = tagd.LeaderElectionConfig{}
+	env.config.Sharding = tagd.ShardingConfig{}
+	env.config.Audit = tagd.AuditConfig{}
+	env.config.Journal = tagd.JournalConfig{}
+	d, err := tagd.New(env.config, env.sess, logger)
+	if err != nil {
+		logger.Error("failed to create daemon", zap.Error(err))
+		return exitError
+	}
+	defer func() {
+		if err := d.Close(); err != nil {
+			logger.Error("Failed to close daemon", zap.Error(err))
+		}
+	}()
+
+	ctx, cancel := signalContext(logger)
+	defer cancel()
+
+	changes, err := d.Plan(ctx)
+	if err != nil {
+		logger.Error("Plan failed", zap.Error(err))
+		return exitError
+	}
+	printChanges(changes)
+	if len(changes) > 0 && viper.GetBool("detailed-exitcode") {
+		return exitChanges
+	}
+	return exitOK
+}
+
+func printChanges(changes []*tagd.Change) {
+	if len(changes) == 0 {
+		fmt.Println("No changes, all resources are tagged.")
+		return
+	}
+
+	scope, asg := "", ""
+	for _, c := range changes {
+		if c.Scope.String() != scope || c.ASG != asg {
+			scope, asg = c.Scope.String(), c.ASG
+			if scope != "" {
+				fmt.Printf("ASG %s (%s)\n", asg, scope)
+			} else {
+				fmt.Printf("ASG %s\n", asg)
+			}
+		}
+		fmt.Printf("  %s\n", c.Resource)
+
+		keys := make([]string, 0, len(c.Tags))
+		for k := range c.Tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if old, exists := c.Previous[k]; exists {
+				fmt.Printf("    ~ %s: %q -> %q\n", k, old, c.Tags[k])
+			} else {
+				fmt.Printf("    + %s: %q\n", k, c.Tags[k])
+			}
+		}
+	}
+	fmt.Printf("\n%d resource(s) to change.\n", len(changes))
+}
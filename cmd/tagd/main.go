@@ -3,11 +3,14 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/signal"
+	"runtime"
 	"strings"
 	"syscall"
+	"text/tabwriter"
 
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/leosunmo/tagd"
@@ -15,116 +18,163 @@ import (
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
-	"gopkg.in/yaml.v2"
 )
 
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+// Exit codes shared by all commands.
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+	// exitChanges is returned by plan --detailed-exitcode if there are changes to apply.
+	exitChanges = 3
+)
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+var commands = []command{
+	{"run", "Run the daemon, tagging resources as events arrive", runDaemon},
+	{"apply", "Tag the existing resources of all managed ASGs once and exit", runApply},
+	{"plan", "Show the tags apply would write, without writing them", runPlan},
+	{"validate", "Check a config file", runValidate},
+	{"orphans", "Report and clean up orphaned volumes", runOrphans},
+	{"rollback", "Restore tags changed since a time from the change journal", runRollback},
+	{"version", "Print the version", runVersion},
+}
+
 func main() {
+	os.Exit(dispatch(os.Args[1:]))
+}
 
-	fs := pflag.NewFlagSet("default", pflag.ContinueOnError)
-	fs.StringP("level", "l", "info", "log level: debug, info, warn, error or panic")
-	fs.Bool("backfill", false, "Enable backfilling tags of existing resources")
+func dispatch(args []string) int {
+	// Without a command run the daemon, as earlier versions did
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return runDaemon(args)
+	}
+	if args[0] == "help" {
+		usage(os.Stdout)
+		return exitOK
+	}
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c.run(args[1:])
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+	usage(os.Stderr)
+	return exitUsage
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: tagd <command> [flags]\n\nCommands:\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", c.name, c.summary)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nRun 'tagd <command> --help' for the flags of a command.\n")
+}
+
+func runVersion(args []string) int {
+	fmt.Printf("tagd %s (%s)\n", version, runtime.Version())
+	return exitOK
+}
+
+// commonFlags adds the flags shared by the commands that load a config file.
+func commonFlags(fs *pflag.FlagSet, level string) {
+	fs.StringP("level", "l", level, "log level: debug, info, warn, error or panic")
 	fs.String("config", "./config.yaml", "Configuration file for ASG Tagging")
-	fs.String("sqs-queue-name", "", "Name of SQS queue to monitor for ASG events")
-	fs.String("sns-topic-arn", "", "If not empty, tagd will set up ASG Notification and subscribe SQS to this SNS topic")
+}
 
-	// parse flags
-	err := fs.Parse(os.Args[1:])
+// parseFlags parses args and binds the flags to TAGD_ environment variables.
+// It returns false, with the exit code, if the command should not continue.
+func parseFlags(fs *pflag.FlagSet, args []string) (int, bool) {
+	err := fs.Parse(args)
 	switch {
 	case err == pflag.ErrHelp:
-		os.Exit(0)
+		return exitOK, false
 	case err != nil:
 		fmt.Fprintf(os.Stderr, "Error: %s\n\n", err.Error())
 		fs.PrintDefaults()
-		os.Exit(2)
+		return exitUsage, false
 	}
 
-	// bind flags and environment variables
 	viper.BindPFlags(fs)
 	viper.SetEnvPrefix("TAGD")
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
 	viper.AutomaticEnv()
+	return exitOK, true
+}
 
-	// configure logging
-	logger, _ := initZap(viper.GetString("level"))
-	defer logger.Sync()
-	stdLog := zap.RedirectStdLog(logger)
-	defer stdLog()
-
-	snsCfg := viper.GetString("sns-topic-arn")
-	sqsCfg := viper.GetString("sqs-queue-name")
+// environment is the config, logger and AWS session shared by the commands.
+type environment struct {
+	config *tagd.Config
+	sess   *session.Session
+	log    *zap.Logger
+}
 
-	if sqsCfg == "" {
-		fmt.Println("Please provide --sqs-queue-name")
-		fs.PrintDefaults()
-		os.Exit(1)
+// newEnvironment loads the config file and creates the logger and AWS session
+// from the common flags.
+func newEnvironment() (*environment, error) {
+	logger, err := initZap(viper.GetString("level"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create logger: %w", err)
 	}
-
 	config, err := readConfigFile(viper.GetString("config"))
 	if err != nil {
-		fmt.Printf("failed to parse config file, %s\n", err.Error())
-		fs.PrintDefaults()
-		os.Exit(1)
+		return nil, fmt.Errorf("failed to parse config file, %w", err)
 	}
-
-	config.Backfill = viper.GetBool("backfill")
-
-	config.SNSTopicARN = snsCfg
-	config.SQSQueueName = sqsCfg
-
-	// Create AWS credentials
 	sess, err := session.NewSession()
 	if err != nil {
-		logger.Fatal("Failed to create new aws session", zap.Error(err))
-	}
-
-	d, err := tagd.New(config, sess, logger)
-	if err != nil {
-		logger.Fatal("failed to create daemon", zap.Error(err))
+		return nil, fmt.Errorf("failed to create new aws session: %w", err)
 	}
+	return &environment{config: config, sess: sess, log: logger}, nil
+}
 
-	sigs := make(chan os.Signal)
-	defer close(sigs)
-
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	defer signal.Stop(sigs)
-
-	// Create an execution context for the daemon that can be cancelled on OS signal
+// signalContext returns a context that is cancelled on SIGINT or SIGTERM. A
+// second signal exits right away, without waiting for a graceful shutdown.
+func signalContext(logger *zap.Logger) (context.Context, context.CancelFunc) {
 	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		for signal := range sigs {
-			logger.Info(fmt.Sprintf("Received signal %s: shutting down...", signal.String()))
+		defer signal.Stop(sigs)
+		select {
+		case s := <-sigs:
+			logger.Info(fmt.Sprintf("Received signal %s: shutting down...", s.String()))
 			cancel()
-			break
+		case <-ctx.Done():
+			return
 		}
+		s := <-sigs
+		logger.Warn(fmt.Sprintf("Received signal %s again: exiting now", s.String()))
+		logger.Sync()
+		os.Exit(exitError)
 	}()
-
-	if err := d.Start(ctx); err != nil && err != context.Canceled {
-		logger.Error("Daemon failed", zap.Error(err))
-	} else {
-		logger.Info("Tagd Daemon stopped")
-	}
-
+	return ctx, cancel
 }
 
+// readConfigFile parses and validates the config file at path. Warnings are
+// reported by the validate command and logged by tagd.New.
 func readConfigFile(path string) (*tagd.Config, error) {
-	if _, err := os.Stat(path); err != nil {
-		return nil, err
-	}
-
-	yamlFile, err := ioutil.ReadFile(path)
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	var config *tagd.Config
-
-	err = yaml.Unmarshal(yamlFile, &config)
+	config, err := tagd.ParseConfig(data)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := config.Validate().Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
 	}
 	return config, nil
-
 }
 
 func initZap(logLevel string) (*zap.Logger, error) {
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/leosunmo/tagd"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+// runOrphans reports orphaned volumes once and applies the cleanup policy.
+// It is a dry-run unless --delete is given or set in the config file.
+func runOrphans(args []string) int {
+	fs := pflag.NewFlagSet("orphans", pflag.ContinueOnError)
+	commonFlags(fs, "warn")
+	fs.Bool("delete", false, "Delete orphaned volumes that have been orphaned for longer than the retention")
+	fs.Bool("snapshot", false, "Snapshot orphaned volumes before deleting them")
+	fs.Duration("retention", 0, "How long a volume must be orphaned before it is deleted (overrides config file)")
+
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	env, err := newEnvironment()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitError
+	}
+	logger := env.log
+	defer logger.Sync()
+
+	config := env.config
+	if fs.Changed("delete") {
+		config.Orphans.Delete, _ = fs.GetBool("delete")
+	}
+	if fs.Changed("snapshot") {
+		config.Orphans.Snapshot, _ = fs.GetBool("snapshot")
+	}
+	if fs.Changed("retention") {
+		config.Orphans.Retention, _ = fs.GetDuration("retention")
+	}
+
+	ctx, cancel := signalContext(logger)
+	defer cancel()
+
+	auditor, err := tagd.OpenAuditor(config, env.sess, logger)
+	if err != nil {
+		logger.Error("Failed to open audit sink", zap.Error(err))
+		return exitError
+	}
+	defer func() {
+		if err := auditor.Close(); err != nil {
+			logger.Error("Failed to close audit sink", zap.Error(err))
+		}
+	}()
+
+	scopes := config.Scopes(env.sess)
+	var orphans []scopedOrphan
+	for _, scope := range scopes {
+		log := logger.With(zap.Stringer("scope", scope))
+		reaper := tagd.NewOrphanReaper(config, ec2.New(scope.Session), log)
+		reaper.SetAuditor(auditor.ForScope(scope))
+		found, err := reaper.Run(ctx)
+		if err != nil {
+			log.Error("Failed to process orphaned volumes", zap.Error(err))
+			return exitError
+		}
+		for _, o := range found {
+			orphans = append(orphans, scopedOrphan{Orphan: o, scope: scope})
+		}
+	}
+	printOrphans(orphans, config.Orphans.ReportTags, len(scopes) > 1)
+	return exitOK
+}
+
+type scopedOrphan struct {
+	*tagd.Orphan
+	scope tagd.Scope
+}
+
+func printOrphans(orphans []scopedOrphan, reportTags []string, showScope bool) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	header := []string{"VOLUME", "SIZE", "TYPE", "AZ", "AGE", "ORPHANED", "ASG", "INSTANCE", "ACTION"}
+	if showScope {
+		header = append([]string{"SCOPE"}, header...)
+	}
+	for _, k := range reportTags {
+		header = append(header, strings.ToUpper(k))
+	}
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+
+	for _, o := range orphans {
+		orphaned := "-"
+		if !o.OrphanedSince.IsZero() {
+			orphaned = time.Since(o.OrphanedSince).Round(time.Minute).String()
+		}
+		action := string(o.Action)
+		if o.DryRun && o.Action != tagd.OrphanActionNone && o.Action != tagd.OrphanActionRetain {
+			action += " (dry-run)"
+		}
+		row := []string{
+			o.VolumeID,
+			fmt.Sprintf("%dGiB", o.Size),
+			o.VolumeType,
+			o.AvailabilityZone,
+			o.Age().Round(time.Hour).String(),
+			orphaned,
+			o.ASG,
+			valueOrDash(o.InstanceID),
+			action,
+		}
+		if showScope {
+			row = append([]string{o.scope.String()}, row...)
+		}
+		for _, k := range reportTags {
+			row = append(row, valueOrDash(o.Tags[k]))
+		}
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+}
+
+func valueOrDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
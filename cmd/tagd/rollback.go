@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/leosunmo/tagd"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// runRollback restores the tags changed since a time, or by some changes, from
+// the change journal.
+func runRollback(args []string) int {
+	fs := pflag.NewFlagSet("rollback", pflag.ContinueOnError)
+	commonFlags(fs, "warn")
+	fs.String("since", "", "Roll back changes made since this time (RFC 3339) or duration ago, e.g. 2h")
+	fs.StringSlice("change-id", nil, "Roll back the changes with these IDs")
+	fs.String("journal", "", "Change journal to read (overrides config file)")
+	fs.Bool("dry-run", false, "Only print the tags that would be restored")
+	fs.Bool("force", false, "Also restore tags that were changed again since")
+
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	ids := viper.GetStringSlice("change-id")
+	if (viper.GetString("since") == "") == (len(ids) == 0) {
+		fmt.Fprintln(os.Stderr, "Please provide either --since or --change-id")
+		fs.PrintDefaults()
+		return exitUsage
+	}
+	var since time.Time
+	if len(ids) == 0 {
+		var err error
+		if since, err = parseSince(viper.GetString("since")); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --since: %s\n", err.Error())
+			return exitUsage
+		}
+	}
+
+	env, err := newEnvironment()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitError
+	}
+	logger := env.log
+	defer logger.Sync()
+
+	path := viper.GetString("journal")
+	if path == "" {
+		path = env.config.Journal.Path
+	}
+	if path == "" {
+		fmt.Fprintln(os.Stderr, "No change journal configured, please provide --journal")
+		return exitUsage
+	}
+	entries, err := tagd.ReadJournal(path)
+	if err != nil {
+		logger.Error("Failed to read change journal", zap.Error(err))
+		return exitError
+	}
+	entries = tagd.SelectChanges(entries, since, ids)
+	if len(entries) == 0 {
+		fmt.Println("No changes to roll back.")
+		return exitOK
+	}
+
+	dryRun := viper.GetBool("dry-run")
+	var auditor *tagd.Auditor
+	if !dryRun {
+		if auditor, err = tagd.OpenAuditor(env.config, env.sess, logger); err != nil {
+			logger.Error("Failed to open audit sink", zap.Error(err))
+			return exitError
+		}
+		defer func() {
+			if err := auditor.Close(); err != nil {
+				logger.Error("Failed to close audit sink", zap.Error(err))
+			}
+		}()
+	}
+
+	ctx, cancel := signalContext(logger)
+	defer cancel()
+
+	rollback := tagd.NewRollback(env.config.Scopes(env.sess), auditor, logger)
+	reverts, err := rollback.Plan(ctx, entries, viper.GetBool("force"))
+	if err != nil {
+		logger.Error("Rollback failed", zap.Error(err))
+		return exitError
+	}
+	n := printReverts(reverts)
+	if dryRun || n == 0 {
+		if n > 0 {
+			fmt.Printf("\n%d resource(s) to roll back.\n", n)
+		}
+		return exitOK
+	}
+	if err := rollback.Apply(ctx, reverts); err != nil {
+		logger.Error("Rollback failed", zap.Error(err))
+		return exitError
+	}
+	fmt.Printf("\nRolled back %d resource(s).\n", n)
+	return exitOK
+}
+
+// parseSince parses an RFC 3339 time, or a duration before now.
+func parseSince(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither a time nor a duration", s)
+	}
+	return time.Now().Add(-d), nil
+}
+
+// printReverts prints the tags each Revert restores and returns the number of
+// resources with tags to restore.
+func printReverts(reverts []*tagd.Revert) int {
+	n := 0
+	conflicts := false
+	for _, rev := range reverts {
+		if rev.Scope.String() != "" {
+			fmt.Printf("%s (%s)\n", rev.Resource, rev.Scope)
+		} else {
+			fmt.Println(rev.Resource)
+		}
+		for _, k := range sortedKeys(rev.Tags) {
+			if old, exists := rev.Current[k]; exists {
+				fmt.Printf("  ~ %s: %q -> %q\n", k, old, rev.Tags[k])
+			} else {
+				fmt.Printf("  + %s: %q\n", k, rev.Tags[k])
+			}
+		}
+		for _, k := range rev.Delete {
+			fmt.Printf("  - %s: %q\n", k, rev.Current[k])
+		}
+		for _, k := range sortedKeys(rev.Conflicts) {
+			fmt.Printf("  ! %s: changed since to %q, skipped\n", k, rev.Conflicts[k])
+			conflicts = true
+		}
+		if len(rev.Tags) > 0 || len(rev.Delete) > 0 {
+			n++
+		}
+	}
+	if conflicts {
+		fmt.Println("\nTags changed since are skipped, use --force to restore them anyway.")
+	}
+	if len(reverts) == 0 {
+		fmt.Println("No changes to roll back, all tags are restored.")
+	}
+	return n
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
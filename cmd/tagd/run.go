@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/leosunmo/tagd"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// runDaemon runs the daemon until it is stopped by a signal.
+func runDaemon(args []string) int {
+	fs := pflag.NewFlagSet("run", pflag.ContinueOnError)
+	commonFlags(fs, "info")
+	fs.Bool("backfill", false, "Enable backfilling tags of existing resources")
+	fs.String("sqs-queue-name", "", "Name of SQS queue to monitor for ASG events")
+	fs.String("sns-topic-arn", "", "If not empty, tagd will set up ASG Notification and subscribe SQS to this SNS topic")
+
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	if viper.GetString("sqs-queue-name") == "" {
+		fmt.Fprintln(os.Stderr, "Please provide --sqs-queue-name")
+		fs.PrintDefaults()
+		return exitUsage
+	}
+
+	env, err := newEnvironment()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitError
+	}
+	logger := env.log
+	defer logger.Sync()
+	stdLog := zap.RedirectStdLog(logger)
+	defer stdLog()
+
+	env.config.Backfill = viper.GetBool("backfill")
+	env.config.SNSTopicARN = viper.GetString("sns-topic-arn")
+	env.config.SQSQueueName = viper.GetString("sqs-queue-name")
+
+	d, err := tagd.New(env.config, env.sess, logger)
+	if err != nil {
+		logger.Error("failed to create daemon", zap.Error(err))
+		return exitError
+	}
+	defer func() {
+		if err := d.Close(); err != nil {
+			logger.Error("Failed to close audit sink", zap.Error(err))
+		}
+	}()
+
+	d.OnShutdown("report dedupe stats", func(ctx context.Context) error {
+		if stats := d.DedupeStats(); stats.Hits+stats.Misses > 0 {
+			logger.Info(fmt.Sprintf("Dedupe store skipped %d duplicate(s) of %d lookup(s)", stats.Hits, stats.Hits+stats.Misses))
+		}
+		return nil
+	})
+	d.OnShutdown("report audit stats", func(ctx context.Context) error {
+		if stats := d.AuditStats(); stats.Dropped > 0 {
+			logger.Warn(fmt.Sprintf("Dropped %d audit record(s) as the audit buffer was full", stats.Dropped))
+		}
+		return nil
+	})
+
+	// Create an execution context for the daemon that can be cancelled on OS signal
+	ctx, cancel := signalContext(logger)
+	defer cancel()
+
+	if err := d.Start(ctx); err != nil && err != context.Canceled {
+		logger.Error("Daemon failed", zap.Error(err))
+		return exitError
+	}
+	logger.Info("Tagd Daemon stopped")
+	return exitOK
+}
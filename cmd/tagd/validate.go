@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/leosunmo/tagd"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// runValidate checks a config file and prints every problem found. With --aws, it
+// also reports which existing ASGs each asgName pattern matches.
+func runValidate(args []string) int {
+	fs := pflag.NewFlagSet("validate", pflag.ContinueOnError)
+	fs.String("config", "./config.yaml", "Configuration file for ASG Tagging")
+	fs.Bool("aws", false, "Match asgName patterns against the existing ASGs, using the default AWS credentials")
+
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	configPath := viper.GetString("config")
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return exitError
+	}
+	config, err := tagd.ParseConfig(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", configPath, err.Error())
+		return exitError
+	}
+
+	result := config.Validate()
+	for _, err := range result.Errors {
+		fmt.Fprintf(os.Stderr, "%s: error: %s\n", configPath, err.Error())
+	}
+	for _, w := range result.Warnings {
+		fmt.Fprintf(os.Stderr, "%s: warning: %s\n", configPath, w)
+	}
+
+	if viper.GetBool("aws") {
+		if err := printASGMatches(config); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to list ASGs: %s\n", err.Error())
+			return exitError
+		}
+	}
+
+	if !result.OK() {
+		return exitError
+	}
+	fmt.Printf("%s: OK\n", configPath)
+	return exitOK
+}
+
+func printASGMatches(config *tagd.Config) error {
+	sess, err := session.NewSession()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	scopes := config.Scopes(sess)
+	for _, scope := range scopes {
+		names, err := tagd.ListAutoscalingGroupNames(ctx, autoscaling.New(scope.Session))
+		if err != nil {
+			return fmt.Errorf("%s: %w", scope, err)
+		}
+
+		prefix := ""
+		if len(scopes) > 1 {
+			prefix = scope.String() + ": "
+		}
+		for _, m := range config.MatchASGs(scope, names) {
+			switch {
+			case len(m.ASGs) == 0 && len(m.Shadowed) == 0:
+				fmt.Printf("%stagConfig[%d] %s: matches no ASGs\n", prefix, m.Index, m.Pattern)
+			case len(m.ASGs) == 0:
+				fmt.Printf("%stagConfig[%d] %s: all matching ASGs are managed by later tagConfigs: %s\n", prefix, m.Index, m.Pattern, strings.Join(m.Shadowed, ", "))
+			default:
+				fmt.Printf("%stagConfig[%d] %s: %s\n", prefix, m.Index, m.Pattern, strings.Join(m.ASGs, ", "))
+				if len(m.Shadowed) > 0 {
+					fmt.Printf("%stagConfig[%d] %s: managed by later tagConfigs: %s\n", prefix, m.Index, m.Pattern, strings.Join(m.Shadowed, ", "))
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package tagd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/ryanuber/go-glob"
+	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+var errEmptyConfig = errors.New("config is empty")
+
+// ParseConfig parses a config file strictly, rejecting unknown and duplicate keys.
+// YAML errors include the offending line number.
+// An empty config, or one with only comments, is an error.
+func ParseConfig(data []byte) (*Config, error) {
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return nil, errEmptyConfig
+	}
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ValidationResult holds the problems found in a Config. Errors stop the daemon
+// from starting, warnings are likely mistakes that are still accepted.
+type ValidationResult struct {
+	Errors   []error
+	Warnings []string
+}
+
+// OK returns true if no errors were found.
+func (r *ValidationResult) OK() bool {
+	return len(r.Errors) == 0
+}
+
+// Err returns the errors found as a single error, or nil if there are none.
+func (r *ValidationResult) Err() error {
+	switch len(r.Errors) {
+	case 0:
+		return nil
+	case 1:
+		return r.Errors[0]
+	}
+	msgs := make([]string, len(r.Errors))
+	for i, err := range r.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Errorf("%d config errors: %s", len(r.Errors), strings.Join(msgs, "; "))
+}
+
+func (r *ValidationResult) warnf(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Validate checks every TaggingConfig and the asgName patterns across them.
+func (c *Config) Validate() *ValidationResult {
+	r := &ValidationResult{}
+	for i := range c.TaggingConfigs {
+		conf := &c.TaggingConfigs[i]
+		if err := conf.validate(); err != nil {
+			r.Errors = append(r.Errors, err)
+		}
+		if conf.ASGName == "" {
+			if conf.NodeSelector == "" {
+				r.warnf("tagConfig[%d] has neither asgName nor nodeSelector and is never used", i)
+			}
+			continue
+		}
+		if strings.ContainsAny(conf.ASGName, "?[]") {
+			r.warnf("tagConfig[%d]: asgName %q contains ?, [ or ], which match literally; only * is a wildcard", i, conf.ASGName)
+		}
+		for j := 0; j < i; j++ {
+			other := &c.TaggingConfigs[j]
+			if other.ASGName == "" || other.Account != conf.Account || !regionsOverlap(conf.Regions, other.Regions) {
+				continue
+			}
+			if other.ASGName == conf.ASGName {
+				r.Errors = append(r.Errors, fmt.Errorf("tagConfig[%d]: duplicate asgName %q, also used by tagConfig[%d]", i, conf.ASGName, j))
+			} else if globsOverlap(other.ASGName, conf.ASGName) {
+				r.warnf("tagConfig[%d]: asgName %q overlaps %q of tagConfig[%d], ASGs matching both use tagConfig[%d]", i, conf.ASGName, other.ASGName, j, i)
+			}
+		}
+	}
+	if err := c.validateAccounts(); err != nil {
+		r.Errors = append(r.Errors, err)
+	}
+	if err := c.validateQueueNames(); err != nil {
+		r.Errors = append(r.Errors, err)
+	}
+	for i := range c.TaggingConfigs {
+		for _, region := range c.TaggingConfigs[i].Regions {
+			if len(c.Regions) > 0 && !containsString(c.Regions, region) {
+				r.Errors = append(r.Errors, fmt.Errorf("tagConfig[%d]: region %s not in the top-level regions", i, region))
+			}
+		}
+	}
+	if c.DiscoveryInterval < 0 {
+		r.Errors = append(r.Errors, fmt.Errorf("discoveryInterval must not be negative"))
+	}
+	if err := c.Orphans.validate(); err != nil {
+		r.Errors = append(r.Errors, err)
+	}
+	if c.Snapshots.Interval < 0 {
+		r.Errors = append(r.Errors, fmt.Errorf("snapshots interval must not be negative"))
+	}
+	if err := c.Audit.validate(); err != nil {
+		r.Errors = append(r.Errors, err)
+	}
+	if err := c.LeaderElection.validate(); err != nil {
+		r.Errors = append(r.Errors, err)
+	}
+	if err := c.Sharding.validate(); err != nil {
+		r.Errors = append(r.Errors, err)
+	}
+	if c.Sharding.enabled() && c.LeaderElection.Backend != "" {
+		r.Errors = append(r.Errors, errShardingWithLeader)
+	}
+	if err := c.Timeouts.validate(); err != nil {
+		r.Errors = append(r.Errors, err)
+	}
+	for i := range c.TaggingConfigs {
+		if attach := c.TaggingConfigs[i].attachTimeout(); attach >= c.Timeouts.event() {
+			r.warnf("tagConfig[%d]: attachTimeout %s is not shorter than the event timeout %s, launches may time out", i, attach, c.Timeouts.event())
+		}
+	}
+	if c.ShutdownGracePeriod < 0 {
+		r.Errors = append(r.Errors, fmt.Errorf("shutdownGracePeriod must not be negative"))
+	}
+	if c.Dedupe.TTL < 0 {
+		r.Errors = append(r.Errors, fmt.Errorf("dedupe ttl must not be negative"))
+	}
+	return r
+}
+
+// validate returns an error if the TaggingConfig is invalid.
+func (c *TaggingConfig) validate() error {
+	for _, kind := range c.Resources {
+		if !kind.valid() {
+			return fmt.Errorf("tagConfig %s: unknown resource kind %q", c.ASGName, kind)
+		}
+	}
+	if err := c.validateTags(); err != nil {
+		return fmt.Errorf("tagConfig %s: %w", c.ASGName, err)
+	}
+	copier, err := newTagCopier(c)
+	if err != nil {
+		return fmt.Errorf("tagConfig %s: %w", c.ASGName, err)
+	}
+	c.compiledCopier = copier
+	for i := range c.Volumes {
+		if err := c.Volumes[i].validate(); err != nil {
+			return fmt.Errorf("tagConfig %s: %w", c.ASGName, err)
+		}
+	}
+	if c.NodeSelector != "" {
+		if _, err := labels.Parse(c.NodeSelector); err != nil {
+			return fmt.Errorf("tagConfig %s: invalid nodeSelector: %w", c.ASGName, err)
+		}
+	}
+	return nil
+}
+
+// regionsOverlap returns true if two TaggingConfigs' regions overlap, where no
+// regions means all of them.
+func regionsOverlap(a, b []string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return true
+	}
+	for _, region := range a {
+		if containsString(b, region) {
+			return true
+		}
+	}
+	return false
+}
+
+// globsOverlap returns true if some string matches both glob patterns, where * is
+// the only wildcard.
+func globsOverlap(a, b string) bool {
+	type pos struct{ i, j int }
+	seen := make(map[pos]bool)
+	var overlap func(i, j int) bool
+	overlap = func(i, j int) bool {
+		p := pos{i, j}
+		if v, ok := seen[p]; ok {
+			return v
+		}
+		var result bool
+		switch {
+		case i == len(a) && j == len(b):
+			result = true
+		case i < len(a) && a[i] == '*':
+			result = overlap(i+1, j) || (j < len(b) && overlap(i, j+1))
+		case j < len(b) && b[j] == '*':
+			result = overlap(i, j+1) || (i < len(a) && overlap(i+1, j))
+		case i < len(a) && j < len(b):
+			result = a[i] == b[j] && overlap(i+1, j+1)
+		}
+		seen[p] = result
+		return result
+	}
+	return overlap(0, 0)
+}
+
+// PatternMatch lists the ASGs an asgName pattern matches. Shadowed ASGs match the
+// pattern but are managed by a later TaggingConfig.
+type PatternMatch struct {
+	Index    int
+	Pattern  string
+	ASGs     []string
+	Shadowed []string
+}
+
+// MatchASGs matches the asgName patterns of the TaggingConfigs in the Scope
+// against asgNames the same way the daemon does, where the last matching pattern wins.
+func (c *Config) MatchASGs(s Scope, asgNames []string) []PatternMatch {
+	winner := make(map[string]int)
+	for i, conf := range c.TaggingConfigs {
+		if conf.ASGName == "" || !conf.inScope(s) {
+			continue
+		}
+		for _, name := range asgNames {
+			if glob.Glob(conf.ASGName, name) {
+				winner[name] = i
+			}
+		}
+	}
+
+	sorted := append([]string(nil), asgNames...)
+	sort.Strings(sorted)
+	var matches []PatternMatch
+	for i, conf := range c.TaggingConfigs {
+		if conf.ASGName == "" || !conf.inScope(s) {
+			continue
+		}
+		m := PatternMatch{Index: i, Pattern: conf.ASGName}
+		for _, name := range sorted {
+			if !glob.Glob(conf.ASGName, name) {
+				continue
+			}
+			if winner[name] == i {
+				m.ASGs = append(m.ASGs, name)
+			} else {
+				m.Shadowed = append(m.Shadowed, name)
+			}
+		}
+		matches = append(matches, m)
+	}
+	return matches
+}
+
+// ListAutoscalingGroupNames returns the names of all ASGs visible to asgClient.
+func ListAutoscalingGroupNames(ctx context.Context, asgClient AutoscalingClient) ([]string, error) {
+	asgs, err := listAutoscalingGroups(ctx, asgClient)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(asgs))
+	for i, asg := range asgs {
+		names[i] = aws.StringValue(asg.AutoScalingGroupName)
+	}
+	return names, nil
+}
@@ -0,0 +1,51 @@
+package tagd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseConfigRejectsEmptyConfig(t *testing.T) {
+	for _, data := range []string{"", "\n", "# nothing yet\n"} {
+		if _, err := ParseConfig([]byte(data)); err != errEmptyConfig {
+			t.Errorf("ParseConfig(%q) error = %v, want %v", data, err, errEmptyConfig)
+		}
+	}
+}
+
+func TestParseConfigRejectsUnknownKeys(t *testing.T) {
+	_, err := ParseConfig([]byte("backfill: true\ntagConfg: []\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("ParseConfig error = %v, want an error on line 2", err)
+	}
+}
+
+func TestValidationResultErr(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+tagConfig:
+  - asgName: web
+    tags:
+      "aws:name": web
+  - asgName: web
+discoveryInterval: -1s
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := config.Validate()
+	if result.OK() {
+		t.Fatal("Validate found no errors")
+	}
+	err = result.Err()
+	if err == nil || !strings.Contains(err.Error(), "duplicate asgName") || !strings.Contains(err.Error(), "discoveryInterval") {
+		t.Errorf("Err() = %v, want every error", err)
+	}
+
+	config, err = ParseConfig([]byte("tagConfig:\n  - asgName: web\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Validate().Err(); err != nil {
+		t.Errorf("Err() = %v, want nil", err)
+	}
+}
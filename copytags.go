@@ -0,0 +1,243 @@
+package tagd
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// CopyTagsConfig selects which instance tags are copied and how they are renamed.
+//
+// Patterns are globs, where * matches any sequence of characters, or regular
+// expressions if enclosed in slashes, e.g. /^k8s\.io\/(.+)$/.
+//
+// Tags are built in this order, later steps overriding earlier ones:
+//  1. instance tags matching KeyPrefix or Include, and not matching Exclude
+//  2. the first matching Rename rule is applied to each copied tag
+//  3. extra tags from the event source, e.g. node labels
+//  4. the TaggingConfig's static tags
+type CopyTagsConfig struct {
+	Include []string     `yaml:"include,omitempty"`
+	Exclude []string     `yaml:"exclude,omitempty"`
+	Rename  []RenameRule `yaml:"rename,omitempty"`
+}
+
+// RenameRule renames tag keys matching From to To. For glob patterns, each * in To
+// and Value is replaced with the text matched by the corresponding * in From. For
+// regular expressions, To and Value are expanded with $1, ${name} etc.
+// If Value is empty, the tag's value is kept.
+type RenameRule struct {
+	From  string `yaml:"from"`
+	To    string `yaml:"to"`
+	Value string `yaml:"value,omitempty"`
+}
+
+// tagPattern is a compiled glob or regular expression matching tag keys.
+type tagPattern struct {
+	re     *regexp.Regexp
+	isGlob bool
+}
+
+func compileTagPattern(pattern string) (*tagPattern, error) {
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+		}
+		return &tagPattern{re: re}, nil
+	}
+	parts := strings.Split(pattern, "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	return &tagPattern{
+		re:     regexp.MustCompile("^" + strings.Join(parts, "(.*)") + "$"),
+		isGlob: true,
+	}, nil
+}
+
+// expand returns template expanded with the submatches of key, which must match the pattern.
+func (p *tagPattern) expand(template, key string) string {
+	match := p.re.FindStringSubmatchIndex(key)
+	if !p.isGlob {
+		return string(p.re.ExpandString(nil, template, key, match))
+	}
+	var b strings.Builder
+	group := 1
+	for _, r := range template {
+		if r == '*' && 2*group+1 < len(match) {
+			b.WriteString(key[match[2*group]:match[2*group+1]])
+			group++
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+type compiledRename struct {
+	from *tagPattern
+	// to matches the keys the rule renames tags to
+	to   *regexp.Regexp
+	rule RenameRule
+}
+
+// templateVariable matches the variables of a regular expression's template.
+var templateVariable = regexp.MustCompile(`\$\$|\$\{\w+\}|\$\w+`)
+
+// templatePattern returns a regular expression matching the expansions of template.
+func (p *tagPattern) templatePattern(template string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	if p.isGlob {
+		parts := strings.Split(template, "*")
+		for i := range parts {
+			parts[i] = regexp.QuoteMeta(parts[i])
+		}
+		b.WriteString(strings.Join(parts, ".*"))
+	} else {
+		last := 0
+		for _, loc := range templateVariable.FindAllStringIndex(template, -1) {
+			b.WriteString(regexp.QuoteMeta(template[last:loc[0]]))
+			if template[loc[0]:loc[1]] == "$$" {
+				b.WriteString(regexp.QuoteMeta("$"))
+			} else {
+				b.WriteString(".*")
+			}
+			last = loc[1]
+		}
+		b.WriteString(regexp.QuoteMeta(template[last:]))
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// tagCopier applies a TaggingConfig's KeyPrefix and CopyTags rules.
+type tagCopier struct {
+	prefixes []string
+	include  []*tagPattern
+	exclude  []*tagPattern
+	rename   []compiledRename
+}
+
+func newTagCopier(c *TaggingConfig) (*tagCopier, error) {
+	tc := &tagCopier{}
+	for _, prefix := range c.KeyPrefix {
+		tc.prefixes = append(tc.prefixes, strings.ToUpper(prefix))
+	}
+	for _, pattern := range c.CopyTags.Include {
+		p, err := compileTagPattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("copyTags include: %w", err)
+		}
+		tc.include = append(tc.include, p)
+	}
+	for _, pattern := range c.CopyTags.Exclude {
+		p, err := compileTagPattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("copyTags exclude: %w", err)
+		}
+		tc.exclude = append(tc.exclude, p)
+	}
+	for _, rule := range c.CopyTags.Rename {
+		if rule.From == "" || rule.To == "" {
+			return nil, fmt.Errorf("copyTags rename: from and to are required")
+		}
+		p, err := compileTagPattern(rule.From)
+		if err != nil {
+			return nil, fmt.Errorf("copyTags rename: %w", err)
+		}
+		tc.rename = append(tc.rename, compiledRename{from: p, to: p.templatePattern(rule.To), rule: rule})
+	}
+	return tc, nil
+}
+
+// selects returns true if the tag key should be copied. Reserved aws: tags are never copied.
+func (tc *tagCopier) selects(key string) bool {
+	if tc == nil || strings.HasPrefix(strings.ToLower(key), reservedTagPrefix) {
+		return false
+	}
+	for _, p := range tc.exclude {
+		if p.re.MatchString(key) {
+			return false
+		}
+	}
+	upper := strings.ToUpper(key)
+	for _, prefix := range tc.prefixes {
+		if strings.HasPrefix(upper, prefix) {
+			return true
+		}
+	}
+	for _, p := range tc.include {
+		if p.re.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// renamed returns the key and value a copied tag is written as.
+func (tc *tagCopier) renamed(key, value string) (string, string) {
+	for _, r := range tc.rename {
+		if !r.from.re.MatchString(key) {
+			continue
+		}
+		newKey := r.from.expand(r.rule.To, key)
+		if r.rule.Value != "" {
+			value = r.from.expand(r.rule.Value, key)
+		}
+		return newKey, value
+	}
+	return key, value
+}
+
+// writes returns true if the tag key may have been written by the copy rules,
+// copied as is or renamed.
+func (tc *tagCopier) writes(key string) bool {
+	if tc == nil {
+		return false
+	}
+	if tc.selects(key) {
+		if newKey, _ := tc.renamed(key, ""); newKey == key {
+			return true
+		}
+	}
+	for _, r := range tc.rename {
+		if r.to.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// copy copies the selected tags from src to dst, renaming them. If several tags
+// are renamed to the same key, a tag copied as is wins, then the first in the
+// sorted order of their keys, so the result doesn't depend on map order.
+func (tc *tagCopier) copy(dst, src map[string]string) {
+	if tc == nil {
+		return
+	}
+	keys := make([]string, 0, len(src))
+	for k := range src {
+		if tc.selects(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	copied := make(map[string]string, len(keys))
+	for _, k := range keys {
+		newKey, newValue := tc.renamed(k, src[k])
+		if from, ok := copied[newKey]; ok && (from == newKey || k != newKey) {
+			continue
+		}
+		copied[newKey] = k
+		dst[newKey] = newValue
+	}
+}
+
+// copier returns the TaggingConfig's copy rules, compiled by validate. A
+// TaggingConfig that wasn't validated copies no tags.
+func (c *TaggingConfig) copier() *tagCopier {
+	return c.compiledCopier
+}
@@ -0,0 +1,38 @@
+package tagd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTagCopierResolvesRenameCollisions(t *testing.T) {
+	conf := &TaggingConfig{
+		CopyTags: CopyTagsConfig{
+			Include: []string{"team", "Team", "owner-*"},
+			Rename: []RenameRule{
+				{From: "Team", To: "team"},
+				{From: "owner-*", To: "owner"},
+			},
+		},
+	}
+	tc, err := newTagCopier(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := map[string]string{
+		"team":      "web",
+		"Team":      "Web",
+		"owner-b":   "b",
+		"owner-a":   "a",
+		"unrelated": "x",
+	}
+	want := map[string]string{"team": "web", "owner": "a"}
+	// Map order must not decide which tag wins
+	for i := 0; i < 20; i++ {
+		got := make(map[string]string)
+		tc.copy(got, src)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("copy() = %v, want %v", got, want)
+		}
+	}
+}
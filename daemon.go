@@ -3,7 +3,10 @@ package tagd
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -12,16 +15,44 @@ import (
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/aws/aws-sdk-go/service/sqs"
-	"github.com/ryanuber/go-glob"
 	"go.uber.org/zap"
+	"k8s.io/client-go/kubernetes"
 )
 
 // Config for the tagd Daemon.
 type Config struct {
-	TaggingConfigs []TaggingConfig `yaml:"tagConfig"`
+	TaggingConfigs []TaggingConfig  `yaml:"tagConfig"`
+	Orphans        OrphanConfig     `yaml:"orphans,omitempty"`
+	Snapshots      SnapshotConfig   `yaml:"snapshots,omitempty"`
+	Kubernetes     KubernetesConfig `yaml:"kubernetes,omitempty"`
 	Backfill       bool
 	SNSTopicARN    string
 	SQSQueueName   string
+	// DiscoveryInterval enables periodic rediscovery of ASGs matching the TaggingConfigs.
+	DiscoveryInterval time.Duration `yaml:"discoveryInterval,omitempty"`
+	// Regions to manage, each with its own clients, queue and taggers. Defaults
+	// to the region of the AWS session.
+	Regions []string `yaml:"regions,omitempty"`
+	// Accounts to manage besides the session's own, by assuming a role in each.
+	Accounts []AccountConfig `yaml:"accounts,omitempty"`
+	// QueueNames overrides SQSQueueName for some scopes, keyed by region for the
+	// session's own account, or by account/region.
+	QueueNames map[string]string `yaml:"queueNames,omitempty"`
+	// Audit records every tag change to a sink separate from the logs.
+	Audit AuditConfig `yaml:"audit,omitempty"`
+	// Journal records the previous values of changed tags for rollbacks.
+	Journal JournalConfig `yaml:"journal,omitempty"`
+	// Dedupe skips events and instances that were already handled.
+	Dedupe DedupeConfig `yaml:"dedupe,omitempty"`
+	// LeaderElection lets only one of several replicas run at a time.
+	LeaderElection LeaderElectionConfig `yaml:"leaderElection,omitempty"`
+	// Sharding partitions the managed ASGs between several replicas.
+	Sharding ShardingConfig `yaml:"sharding,omitempty"`
+	// ShutdownGracePeriod is how long in-flight handlers may run after the
+	// Daemon is stopped, defaults to 20 seconds.
+	ShutdownGracePeriod time.Duration `yaml:"shutdownGracePeriod,omitempty"`
+	// Timeouts bound AWS API calls and the handling of each event.
+	Timeouts TimeoutConfig `yaml:"timeouts,omitempty"`
 }
 
 // TaggingConfig to specify which ASGs to monitor and tag
@@ -29,6 +60,37 @@ type TaggingConfig struct {
 	ASGName   string            `yaml:"asgName"`
 	Tags      map[string]string `yaml:"tags,omitempty"`
 	KeyPrefix []string          `yaml:"keyPrefix,omitempty"`
+	// CopyTags selects and renames copied instance tags, in addition to KeyPrefix.
+	CopyTags CopyTagsConfig `yaml:"copyTags,omitempty"`
+	// InheritASGTags copies the ASG's tags as well, including those not propagated
+	// at launch, with the same filtering as instance tags.
+	InheritASGTags bool `yaml:"inheritASGTags,omitempty"`
+	// Resources to tag, defaults to volumes only.
+	Resources []ResourceKind `yaml:"resources,omitempty"`
+	// MaxTags limits the tags applied per resource, defaults to EC2's limit of 50.
+	MaxTags int `yaml:"maxTags,omitempty"`
+	// TagPriority are globs of tag keys to keep first when truncating to MaxTags.
+	// Otherwise static tags are kept before copied ones.
+	TagPriority []string `yaml:"tagPriority,omitempty"`
+	// Volumes select volumes to exclude or tag with extra tags, e.g. by device name.
+	Volumes []VolumeSelector `yaml:"volumes,omitempty"`
+	// NodeSelector is a Kubernetes label selector for nodes whose instances are
+	// tagged, regardless of which ASG they belong to.
+	NodeSelector string `yaml:"nodeSelector,omitempty"`
+	// Account is the name of the AccountConfig whose ASGs are tagged, defaults to
+	// the session's own account.
+	Account string `yaml:"account,omitempty"`
+	// Regions limits the TaggingConfig to some of the Config's Regions, defaults to all.
+	Regions []string `yaml:"regions,omitempty"`
+	// NodeLabels are node labels copied into the tags of selected nodes.
+	NodeLabels []string `yaml:"nodeLabels,omitempty"`
+
+	// AttachTimeout is how long to wait for block devices to attach on launch.
+	AttachTimeout time.Duration `yaml:"attachTimeout,omitempty"`
+	// RecheckAfter is when to tag volumes attached after launch.
+	RecheckAfter time.Duration `yaml:"recheckAfter,omitempty"`
+
+	compiledCopier *tagCopier
 }
 
 type Daemon struct {
@@ -39,75 +101,279 @@ type Daemon struct {
 	asgClient  AutoscalingClient
 	ec2Client  EC2Client
 	asgTaggers map[string]*AutoscalingTagger
+	mu         sync.RWMutex
+	orphans    *OrphanReaper
+	pvcTagger  *PVCTagger
+	nodes      *NodeWatcher
+	labeler    *NodeLabeler
+	audit      *Auditor
+	dedupe     *DedupeStore
+	elector    *LeaderElector
+	sharder    *Sharder
 	log        *zap.Logger
+
+	// owned are the ASGs this replica handled the last time it claimed them
+	owned map[string]bool
+	// handlers are the handlers running, drained on shutdown
+	handlers drainGroup
+	hooks    []namedHook
+	// failures are the failed attempts at the messages this replica handles
+	failures messageFailures
+	// stopping is closed when the context given to Start is cancelled, telling
+	// a shutdown from a loss of leadership
+	stopping <-chan struct{}
+
+	// scope is the account and region of the Daemon. A Daemon managing several
+	// scopes has no clients of its own and runs a Daemon for each in scopes instead.
+	scope  Scope
+	scopes []*Daemon
 }
 
-// New creates a new tagd Daemon.
+// New creates a new tagd Daemon. If several Regions or Accounts are configured,
+// the Daemon manages each account and region with its own clients, queue and taggers.
+// The config is validated first, logging its warnings.
 func New(config *Config, sess *session.Session, logger *zap.Logger) (*Daemon, error) {
-	return NewDaemon(
+	result := config.Validate()
+	if err := result.Err(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	for _, w := range result.Warnings {
+		logger.Warn(w)
+	}
+	elector, err := newLeaderElector(config, sess, logger)
+	if err != nil {
+		return nil, err
+	}
+	sharder, err := newSharder(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	auditor, err := OpenAuditor(config, sess, logger)
+	if err != nil {
+		return nil, err
+	}
+	dedupe, err := openDedupeStore(&config.Dedupe, logger)
+	if err != nil {
+		auditor.Close()
+		return nil, err
+	}
+	// The parent owns the audit sink, dedupe store and sharder the scoped Daemons share
+	daemon := &Daemon{config: config, audit: auditor, dedupe: dedupe, elector: elector, sharder: sharder, log: logger}
+
+	scopes := config.Scopes(sess)
+	if len(scopes) == 1 {
+		d, err := newScopedDaemon(config.forScope(scopes[0], true), scopes[0], auditor, dedupe, sharder, logger)
+		if err != nil {
+			daemon.Close()
+			return nil, err
+		}
+		d.elector = elector
+		return d, nil
+	}
+
+	// Kubernetes handlers only run in the account and region of the cluster, assumed to be our own.
+	// A scope that can't be set up, e.g. as its role can't be assumed, doesn't stop the others.
+	kubeRegion := config.kubernetesRegion(aws.StringValue(sess.Config.Region))
+	var failed []string
+	for _, s := range scopes {
+		kubernetes := s.Account == "" && s.Region == kubeRegion
+		d, err := newScopedDaemon(config.forScope(s, kubernetes), s, auditor, dedupe, sharder, logger)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Skipping %s, failed to set it up", s), zap.Error(err))
+			failed = append(failed, s.String())
+			continue
+		}
+		daemon.scopes = append(daemon.scopes, d)
+	}
+	if len(daemon.scopes) == 0 {
+		daemon.Close()
+		return nil, fmt.Errorf("failed to set up any scope: %s", strings.Join(failed, ", "))
+	}
+	return daemon, nil
+}
+
+// newScopedDaemon creates a Daemon with clients for the Scope.
+func newScopedDaemon(config *Config, s Scope, auditor *Auditor, dedupe *DedupeStore, sharder *Sharder, logger *zap.Logger) (*Daemon, error) {
+	if s.Region != "" {
+		logger = logger.With(zap.String("region", s.Region))
+	}
+	if s.Account != "" {
+		logger = logger.With(zap.String("account", s.Account))
+	}
+	var kubeClient kubernetes.Interface
+	if config.kubernetesEnabled() {
+		var err error
+		kubeClient, err = NewKubernetesClient(config.Kubernetes.Kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create kubernetes client: %w", err)
+		}
+	}
+	d, err := NewDaemon(
 		config,
-		sqs.New(sess),
-		sns.New(sess),
-		autoscaling.New(sess),
-		ec2.New(sess),
+		sqs.New(s.Session),
+		sns.New(s.Session),
+		autoscaling.New(s.Session),
+		ec2.New(s.Session),
+		kubeClient,
+		auditor.ForScope(s),
 		logger,
 	)
+	if err != nil {
+		return nil, err
+	}
+	d.scope = s
+	d.dedupe = dedupe
+	d.sharder = sharder
+	return d, nil
 }
 
-// NewDaemon creates a new Daemon.
+// NewDaemon creates a new Daemon. kubeClient may be nil if no Kubernetes handlers
+// are enabled, and auditor if auditing is disabled.
 func NewDaemon(
 	config *Config,
 	sqsClient SQSClient,
 	snsClient SNSClient,
 	asgClient AutoscalingClient,
 	ec2Client EC2Client,
+	kubeClient kubernetes.Interface,
+	auditor *Auditor,
 	logger *zap.Logger,
 ) (*Daemon, error) {
+	for i := range config.TaggingConfigs {
+		if err := config.TaggingConfigs[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+
 	daemon := &Daemon{
 		config:    config,
 		sqsClient: sqsClient,
 		snsClient: snsClient,
 		asgClient: asgClient,
 		ec2Client: ec2Client,
+		audit:     auditor,
 		log:       logger,
 	}
 
-	queue, err := NewQueue(
-		config.SQSQueueName,
-		config.SNSTopicARN,
-		sqsClient,
-		snsClient,
-	)
-	if err != nil {
-		return nil, err
+	// The queue is only needed by Start, one-shot commands run without it
+	if config.SQSQueueName != "" {
+		queue, err := NewQueue(
+			config.SQSQueueName,
+			config.SNSTopicARN,
+			sqsClient,
+			snsClient,
+		)
+		if err != nil {
+			return nil, err
+		}
+		daemon.queue = queue
 	}
-	daemon.queue = queue
 
 	daemon.asgTaggers = make(map[string]*AutoscalingTagger)
+	daemon.orphans = NewOrphanReaper(config, ec2Client, logger)
+	daemon.orphans.SetAuditor(auditor)
+	if config.Kubernetes.PVC.Enabled {
+		if kubeClient == nil {
+			return nil, errors.New("kubernetes client required for the PVC handler")
+		}
+		daemon.pvcTagger = NewPVCTagger(&config.Kubernetes, kubeClient, ec2Client, logger)
+		daemon.pvcTagger.audit = auditor
+		daemon.pvcTagger.timeouts = config.Timeouts
+	}
+	if config.kubernetesEnabled() {
+		if kubeClient == nil {
+			return nil, errors.New("kubernetes client required for node selectors")
+		}
+		if config.Kubernetes.NodeLabels.Enabled {
+			daemon.labeler = NewNodeLabeler(&config.Kubernetes.NodeLabels, kubeClient, logger)
+			daemon.labeler.timeouts = config.Timeouts
+		}
+		var err error
+		daemon.nodes, err = NewNodeWatcher(config, kubeClient, asgClient, ec2Client, logger)
+		if err != nil {
+			return nil, err
+		}
+		daemon.nodes.handlers = &daemon.handlers
+		for _, nt := range daemon.nodes.taggers {
+			nt.tagger.audit = auditor
+			nt.tagger.handlers = &daemon.handlers
+			nt.tagger.timeouts = config.Timeouts
+		}
+	}
 
 	// Give it a very generous 1 minute to page through all ASGs
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*1)
 	defer cancel()
-	asgNameList, err := daemon.listAutoscalingGroupNames(ctx)
-	if err != nil {
+	if _, err := daemon.discover(ctx); err != nil {
 		return nil, err
 	}
+	return daemon, nil
+}
 
-	// Iterate over the configured ASGs and the actual ASGs and check for glob matches (or exact matches)
-	for _, conf := range config.TaggingConfigs {
-		for _, asgName := range asgNameList {
-			if glob.Glob(conf.ASGName, asgName) {
-				daemon.addTagger(asgName, &conf)
-			}
-		}
+// Close flushes and closes the audit sink and change journal, and closes the
+// dedupe store, after the Daemon has stopped.
+func (d *Daemon) Close() error {
+	err := d.audit.Close()
+	if derr := d.dedupe.Close(); err == nil {
+		err = derr
 	}
-	return daemon, nil
+	return err
+}
+
+// AuditStats returns the audit records dropped since the Daemon was created.
+func (d *Daemon) AuditStats() AuditStats {
+	return d.audit.Stats()
+}
+
+// DedupeStats returns the dedupe store's lookups since the Daemon was created.
+func (d *Daemon) DedupeStats() DedupeStats {
+	return d.dedupe.Stats()
 }
 
+// Start runs the Daemon until ctx is cancelled. With leader election, it stands
+// by until it becomes the leader, and again whenever it loses leadership. With
+// sharding, it only handles the ASGs it owns, following replicas joining or leaving.
+//
+// Once ctx is cancelled, the Daemon stops receiving messages and waits up to the
+// shutdown grace period for the handlers in flight, leaving the messages of those
+// that don't finish on the queue. Then it runs the shutdown hooks and returns.
 func (d *Daemon) Start(ctx context.Context) error {
+	d.setStopping(ctx.Done())
+	if d.sharder != nil {
+		go d.sharder.Run(ctx)
+	}
+	var err error
+	if d.elector != nil {
+		err = d.elector.Run(ctx, d.start)
+	} else {
+		err = d.start(ctx)
+	}
+	d.runShutdownHooks()
+	return err
+}
+
+func (d *Daemon) start(ctx context.Context) error {
+	if len(d.scopes) > 0 {
+		return d.startScopes(ctx)
+	}
+	if d.queue == nil {
+		return errors.New("an SQS queue is required to run the daemon")
+	}
 	d.log.Info("Starting Daemon")
 
-	for _, asg := range d.asgTaggers {
+	// Handlers run with a context of their own, so they can finish after ctx is
+	// cancelled, until the grace period is over
+	work, cancelWork := d.workContext(ctx)
+	defer cancelWork()
+	d.handlers.reset(work)
+
+	// Subscribe before claiming, so no change of replicas is missed
+	var rebalance <-chan struct{}
+	if d.sharder != nil {
+		rebalance = d.sharder.subscribe()
+	}
+	taggers, _ := d.claim()
+	for _, asg := range taggers {
 		d.log.Info(fmt.Sprintf("Managing tags for ASG %s", asg.asgName))
 	}
 
@@ -119,88 +385,326 @@ func (d *Daemon) Start(ctx context.Context) error {
 		}
 
 		d.log.Debug("Enabling notifications to ASGs")
-		for _, asg := range d.asgTaggers {
-			if err := asg.EnableNotifications(); err != nil {
-				d.log.Error(fmt.Sprintf("failed to enable notifications for ASG %s", asg.asgName), zap.Error(err))
-			}
+		for _, asg := range taggers {
+			d.enableNotifications(work, asg)
 		}
 	}
 
 	if d.config.Backfill {
 		d.log.Debug("Backfilling enabled, processing...")
 		// Iterate over all the ASGs and tag existing disks before we start listening to the SQS queue
-		for _, asg := range d.asgTaggers {
-			d.log.Info(fmt.Sprintf("Processing existing disks for ASG %s", asg.asgName))
-			instances, err := asg.instances()
-			if err != nil {
-				d.log.Error(fmt.Sprintf("failed to look up instances for ASG %s", asg.asgName), zap.Error(err))
-				continue
-			}
-			for i, instance := range instances {
-				d.log.Info(fmt.Sprintf("[%d/%d] Tagging existing instance %s", i+1, len(instances), instance))
-				asg.Handle(instance)
+		for _, asg := range taggers {
+			if ctx.Err() != nil {
+				break
 			}
+			d.backfill(work, asg, true)
 		}
 	}
+
+	if rebalance != nil {
+		d.goHandler(func() { d.runRebalance(ctx, work, rebalance) })
+	}
+
+	if d.config.DiscoveryInterval > 0 {
+		d.log.Info(fmt.Sprintf("Rediscovering ASGs every %s", d.config.DiscoveryInterval))
+		d.goHandler(func() { d.runDiscovery(ctx, work, d.config.DiscoveryInterval) })
+	}
+
+	if d.config.Orphans.Interval > 0 {
+		d.log.Info(fmt.Sprintf("Checking for orphaned volumes every %s", d.config.Orphans.Interval))
+		d.goHandler(func() { d.runOrphanReaper(ctx, work, d.config.Orphans.Interval) })
+	}
+
+	if d.pvcTagger != nil {
+		d.goHandler(func() {
+			if err := d.pvcTagger.Run(ctx, work); err != nil {
+				d.log.Error("PersistentVolume handler failed", zap.Error(err))
+			}
+		})
+	}
+
+	if d.labeler != nil {
+		d.goHandler(func() {
+			if err := d.labeler.Run(ctx, work); err != nil {
+				d.log.Error("Node labeler failed", zap.Error(err))
+			}
+		})
+	}
+
+	if d.nodes != nil && len(d.nodes.taggers) > 0 {
+		d.goHandler(func() {
+			if err := d.nodes.Run(ctx, work); err != nil {
+				d.log.Error("Node watcher failed", zap.Error(err))
+			}
+		})
+	}
+
+	if d.config.Snapshots.Interval > 0 {
+		d.log.Info(fmt.Sprintf("Scanning snapshots every %s", d.config.Snapshots.Interval))
+		d.goHandler(func() { d.runSnapshotScan(ctx, work, d.config.Snapshots.Interval) })
+	}
+
 	d.log.Info("Polling SQS queue for events...")
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		default:
-			d.log.Debug("Polling SQS for messages", zap.String("queueURL", d.queue.url))
-			messages, err := d.queue.GetMessages(ctx)
-			if err != nil {
-				d.log.Warn("Failed to get messages from SQS", zap.Error(err))
+	inFlight := make(chan struct{}, maxInFlightMessages)
+	for ctx.Err() == nil {
+		d.log.Debug("Polling SQS for messages", zap.String("queueURL", d.queue.url))
+		// Receiving stops as soon as ctx is cancelled
+		messages, err := d.queue.GetMessages(ctx)
+		if err != nil {
+			d.log.Warn("Failed to get messages from SQS", zap.Error(err))
+		}
+		// Messages are handled concurrently, so a launch waiting for its
+		// volumes doesn't hold up the others
+		for _, m := range messages {
+			m := m
+			inFlight <- struct{}{}
+			handling := d.goHandler(func() {
+				defer func() { <-inFlight }()
+				d.handleQueueMessage(work, m)
+			})
+			if !handling {
+				<-inFlight
 			}
-			for _, m := range messages {
-				var env Envelope
-				var msg Message
-
-				if err := d.queue.DeleteMessage(ctx, aws.StringValue(m.ReceiptHandle)); err != nil {
-					d.log.Warn("Failed to delete SQS message", zap.Error(err))
-				}
-
-				// unmarshal outer layer
-				if err := json.Unmarshal([]byte(*m.Body), &env); err != nil {
-					d.log.Error("Failed to unmarshal envelope", zap.Error(err))
-					continue
-				}
-
-				d.log.Debug("Received an SQS message",
-					zap.String("type", env.Type),
-					zap.String("subject", env.Subject),
-				)
-
-				// unmarshal inner layer
-				if err := json.Unmarshal([]byte(env.Message), &msg); err != nil {
-					d.log.Error("Failed to unmarshal autoscaling message", zap.Error(err))
-					continue
-				}
-
-				if _, exists := d.asgTaggers[msg.GroupName]; !exists {
-					d.log.Debug(fmt.Sprintf("Skipping message, %s not a managed ASG", msg.GroupName))
-					continue
-				}
-
-				if msg.Event != "autoscaling:EC2_INSTANCE_LAUNCH" {
-					d.log.Debug(fmt.Sprintf("Skipping autoscaling event, %s not ECS_INSTANCE_LAUNCH", msg.Event))
-					continue
-				}
-
-				d.asgTaggers[msg.GroupName].Handle(msg.EC2InstanceID)
+		}
+	}
+	d.drain(work)
+	return nil
+}
+
+// handleQueueMessage handles a message and deletes it from the queue, unless it's
+// left for another replica or was cut short by the end of the grace period. The
+// message stays hidden from other receivers while it's handled. Messages that
+// failed are retried with a backoff, up to maxMessageAttempts failures.
+func (d *Daemon) handleQueueMessage(work context.Context, m *sqs.Message) {
+	stop := d.keepHidden(aws.StringValue(m.ReceiptHandle))
+	err := d.handleMessage(work, aws.StringValue(m.Body))
+	stop()
+	switch {
+	case errors.Is(err, errNotOwned):
+		// Hide it for a moment, so replicas not owning the ASG don't keep
+		// receiving it back and forth while its owner is polling too
+		d.log.Debug("Leaving SQS message for another replica", zap.Error(err))
+		if err := d.queue.ChangeMessageVisibility(work, aws.StringValue(m.ReceiptHandle), notOwnedVisibilityTimeout); err != nil {
+			d.log.Warn("Failed to change visibility of SQS message", zap.Error(err))
+		}
+		return
+	case err != nil && work.Err() != nil:
+		// work is cancelled, make it visible again for the next replica to start
+		d.log.Warn("Leaving unfinished SQS message on the queue", zap.Error(err))
+		ctx, cancel := context.WithTimeout(context.Background(), sqsCallTimeout)
+		defer cancel()
+		if err := d.queue.ChangeMessageVisibility(ctx, aws.StringValue(m.ReceiptHandle), 0); err != nil {
+			d.log.Warn("Failed to change visibility of SQS message", zap.Error(err))
+		}
+		return
+	case err != nil:
+		attempts := d.failures.add(aws.StringValue(m.MessageId))
+		if attempts >= maxMessageAttempts {
+			d.log.Error(fmt.Sprintf("Failed to handle SQS message %d times, dropping it", attempts), zap.Error(err))
+			break
+		}
+		delay := retryDelay(attempts)
+		d.log.Warn(fmt.Sprintf("Failed to handle SQS message, retrying in %s", delay), zap.Error(err))
+		if err := d.queue.ChangeMessageVisibility(work, aws.StringValue(m.ReceiptHandle), delay); err != nil {
+			d.log.Warn("Failed to change visibility of SQS message", zap.Error(err))
+		}
+		return
+	}
+	d.failures.clear(aws.StringValue(m.MessageId))
+	if err := d.queue.DeleteMessage(work, aws.StringValue(m.ReceiptHandle)); err != nil {
+		d.log.Warn("Failed to delete SQS message", zap.Error(err))
+	}
+}
+
+// keepHidden extends the visibility timeout of a received message until the
+// returned function is called, so it isn't received again while it's handled.
+func (d *Daemon) keepHidden(receiptHandle string) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(messageVisibilityTimeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), sqsCallTimeout)
+			err := d.queue.ChangeMessageVisibility(ctx, receiptHandle, messageVisibilityTimeout)
+			cancel()
+			if err != nil {
+				d.log.Warn("Failed to extend visibility of SQS message", zap.Error(err))
 			}
 		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
 	}
 }
 
-func (d *Daemon) listAutoscalingGroupNames(ctx context.Context) ([]string, error) {
-	asgList := []string{}
-	input := &autoscaling.DescribeAutoScalingGroupsInput{}
-	err := d.asgClient.DescribeAutoScalingGroupsPagesWithContext(ctx, input, func(page *autoscaling.DescribeAutoScalingGroupsOutput, lastPage bool) bool {
-		for _, asg := range page.AutoScalingGroups {
-			asgList = append(asgList, *asg.AutoScalingGroupName)
+// handleMessage decodes a queue message and dispatches it to the right handler.
+// Messages that can't be decoded are logged and dropped, as retrying them won't
+// help. Errors are returned for messages that may succeed when retried, and
+// errNotOwned for messages to leave on the queue for another replica. Handling
+// is bounded by the event timeout, within the deadline of ctx.
+func (d *Daemon) handleMessage(ctx context.Context, body string) error {
+	p, err := decodeMessage(body)
+	if err != nil {
+		d.log.Error("Failed to decode SQS message", zap.Error(err))
+		return nil
+	}
+	keys := p.dedupeKeys()
+	if d.dedupe.Seen(keys...) {
+		d.log.Debug("Skipping duplicate SQS message", zap.Strings("keys", keys))
+		return nil
+	}
+	ctx, cancel := d.config.Timeouts.eventContext(ctx)
+	defer cancel()
+	switch {
+	case p.autoscaling != nil:
+		err = d.handleAutoscalingMessage(ctx, p.autoscaling)
+	case p.event != nil:
+		err = d.handleEvent(ctx, p.event)
+	}
+	if err == nil {
+		d.dedupe.Mark(keys...)
+	}
+	return err
+}
+
+func (d *Daemon) handleAutoscalingMessage(ctx context.Context, msg *Message) error {
+	d.log.Debug("Received an autoscaling message",
+		zap.String("event", msg.Event),
+		zap.String("asg", msg.GroupName),
+	)
+
+	tagger, exists := d.tagger(msg.GroupName)
+	if !exists {
+		d.log.Debug(fmt.Sprintf("Skipping message, %s not a managed ASG", msg.GroupName))
+		return nil
+	}
+
+	if msg.Event != "autoscaling:EC2_INSTANCE_LAUNCH" {
+		d.log.Debug(fmt.Sprintf("Skipping autoscaling event, %s not ECS_INSTANCE_LAUNCH", msg.Event))
+		return nil
+	}
+	if !d.owns(msg.GroupName) {
+		return fmt.Errorf("launch of %s in %s: %w", msg.EC2InstanceID, msg.GroupName, errNotOwned)
+	}
+
+	// The same instance may be announced by several notifications
+	key := tagger.instanceKey(d.scope, CauseLaunch, msg.EC2InstanceID)
+	if d.dedupe.Seen(key) {
+		d.log.Debug(fmt.Sprintf("Skipping launch of %s, already tagged", msg.EC2InstanceID), zap.String("asg", msg.GroupName))
+		return nil
+	}
+	if err := tagger.HandleLaunch(ctx, msg.EC2InstanceID); err != nil {
+		return fmt.Errorf("failed to tag instance %s of ASG %s: %w", msg.EC2InstanceID, msg.GroupName, err)
+	}
+	d.dedupe.Mark(key)
+	return nil
+}
+
+func (d *Daemon) handleEvent(ctx context.Context, event *Event) error {
+	d.log.Debug("Received an EventBridge event",
+		zap.String("source", event.Source),
+		zap.String("detailType", event.DetailType),
+	)
+
+	if event.Source != eventSourceEC2 {
+		d.log.Debug(fmt.Sprintf("Skipping event, %s from %s not supported", event.DetailType, event.Source))
+		return nil
+	}
+	switch event.DetailType {
+	case detailTypeSnapshot:
+		return d.handleSnapshotEvent(ctx, event)
+	case detailTypeCloudTrail:
+	default:
+		d.log.Debug(fmt.Sprintf("Skipping event, %s from %s not supported", event.DetailType, event.Source))
+		return nil
+	}
+
+	var detail CloudTrailDetail
+	if err := json.Unmarshal(event.Detail, &detail); err != nil {
+		d.log.Error("Failed to unmarshal CloudTrail event detail", zap.Error(err))
+		return nil
+	}
+	if detail.ErrorCode != "" {
+		d.log.Debug(fmt.Sprintf("Skipping failed %s call", detail.EventName), zap.String("errorCode", detail.ErrorCode))
+		return nil
+	}
+
+	switch detail.EventName {
+	case eventNameAttachVol:
+		var params AttachVolumeParameters
+		if err := json.Unmarshal(detail.RequestParameters, &params); err != nil {
+			d.log.Error("Failed to unmarshal AttachVolume parameters", zap.Error(err))
+			return nil
 		}
+		return d.handleAttachVolume(ctx, &params)
+	default:
+		d.log.Debug(fmt.Sprintf("Skipping CloudTrail event, %s not supported", detail.EventName))
+	}
+	return nil
+}
+
+// handleAttachVolume tags a volume attached to an instance of a managed ASG after launch.
+func (d *Daemon) handleAttachVolume(ctx context.Context, params *AttachVolumeParameters) error {
+	asgName, err := d.instanceASG(ctx, params.InstanceID)
+	if err != nil {
+		return fmt.Errorf("failed to look up ASG of instance %s: %w", params.InstanceID, err)
+	}
+	tagger, exists := d.tagger(asgName)
+	if !exists {
+		d.log.Debug(fmt.Sprintf("Skipping volume %s, instance %s not in a managed ASG", params.VolumeID, params.InstanceID))
+		return nil
+	}
+	if !d.owns(asgName) {
+		return fmt.Errorf("volume %s attached to %s in %s: %w", params.VolumeID, params.InstanceID, asgName, errNotOwned)
+	}
+	if err := tagger.HandleAttachedVolume(ctx, params.InstanceID, params.VolumeID); err != nil {
+		return fmt.Errorf("failed to tag volume %s of ASG %s: %w", params.VolumeID, asgName, err)
+	}
+	return nil
+}
+
+// instanceASG returns the name of the ASG that launched instanceID, or an empty string.
+func (d *Daemon) instanceASG(ctx context.Context, instanceID string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.config.Timeouts.describe())
+	defer cancel()
+	out, err := d.ec2Client.DescribeTagsWithContext(ctx, &ec2.DescribeTagsInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("resource-id"),
+				Values: aws.StringSlice([]string{instanceID}),
+			},
+			{
+				Name:   aws.String("key"),
+				Values: aws.StringSlice([]string{asgNameTagKey}),
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(out.Tags) == 0 {
+		return "", nil
+	}
+	return aws.StringValue(out.Tags[0].Value), nil
+}
+
+func (d *Daemon) listAutoscalingGroups(ctx context.Context) ([]*autoscaling.Group, error) {
+	return listAutoscalingGroups(ctx, d.asgClient)
+}
+
+func listAutoscalingGroups(ctx context.Context, asgClient AutoscalingClient) ([]*autoscaling.Group, error) {
+	asgList := []*autoscaling.Group{}
+	input := &autoscaling.DescribeAutoScalingGroupsInput{}
+	err := asgClient.DescribeAutoScalingGroupsPagesWithContext(ctx, input, func(page *autoscaling.DescribeAutoScalingGroupsOutput, lastPage bool) bool {
+		asgList = append(asgList, page.AutoScalingGroups...)
 		return true
 	})
 	if err != nil {
@@ -209,6 +713,13 @@ func (d *Daemon) listAutoscalingGroupNames(ctx context.Context) ([]string, error
 	return asgList, nil
 }
 
-func (d *Daemon) addTagger(asgName string, tags *TaggingConfig) {
-	d.asgTaggers[asgName] = NewAutoscalingTagger(asgName, tags, d.queue, d.asgClient, d.ec2Client, d.log)
+func (d *Daemon) addTagger(asgName string, tags *TaggingConfig) *AutoscalingTagger {
+	tagger := NewAutoscalingTagger(asgName, tags, d.queue, d.asgClient, d.ec2Client, d.log)
+	tagger.nodeLabeler = d.labeler
+	tagger.audit = d.audit
+	tagger.handlers = &d.handlers
+	tagger.owns = d.owns
+	tagger.timeouts = d.config.Timeouts
+	d.asgTaggers[asgName] = tagger
+	return tagger
 }
@@ -0,0 +1,128 @@
+package tagd
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/leosunmo/tagd/tagdtest"
+	"go.uber.org/zap"
+)
+
+func TestNewValidatesConfig(t *testing.T) {
+	config := &Config{
+		TaggingConfigs: []TaggingConfig{{ASGName: "web"}, {ASGName: "web"}},
+	}
+	sess := session.Must(session.NewSession(aws.NewConfig().WithRegion("us-east-1")))
+	_, err := New(config, sess, zap.NewNop())
+	if err == nil || !strings.Contains(err.Error(), "duplicate asgName") {
+		t.Errorf("New() error = %v, want a duplicate asgName error", err)
+	}
+}
+
+// startDaemon runs d until the test ends.
+func startDaemon(t *testing.T, d *Daemon) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- d.Start(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Start() error = %v", err)
+		}
+	})
+}
+
+// newTestFleet returns a Backend with the queue and topic of a Config managing
+// the ASG web, which tags volumes with env=prod and copies the team tag.
+func newTestFleet(t *testing.T) (*tagdtest.Backend, *Config) {
+	t.Helper()
+	backend := tagdtest.NewBackend("", "")
+	backend.CreateQueue("tagd")
+	topic := backend.CreateTopic("tagd")
+	if err := backend.CreateASG("web", map[string]string{"team": "web"}); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		SQSQueueName: "tagd",
+		SNSTopicARN:  topic,
+		TaggingConfigs: []TaggingConfig{{
+			ASGName:   "web",
+			Tags:      map[string]string{"env": "prod"},
+			KeyPrefix: []string{"team"},
+		}},
+		ShutdownGracePeriod: time.Second,
+	}
+	return backend, config
+}
+
+// waitForTags waits until resourceID carries tags.
+func waitForTags(t *testing.T, backend *tagdtest.Backend, resourceID string, tags map[string]string) {
+	t.Helper()
+	waitFor(t, "tags of "+resourceID, func() bool {
+		return containsTags(backend.Tags(resourceID), tags)
+	})
+}
+
+func TestDaemonTagsLaunchesAttachmentsAndSnapshots(t *testing.T) {
+	backend, config := newTestFleet(t)
+	startDaemon(t, newTestDaemon(t, backend, config))
+	waitFor(t, "notifications of web", func() bool {
+		return len(backend.NotificationConfigurations("web")) > 0
+	})
+	want := map[string]string{"env": "prod", "team": "web", MarkerTagASG: "web"}
+
+	// The launch notification reaches the queue through the topic
+	id, err := backend.LaunchInstance("web", tagdtest.InstanceSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := backend.Volumes(id)[0]
+	waitForTags(t, backend, root, want)
+
+	vol := backend.CreateVolume(tagdtest.VolumeSpec{})
+	if err := backend.AttachVolume(vol, id, "/dev/sdf"); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.SendMessage("tagd", backend.AttachVolumeEvent(vol, id, "/dev/sdf")); err != nil {
+		t.Fatal(err)
+	}
+	waitForTags(t, backend, vol, want)
+
+	snap, err := backend.CreateSnapshot(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.SendMessage("tagd", backend.SnapshotEvent(snap)); err != nil {
+		t.Fatal(err)
+	}
+	waitForTags(t, backend, snap, want)
+
+	waitFor(t, "the queue to empty", func() bool { return len(backend.Messages("tagd")) == 0 })
+}
+
+func TestDaemonRetriesFailedMessages(t *testing.T) {
+	backend, config := newTestFleet(t)
+	config.Timeouts = testTimeouts
+	startDaemon(t, newTestDaemon(t, backend, config))
+	waitFor(t, "notifications of web", func() bool {
+		return len(backend.NotificationConfigurations("web")) > 0
+	})
+
+	// Throttled, then hung until the tag timeout, then tagged on the third receive
+	backend.InjectFault("CreateTags", tagdtest.Fault{Err: tagdtest.Error("RequestLimitExceeded", "Request limit exceeded."), Times: 1})
+	backend.InjectFault("CreateTags", tagdtest.Fault{Delay: time.Hour, Times: 1})
+	id, err := backend.LaunchInstance("web", tagdtest.InstanceSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForTags(t, backend, backend.Volumes(id)[0], map[string]string{"env": "prod"})
+	if got := backend.Calls("CreateTags"); got != 3 {
+		t.Errorf("CreateTags calls = %d, want 3", got)
+	}
+	waitFor(t, "the queue to empty", func() bool { return len(backend.Messages("tagd")) == 0 })
+}
@@ -0,0 +1,237 @@
+package tagd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultDedupeTTL = 24 * time.Hour
+	dedupePruneEvery = time.Hour
+)
+
+var dedupeBucket = []byte("processed")
+
+// DedupeConfig enables skipping events and instances that were already handled,
+// across restarts. SQS delivers messages at least once, SNS may duplicate them,
+// and backfilling on startup would otherwise tag every instance again.
+type DedupeConfig struct {
+	// Path of the store file. Deduplication is disabled if empty.
+	Path string `yaml:"path,omitempty"`
+	// TTL is how long a handled event is remembered, defaults to 24 hours. Backfill
+	// tags an instance again once its entry has expired, to catch drift.
+	TTL time.Duration `yaml:"ttl,omitempty"`
+}
+
+// DedupeStats are the lookups in a DedupeStore since it was opened.
+type DedupeStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// DedupeStore remembers the identities of handled events in an embedded bbolt
+// database until they expire. A nil DedupeStore remembers nothing. Expired
+// entries are pruned in the background until the store is closed.
+type DedupeStore struct {
+	db     *bolt.DB
+	ttl    time.Duration
+	log    *zap.Logger
+	hits   uint64
+	misses uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// OpenDedupeStore opens or creates the store at path. Only one process can
+// open it at a time.
+func OpenDedupeStore(path string, ttl time.Duration, logger *zap.Logger) (*DedupeStore, error) {
+	if ttl <= 0 {
+		ttl = defaultDedupeTTL
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dedupe store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(dedupeBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open dedupe store %s: %w", path, err)
+	}
+	s := &DedupeStore{
+		db:   db,
+		ttl:  ttl,
+		log:  logger,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// openDedupeStore returns the configured store, or nil if deduplication is disabled.
+func openDedupeStore(conf *DedupeConfig, logger *zap.Logger) (*DedupeStore, error) {
+	if conf.Path == "" {
+		return nil, nil
+	}
+	return OpenDedupeStore(conf.Path, conf.TTL, logger)
+}
+
+// Seen returns true if any of keys was handled and hasn't expired yet.
+func (s *DedupeStore) Seen(keys ...string) bool {
+	if s == nil || len(keys) == 0 {
+		return false
+	}
+	now := time.Now().UnixNano()
+	seen := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(dedupeBucket)
+		for _, k := range keys {
+			if v := b.Get([]byte(k)); len(v) == 8 && int64(binary.BigEndian.Uint64(v)) > now {
+				seen = true
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// Handling an event twice is better than not at all
+		s.log.Warn("Failed to look up dedupe store", zap.Error(err))
+		return false
+	}
+	if seen {
+		atomic.AddUint64(&s.hits, 1)
+	} else {
+		atomic.AddUint64(&s.misses, 1)
+	}
+	return seen
+}
+
+// Mark records keys as handled until the TTL expires.
+func (s *DedupeStore) Mark(keys ...string) {
+	if s == nil || len(keys) == 0 {
+		return
+	}
+	expiry := make([]byte, 8)
+	binary.BigEndian.PutUint64(expiry, uint64(time.Now().Add(s.ttl).UnixNano()))
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(dedupeBucket)
+		for _, k := range keys {
+			if err := b.Put([]byte(k), expiry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.log.Warn("Failed to update dedupe store", zap.Error(err))
+	}
+}
+
+// Stats returns the lookups since the store was opened.
+func (s *DedupeStore) Stats() DedupeStats {
+	if s == nil {
+		return DedupeStats{}
+	}
+	return DedupeStats{
+		Hits:   atomic.LoadUint64(&s.hits),
+		Misses: atomic.LoadUint64(&s.misses),
+	}
+}
+
+func (s *DedupeStore) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(dedupePruneEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+		pruned, err := s.prune()
+		if err != nil {
+			s.log.Warn("Failed to prune dedupe store", zap.Error(err))
+		}
+		stats := s.Stats()
+		s.log.Info(fmt.Sprintf("Dedupe store skipped %d duplicate(s) of %d lookup(s), pruned %d expired entries",
+			stats.Hits, stats.Hits+stats.Misses, pruned))
+	}
+}
+
+// prune deletes the expired entries and returns how many there were.
+func (s *DedupeStore) prune() (int, error) {
+	now := time.Now().UnixNano()
+	pruned := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(dedupeBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if len(v) != 8 || int64(binary.BigEndian.Uint64(v)) <= now {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+				pruned++
+			}
+		}
+		return nil
+	})
+	return pruned, err
+}
+
+// Close stops pruning and closes the database.
+func (s *DedupeStore) Close() error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case <-s.stop:
+		return nil
+	default:
+		close(s.stop)
+	}
+	<-s.done
+	return s.db.Close()
+}
+
+// dedupeKeys returns the identities of a queue message: the SNS MessageId and
+// the autoscaling ActivityId or EventBridge event ID.
+func (p *payload) dedupeKeys() []string {
+	var keys []string
+	if p.snsMessageID != "" {
+		keys = append(keys, "sns/"+p.snsMessageID)
+	}
+	switch {
+	case p.autoscaling != nil && p.autoscaling.ActivityID != "":
+		keys = append(keys, "activity/"+p.autoscaling.ActivityID)
+	case p.event != nil && p.event.ID != "":
+		keys = append(keys, "event/"+p.event.ID)
+	}
+	return keys
+}
+
+// instanceKey identifies the instance tagged by the tagger for cause with its
+// current config, so changing the config tags the instance again.
+func (l *AutoscalingTagger) instanceKey(s Scope, cause Cause, instanceID string) string {
+	return fmt.Sprintf("instance/%s/%s/%s/%s/%s", s, l.asgName, instanceID, l.tags.hash(), cause)
+}
+
+// hash returns a hash of the TaggingConfig.
+func (c *TaggingConfig) hash() string {
+	out, err := yaml.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	h := fnv.New64a()
+	h.Write(out)
+	return fmt.Sprintf("%016x", h.Sum64())
+}
@@ -0,0 +1,238 @@
+package tagd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/ryanuber/go-glob"
+	"go.uber.org/zap"
+)
+
+// discover matches the configured ASG patterns against the existing ASGs, adding
+// taggers for new ASGs, removing those for deleted ones and refreshing the cached
+// ASG tags. It returns the taggers that were added.
+func (d *Daemon) discover(ctx context.Context) ([]*AutoscalingTagger, error) {
+	asgList, err := d.listAutoscalingGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Iterate over the configured ASGs and the actual ASGs and check for glob matches (or exact matches).
+	// If several patterns match an ASG, the last one wins.
+	matched := make(map[string]*TaggingConfig)
+	asgs := make(map[string]*autoscaling.Group)
+	for i := range d.config.TaggingConfigs {
+		conf := &d.config.TaggingConfigs[i]
+		if conf.ASGName == "" {
+			continue
+		}
+		for _, asg := range asgList {
+			asgName := aws.StringValue(asg.AutoScalingGroupName)
+			if glob.Glob(conf.ASGName, asgName) {
+				matched[asgName] = conf
+				asgs[asgName] = asg
+			}
+		}
+	}
+
+	var added []*AutoscalingTagger
+	for asgName, conf := range matched {
+		tagger, exists := d.asgTaggers[asgName]
+		if !exists || tagger.tags != conf {
+			tagger = d.addTagger(asgName, conf)
+			if !exists {
+				added = append(added, tagger)
+			}
+		}
+		tagger.setASGTags(asgTagMap(asgs[asgName].Tags))
+	}
+
+	for asgName := range d.asgTaggers {
+		if _, ok := matched[asgName]; !ok {
+			d.log.Info(fmt.Sprintf("No longer managing tags for ASG %s", asgName))
+			delete(d.asgTaggers, asgName)
+		}
+	}
+	return added, nil
+}
+
+// runDiscovery periodically rediscovers ASGs with the work context until ctx is
+// cancelled. New ASGs get notifications enabled and are backfilled like those
+// found at startup.
+func (d *Daemon) runDiscovery(ctx, work context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		d.log.Debug("Rediscovering ASGs")
+		if _, err := d.discover(work); err != nil {
+			d.log.Error("failed to rediscover ASGs", zap.Error(err))
+			continue
+		}
+		d.takeOver(work)
+	}
+}
+
+// takeOver enables notifications and backfills the ASGs this replica owns that
+// it didn't before, either discovered since or moved here by sharding.
+func (d *Daemon) takeOver(ctx context.Context) {
+	_, added := d.claim()
+	for _, asg := range added {
+		d.log.Info(fmt.Sprintf("Managing tags for ASG %s", asg.asgName))
+		if d.config.SNSTopicARN != "" {
+			d.enableNotifications(ctx, asg)
+		}
+		if d.config.Backfill {
+			d.backfill(ctx, asg, true)
+		}
+	}
+}
+
+// claim returns the taggers of the ASGs this replica owns, sorted by ASG name,
+// and those of them it didn't own the last time claim was called.
+func (d *Daemon) claim() (owned, added []*AutoscalingTagger) {
+	for _, tagger := range d.taggers() {
+		if d.owns(tagger.asgName) {
+			owned = append(owned, tagger)
+		}
+	}
+
+	d.mu.Lock()
+	previous := d.owned
+	d.owned = make(map[string]bool, len(owned))
+	for _, tagger := range owned {
+		d.owned[tagger.asgName] = true
+	}
+	current := d.owned
+	d.mu.Unlock()
+
+	for _, tagger := range owned {
+		if !previous[tagger.asgName] {
+			added = append(added, tagger)
+		}
+	}
+	for asgName := range previous {
+		// ASGs that are no longer managed at all were logged by discover
+		if _, exists := d.tagger(asgName); exists && !current[asgName] {
+			d.log.Info(fmt.Sprintf("Handing over ASG %s to another replica", asgName))
+		}
+	}
+	return owned, added
+}
+
+// owns returns true if this replica handles asgName.
+func (d *Daemon) owns(asgName string) bool {
+	return d.sharder.Owns(d.scope, asgName)
+}
+
+// tagger returns the tagger managing asgName.
+func (d *Daemon) tagger(asgName string) (*AutoscalingTagger, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	tagger, exists := d.asgTaggers[asgName]
+	return tagger, exists
+}
+
+// taggers returns all taggers, sorted by ASG name.
+func (d *Daemon) taggers() []*AutoscalingTagger {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	taggers := make([]*AutoscalingTagger, 0, len(d.asgTaggers))
+	for _, tagger := range d.asgTaggers {
+		taggers = append(taggers, tagger)
+	}
+	sort.Slice(taggers, func(i, j int) bool {
+		return taggers[i].asgName < taggers[j].asgName
+	})
+	return taggers
+}
+
+func (d *Daemon) enableNotifications(ctx context.Context, asg *AutoscalingTagger) {
+	if err := asg.EnableNotifications(ctx); err != nil {
+		d.log.Error(fmt.Sprintf("failed to enable notifications for ASG %s", asg.asgName), zap.Error(err))
+	}
+}
+
+// backfill tags the existing instances of an ASG. Failures are logged, and an
+// error is returned if any instance could not be tagged. With dedupe, instances
+// tagged with the same config before, even before a restart, are skipped.
+func (d *Daemon) backfill(ctx context.Context, asg *AutoscalingTagger, dedupe bool) error {
+	d.log.Info(fmt.Sprintf("Processing existing disks for ASG %s", asg.asgName))
+	instances, err := asg.instances(ctx)
+	if err != nil {
+		d.log.Error(fmt.Sprintf("failed to look up instances for ASG %s", asg.asgName), zap.Error(err))
+		return err
+	}
+	failed := 0
+	for i, instance := range instances {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		key := asg.instanceKey(d.scope, CauseBackfill, instance)
+		if dedupe && d.dedupe.Seen(key, asg.instanceKey(d.scope, CauseLaunch, instance)) {
+			d.log.Debug(fmt.Sprintf("[%d/%d] Skipping instance %s, already tagged", i+1, len(instances), instance))
+			continue
+		}
+		d.log.Info(fmt.Sprintf("[%d/%d] Tagging existing instance %s", i+1, len(instances), instance))
+		if err := asg.Handle(ctx, instance); err != nil {
+			d.log.Error(fmt.Sprintf("failed to tag instance %s", instance), zap.String("asg", asg.asgName), zap.Error(err))
+			failed++
+			continue
+		}
+		d.dedupe.Mark(key)
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to tag %d of %d instances", failed, len(instances))
+	}
+	return nil
+}
+
+// setASGTags caches the ASG's tags for InheritASGTags.
+func (l *AutoscalingTagger) setASGTags(tags map[string]string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.asgTags = tags
+}
+
+// inheritedASGTags returns the cached ASG tags, looking them up if they
+// haven't been discovered yet.
+func (l *AutoscalingTagger) inheritedASGTags(ctx context.Context) (map[string]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.asgTags != nil {
+		return l.asgTags, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, l.timeouts.describe())
+	defer cancel()
+	out, err := l.autoscaling.DescribeAutoScalingGroupsWithContext(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: aws.StringSlice([]string{l.asgName}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	l.asgTags = map[string]string{}
+	for _, asg := range out.AutoScalingGroups {
+		l.asgTags = asgTagMap(asg.Tags)
+	}
+	return l.asgTags, nil
+}
+
+func asgTagMap(tags []*autoscaling.TagDescription) map[string]string {
+	m := make(map[string]string, len(tags))
+	for _, t := range tags {
+		m[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return m
+}
@@ -0,0 +1,99 @@
+package tagd
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// DynamoDBClient for testing purposes
+type DynamoDBClient dynamodbiface.DynamoDBAPI
+
+// DynamoDBLock is a leader lease stored as an item in a DynamoDB table with a
+// string partition key named LockID. The item holds the owner's identity and
+// when the lease expires, by the owner's clock, so replicas' clocks must not
+// drift apart by more than the lease duration.
+type DynamoDBLock struct {
+	client   DynamoDBClient
+	table    string
+	name     string
+	identity string
+}
+
+// NewDynamoDBLock returns a lock named name in table, held as identity.
+func NewDynamoDBLock(client DynamoDBClient, table, name, identity string) *DynamoDBLock {
+	return &DynamoDBLock{
+		client:   client,
+		table:    table,
+		name:     name,
+		identity: identity,
+	}
+}
+
+func (l *DynamoDBLock) tryAcquire(ctx context.Context, leaseDuration time.Duration) (string, error) {
+	now := time.Now()
+	_, err := l.client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(l.table),
+		Item: map[string]*dynamodb.AttributeValue{
+			"LockID":  {S: aws.String(l.name)},
+			"Owner":   {S: aws.String(l.identity)},
+			"Expires": {N: aws.String(unixMillis(now.Add(leaseDuration)))},
+		},
+		// Owner is a reserved word in expressions
+		ConditionExpression: aws.String("attribute_not_exists(LockID) OR #expires < :now OR #owner = :owner"),
+		ExpressionAttributeNames: map[string]*string{
+			"#expires": aws.String("Expires"),
+			"#owner":   aws.String("Owner"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now":   {N: aws.String(unixMillis(now))},
+			":owner": {S: aws.String(l.identity)},
+		},
+	})
+	if err == nil {
+		return l.identity, nil
+	}
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+		return "", err
+	}
+
+	// Someone else holds the lease
+	out, err := l.client.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(l.table),
+		Key:            map[string]*dynamodb.AttributeValue{"LockID": {S: aws.String(l.name)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	if owner, ok := out.Item["Owner"]; ok {
+		return aws.StringValue(owner.S), nil
+	}
+	return "", nil
+}
+
+func (l *DynamoDBLock) release(ctx context.Context) error {
+	_, err := l.client.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName:                aws.String(l.table),
+		Key:                      map[string]*dynamodb.AttributeValue{"LockID": {S: aws.String(l.name)}},
+		ConditionExpression:      aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]*string{"#owner": aws.String("Owner")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":owner": {S: aws.String(l.identity)},
+		},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		// Not ours anymore
+		return nil
+	}
+	return err
+}
+
+func unixMillis(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
@@ -0,0 +1,61 @@
+package tagd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/leosunmo/tagd/tagdtest"
+)
+
+func TestDynamoDBLock(t *testing.T) {
+	backend := tagdtest.NewBackend("", "")
+	backend.CreateTable("locks", "LockID")
+	a := NewDynamoDBLock(backend.DynamoDB(), "locks", "tagd", "replica-a")
+	b := NewDynamoDBLock(backend.DynamoDB(), "locks", "tagd", "replica-b")
+	ctx := context.Background()
+
+	acquire := func(l *DynamoDBLock, lease time.Duration, want string) {
+		t.Helper()
+		holder, err := l.tryAcquire(ctx, lease)
+		if err != nil {
+			t.Fatalf("%s: tryAcquire: %v", l.identity, err)
+		}
+		if holder != want {
+			t.Fatalf("%s: holder = %q, want %q", l.identity, holder, want)
+		}
+	}
+
+	// Acquire, and renew while others are turned away
+	acquire(a, time.Minute, "replica-a")
+	acquire(b, time.Minute, "replica-a")
+	before := backend.Item("locks", "tagd")["Expires"]
+	time.Sleep(2 * time.Millisecond)
+	acquire(a, time.Minute, "replica-a")
+	if after := backend.Item("locks", "tagd")["Expires"]; after <= before {
+		t.Errorf("renewal didn't extend the lease: %s, was %s", after, before)
+	}
+
+	// Releasing someone else's lease does nothing
+	if err := b.release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if owner := backend.Item("locks", "tagd")["Owner"]; owner != "replica-a" {
+		t.Fatalf("owner after b's release = %q, want replica-a", owner)
+	}
+
+	// An expired lease is taken over
+	acquire(a, time.Millisecond, "replica-a")
+	time.Sleep(5 * time.Millisecond)
+	acquire(b, time.Minute, "replica-b")
+	acquire(a, time.Minute, "replica-b")
+
+	// and is free once released
+	if err := b.release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if item := backend.Item("locks", "tagd"); item != nil {
+		t.Fatalf("lease not deleted on release: %v", item)
+	}
+	acquire(a, time.Minute, "replica-a")
+}
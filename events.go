@@ -0,0 +1,90 @@
+package tagd
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	eventSourceEC2       = "aws.ec2"
+	detailTypeCloudTrail = "AWS API Call via CloudTrail"
+	eventNameAttachVol   = "AttachVolume"
+
+	// asgNameTagKey is the tag AWS adds to instances launched by an ASG.
+	asgNameTagKey = "aws:autoscaling:groupName"
+)
+
+// Event is an EventBridge event, delivered to the queue by an EventBridge rule
+// either directly or through the SNS topic.
+type Event struct {
+	ID         string          `json:"id"`
+	DetailType string          `json:"detail-type"`
+	Source     string          `json:"source"`
+	Account    string          `json:"account"`
+	Time       time.Time       `json:"time"`
+	Region     string          `json:"region"`
+	Resources  []string        `json:"resources"`
+	Detail     json.RawMessage `json:"detail"`
+}
+
+// CloudTrailDetail is the detail of an "AWS API Call via CloudTrail" event.
+type CloudTrailDetail struct {
+	EventSource       string          `json:"eventSource"`
+	EventName         string          `json:"eventName"`
+	ErrorCode         string          `json:"errorCode"`
+	RequestParameters json.RawMessage `json:"requestParameters"`
+}
+
+// AttachVolumeParameters are the request parameters of an EC2 AttachVolume call.
+type AttachVolumeParameters struct {
+	VolumeID   string `json:"volumeId"`
+	InstanceID string `json:"instanceId"`
+	Device     string `json:"device"`
+}
+
+// payload is a decoded queue message. Exactly one of autoscaling and event is set.
+type payload struct {
+	autoscaling *Message
+	event       *Event
+	// snsMessageID is the MessageId of the SNS envelope, if the message had one.
+	snsMessageID string
+}
+
+// decodeMessage decodes a queue message body. Bodies may be an SNS envelope
+// wrapping an autoscaling notification or EventBridge event, or a raw EventBridge event.
+func decodeMessage(body string) (*payload, error) {
+	var probe struct {
+		Type       string `json:"Type"`
+		MessageID  string `json:"MessageId"`
+		Message    string `json:"Message"`
+		DetailType string `json:"detail-type"`
+	}
+	if err := json.Unmarshal([]byte(body), &probe); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal message: %w", err)
+	}
+
+	// unwrap the SNS envelope
+	if probe.Type == "Notification" {
+		p, err := decodeMessage(probe.Message)
+		if err != nil {
+			return nil, err
+		}
+		p.snsMessageID = probe.MessageID
+		return p, nil
+	}
+
+	if probe.DetailType != "" {
+		var event Event
+		if err := json.Unmarshal([]byte(body), &event); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal event: %w", err)
+		}
+		return &payload{event: &event}, nil
+	}
+
+	var msg Message
+	if err := json.Unmarshal([]byte(body), &msg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal autoscaling message: %w", err)
+	}
+	return &payload{autoscaling: &msg}, nil
+}
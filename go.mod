@@ -3,10 +3,15 @@ module github.com/leosunmo/tagd
 go 1.14
 
 require (
+	github.com/aws/aws-lambda-go v1.34.1
 	github.com/aws/aws-sdk-go v1.33.4
 	github.com/ryanuber/go-glob v1.0.0
 	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.7.0
+	go.etcd.io/bbolt v1.3.5
 	go.uber.org/zap v1.15.0
 	gopkg.in/yaml.v2 v2.3.0
+	k8s.io/api v0.18.6
+	k8s.io/apimachinery v0.18.6
+	k8s.io/client-go v0.18.6
 )
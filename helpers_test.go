@@ -0,0 +1,31 @@
+package tagd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/leosunmo/tagd/tagdtest"
+	"go.uber.org/zap"
+)
+
+// waitFor polls cond until it returns true, failing the test after 5 seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// newTestDaemon returns a Daemon of config using the clients of backend.
+func newTestDaemon(t *testing.T, backend *tagdtest.Backend, config *Config) *Daemon {
+	t.Helper()
+	d, err := NewDaemon(config, backend.SQS(), backend.SNS(), backend.Autoscaling(), backend.EC2(), nil, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
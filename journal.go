@@ -0,0 +1,141 @@
+package tagd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// JournalConfig enables the change journal, which records the previous values
+// of tags before tagd changes them so the change can be rolled back.
+type JournalConfig struct {
+	// Path of the JSONL journal file. The journal is disabled if empty.
+	Path string `yaml:"path,omitempty"`
+}
+
+// JournalEntry is a tag change of one or more resources, written to the
+// journal before the change is made.
+type JournalEntry struct {
+	// ID of the change, also recorded in the audit records of the change.
+	ID      string    `json:"id"`
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	Account string    `json:"account,omitempty"`
+	Region  string    `json:"region,omitempty"`
+	ASG     string    `json:"asg,omitempty"`
+	Cause   Cause     `json:"cause,omitempty"`
+	// Resources changed, each getting the same Tags, or losing their keys for AuditDeleteTags.
+	Resources []string          `json:"resources"`
+	Tags      map[string]string `json:"tags"`
+	// Previous holds the values of the keys of Tags each resource had before the
+	// change. Keys that are missing did not exist.
+	Previous map[string]map[string]string `json:"previous,omitempty"`
+}
+
+// Journal appends JournalEntries to a file, syncing each one to disk.
+type Journal struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+// OpenJournal opens or creates the journal at path for appending.
+func OpenJournal(path string) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open change journal: %w", err)
+	}
+	return &Journal{path: path, f: f}, nil
+}
+
+// Append writes e to the journal. It returns once e is on disk, so a change
+// is never made without its previous values being recorded.
+func (j *Journal) Append(e *JournalEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return fmt.Errorf("change journal %s is closed", j.path)
+	}
+	if _, err := j.f.Write(line); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// Close closes the journal file.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return nil
+	}
+	err := j.f.Close()
+	j.f = nil
+	return err
+}
+
+// ReadJournal returns the entries of the journal at path, oldest first.
+func ReadJournal(path string) ([]*JournalEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []*JournalEntry
+	scanner := bufio.NewScanner(f)
+	// Entries of large backfills can hold many resources
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		entries = append(entries, &e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// newJournalEntry returns the entry for changing tags of resourceIDs, with the
+// previous values of the keys of tags out of current.
+func newJournalEntry(rec *AuditRecord, resourceIDs []string, tags map[string]string, current map[string]map[string]string) *JournalEntry {
+	e := &JournalEntry{
+		ID:        rec.Change,
+		Time:      time.Now().UTC(),
+		Action:    rec.Action,
+		Account:   rec.Account,
+		Region:    rec.Region,
+		ASG:       rec.ASG,
+		Cause:     rec.Cause,
+		Resources: resourceIDs,
+		Tags:      tags,
+		Previous:  make(map[string]map[string]string),
+	}
+	for _, id := range resourceIDs {
+		for k := range tags {
+			if old, exists := current[id][k]; exists {
+				if e.Previous[id] == nil {
+					e.Previous[id] = make(map[string]string)
+				}
+				e.Previous[id][k] = old
+			}
+		}
+	}
+	return e
+}
@@ -0,0 +1,38 @@
+package tagd
+
+import (
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// KubernetesConfig configures the optional Kubernetes handlers.
+type KubernetesConfig struct {
+	// Kubeconfig is the path to a kubeconfig file, the in-cluster config is used if empty.
+	Kubeconfig  string          `yaml:"kubeconfig,omitempty"`
+	ClusterName string          `yaml:"clusterName,omitempty"`
+	PVC         PVCConfig       `yaml:"pvc,omitempty"`
+	NodeLabels  NodeLabelConfig `yaml:"nodeLabels,omitempty"`
+}
+
+// kubernetesEnabled returns true if any Kubernetes handler or event source is enabled.
+func (c *Config) kubernetesEnabled() bool {
+	if c.Kubernetes.PVC.Enabled || c.Kubernetes.NodeLabels.Enabled {
+		return true
+	}
+	for _, conf := range c.TaggingConfigs {
+		if conf.NodeSelector != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// NewKubernetesClient returns a Kubernetes client for kubeconfig, or for the
+// in-cluster config if kubeconfig is empty.
+func NewKubernetesClient(kubeconfig string) (kubernetes.Interface, error) {
+	restConfig, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(restConfig)
+}
@@ -0,0 +1,121 @@
+package tagd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// BatchMessage is a queue message handled by a LambdaHandler, e.g. a record of
+// an SQS event delivered to a Lambda function.
+type BatchMessage struct {
+	ID   string
+	Body string
+	// Source is the ARN of the queue the message was received from, to route it
+	// to the Daemon of the queue's account and region when managing several.
+	Source string
+}
+
+// LambdaHandler handles batches of queue messages with a Daemon's taggers, for
+// running tagd as a Lambda function consuming the SQS queue instead of polling it.
+type LambdaHandler struct {
+	daemon *Daemon
+
+	mu         sync.Mutex
+	discovered time.Time
+}
+
+// NewLambdaHandler returns a new LambdaHandler for d, which doesn't need a queue.
+// Re-checks for volumes attached after launch need a long-running process and are
+// disabled, send AttachVolume events to the queue instead.
+func NewLambdaHandler(d *Daemon) *LambdaHandler {
+	for _, s := range d.scoped() {
+		for i := range s.config.TaggingConfigs {
+			s.config.TaggingConfigs[i].RecheckAfter = -1
+		}
+	}
+	return &LambdaHandler{
+		daemon:     d,
+		discovered: time.Now(),
+	}
+}
+
+// HandleBatch handles the messages the same way Daemon.Start does and returns
+// the IDs of the messages that failed and should be retried.
+func (h *LambdaHandler) HandleBatch(ctx context.Context, messages []BatchMessage) []string {
+	h.rediscover(ctx)
+
+	var failed []string
+	for _, m := range messages {
+		d := h.route(m.Source)
+		if d == nil {
+			h.daemon.log.Error(fmt.Sprintf("Failed to handle SQS message, queue %s not managed", m.Source), zap.String("messageID", m.ID))
+			failed = append(failed, m.ID)
+			continue
+		}
+		if err := d.handleMessage(ctx, m.Body); err != nil {
+			h.daemon.log.Error("Failed to handle SQS message", zap.String("messageID", m.ID), zap.Error(err))
+			failed = append(failed, m.ID)
+		}
+	}
+	// The container may be frozen or discarded once the batch is done
+	if err := h.daemon.audit.Flush(); err != nil {
+		h.daemon.log.Error("Failed to flush audit records", zap.Error(err))
+	}
+	return failed
+}
+
+// route returns the Daemon handling messages from the queue with the ARN source,
+// by the queue's account and region. A Daemon managing a single scope handles all
+// messages, and queues of unknown accounts belong to the session's own account.
+func (h *LambdaHandler) route(source string) *Daemon {
+	if len(h.daemon.scopes) == 0 {
+		return h.daemon
+	}
+	parts := strings.SplitN(source, ":", 6)
+	if len(parts) < 6 {
+		return nil
+	}
+	region, accountID := parts[3], parts[4]
+	var own *Daemon
+	for _, s := range h.daemon.scopes {
+		if s.scope.Region != region {
+			continue
+		}
+		if s.scope.Account == "" {
+			own = s
+		} else if h.daemon.config.account(s.scope.Account).id() == accountID {
+			return s
+		}
+	}
+	return own
+}
+
+// rediscover rediscovers ASGs if the last discovery is older than the
+// discoveryInterval, as warm Lambda containers may live for hours.
+func (h *LambdaHandler) rediscover(ctx context.Context) {
+	interval := h.daemon.config.DiscoveryInterval
+	if interval <= 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if time.Since(h.discovered) < interval {
+		return
+	}
+	for _, s := range h.daemon.scoped() {
+		added, err := s.discover(ctx)
+		if err != nil {
+			s.log.Error("failed to rediscover ASGs", zap.Error(err))
+			continue
+		}
+		for _, asg := range added {
+			s.log.Info(fmt.Sprintf("Managing tags for ASG %s", asg.asgName))
+		}
+	}
+	h.discovered = time.Now()
+}
@@ -0,0 +1,305 @@
+package tagd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"go.uber.org/zap"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	leaderBackendKubernetes = "kubernetes"
+	leaderBackendDynamoDB   = "dynamodb"
+
+	defaultLeaderName          = "tagd"
+	defaultLeaseDuration       = 15 * time.Second
+	defaultLeaderRetryInterval = 2 * time.Second
+)
+
+// LeaderElectionConfig enables leader election between replicas. Only the leader
+// runs the Daemon, the others stand by and take over when the leader's lease expires.
+type LeaderElectionConfig struct {
+	// Backend is kubernetes, for a coordination.k8s.io Lease, or dynamodb, for a
+	// lock item in a DynamoDB table. Leader election is disabled if empty.
+	Backend string `yaml:"backend,omitempty"`
+	// Name of the Lease or lock item, defaults to tagd.
+	Name string `yaml:"name,omitempty"`
+	// Namespace of the Lease, defaults to the POD_NAMESPACE environment variable or default.
+	Namespace string `yaml:"namespace,omitempty"`
+	// Table is the DynamoDB table, with a string partition key named LockID.
+	Table string `yaml:"table,omitempty"`
+	// Region and Endpoint of DynamoDB, e.g. DynamoDB Local, default to the session's.
+	Region   string `yaml:"region,omitempty"`
+	Endpoint string `yaml:"endpoint,omitempty"`
+	// Identity of this replica, defaults to the hostname and process ID.
+	Identity string `yaml:"identity,omitempty"`
+	// LeaseDuration is how long followers wait before taking over from a leader
+	// that stopped renewing its lease, defaults to 15 seconds.
+	LeaseDuration time.Duration `yaml:"leaseDuration,omitempty"`
+	// RetryInterval is how often the lease is renewed or followers try to acquire
+	// it, defaults to 2 seconds.
+	RetryInterval time.Duration `yaml:"retryInterval,omitempty"`
+}
+
+func (c *LeaderElectionConfig) validate() error {
+	switch c.Backend {
+	case "", leaderBackendKubernetes:
+	case leaderBackendDynamoDB:
+		if c.Table == "" {
+			return fmt.Errorf("leaderElection: table is required for the dynamodb backend")
+		}
+	default:
+		return fmt.Errorf("leaderElection: unknown backend %q", c.Backend)
+	}
+	if c.LeaseDuration < 0 || c.RetryInterval < 0 {
+		return fmt.Errorf("leaderElection: leaseDuration and retryInterval must not be negative")
+	}
+	if c.LeaseDuration > 0 && c.RetryInterval >= c.LeaseDuration {
+		return fmt.Errorf("leaderElection: retryInterval must be shorter than leaseDuration")
+	}
+	return nil
+}
+
+// leaderLock is a lease held by one replica at a time.
+type leaderLock interface {
+	// tryAcquire takes or renews the lease for leaseDuration if it is free, expired
+	// or already ours, and returns the identity of its holder.
+	tryAcquire(ctx context.Context, leaseDuration time.Duration) (string, error)
+	// release gives up the lease if we hold it.
+	release(ctx context.Context) error
+}
+
+// LeaderElector runs a function while this replica holds the leader lease.
+type LeaderElector struct {
+	lock          leaderLock
+	identity      string
+	leaseDuration time.Duration
+	retryInterval time.Duration
+	log           *zap.Logger
+}
+
+// newLeaderElector returns the configured LeaderElector, or nil if leader election is disabled.
+func newLeaderElector(config *Config, sess *session.Session, logger *zap.Logger) (*LeaderElector, error) {
+	conf := &config.LeaderElection
+	if conf.Backend == "" {
+		return nil, nil
+	}
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	e := &LeaderElector{
+		identity:      conf.Identity,
+		leaseDuration: conf.LeaseDuration,
+		retryInterval: conf.RetryInterval,
+		log:           logger,
+	}
+	if e.identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("leaderElection: failed to get hostname for the identity: %w", err)
+		}
+		e.identity = fmt.Sprintf("%s_%d", hostname, os.Getpid())
+	}
+	if e.leaseDuration == 0 {
+		e.leaseDuration = defaultLeaseDuration
+	}
+	if e.retryInterval == 0 {
+		e.retryInterval = defaultLeaderRetryInterval
+	}
+	name := conf.Name
+	if name == "" {
+		name = defaultLeaderName
+	}
+
+	switch conf.Backend {
+	case leaderBackendKubernetes:
+		kubeClient, err := NewKubernetesClient(config.Kubernetes.Kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create kubernetes client: %w", err)
+		}
+		namespace := conf.Namespace
+		if namespace == "" {
+			namespace = os.Getenv("POD_NAMESPACE")
+		}
+		if namespace == "" {
+			namespace = metav1.NamespaceDefault
+		}
+		e.lock = newLeaseLock(kubeClient, namespace, name, e.identity)
+	case leaderBackendDynamoDB:
+		cfg := &aws.Config{}
+		if conf.Region != "" {
+			cfg.Region = aws.String(conf.Region)
+		}
+		if conf.Endpoint != "" {
+			cfg.Endpoint = aws.String(conf.Endpoint)
+		}
+		e.lock = NewDynamoDBLock(dynamodb.New(sess, cfg), conf.Table, name, e.identity)
+	}
+	return e, nil
+}
+
+// Run campaigns for the lease and calls lead with a context that is cancelled
+// if the lease is lost. Once lead returns, the lease is released and Run
+// campaigns again, until ctx is cancelled or lead returns an error.
+func (e *LeaderElector) Run(ctx context.Context, lead func(ctx context.Context) error) error {
+	for {
+		e.log.Info(fmt.Sprintf("Waiting to become leader as %s", e.identity))
+		if !e.campaign(ctx) {
+			return nil
+		}
+		e.log.Info(fmt.Sprintf("Became leader as %s", e.identity))
+
+		leaderCtx, cancel := context.WithCancel(ctx)
+		renewed := make(chan struct{})
+		go func() {
+			defer close(renewed)
+			e.renew(leaderCtx, cancel)
+		}()
+		err := lead(leaderCtx)
+		cancel()
+		<-renewed
+
+		// Let a follower take over right away instead of after the lease expires
+		releaseCtx, releaseCancel := context.WithTimeout(context.Background(), e.retryInterval)
+		if rerr := e.lock.release(releaseCtx); rerr != nil {
+			e.log.Warn("Failed to release leader lease", zap.Error(rerr))
+		}
+		releaseCancel()
+
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		e.log.Warn("Lost leadership, standing by")
+	}
+}
+
+// campaign tries to acquire the lease every retry interval until it succeeds,
+// returning false if ctx is cancelled first.
+func (e *LeaderElector) campaign(ctx context.Context) bool {
+	ticker := time.NewTicker(e.retryInterval)
+	defer ticker.Stop()
+	leader := ""
+	for {
+		holder, err := e.lock.tryAcquire(ctx, e.leaseDuration)
+		switch {
+		case err != nil:
+			e.log.Debug("Failed to acquire leader lease", zap.Error(err))
+		case holder == e.identity:
+			return true
+		case holder != leader:
+			leader = holder
+			e.log.Info(fmt.Sprintf("Standing by, %s is the leader", holder))
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// renew renews the lease every retry interval and calls lost if it can't be
+// renewed before followers may consider it expired.
+func (e *LeaderElector) renew(ctx context.Context, lost func()) {
+	ticker := time.NewTicker(e.retryInterval)
+	defer ticker.Stop()
+	renewed := time.Now()
+	// Give up early enough to stop leading before anyone else starts
+	deadline := e.leaseDuration * 2 / 3
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		holder, err := e.lock.tryAcquire(ctx, e.leaseDuration)
+		switch {
+		case err == nil && holder == e.identity:
+			renewed = time.Now()
+			continue
+		case err != nil:
+			e.log.Warn("Failed to renew leader lease", zap.Error(err))
+		default:
+			e.log.Warn(fmt.Sprintf("Leader lease taken over by %s", holder))
+			lost()
+			return
+		}
+		if time.Since(renewed) > deadline {
+			lost()
+			return
+		}
+	}
+}
+
+// leaseLock is a leaderLock backed by a coordination.k8s.io Lease.
+type leaseLock struct {
+	lock     resourcelock.Interface
+	identity string
+}
+
+func newLeaseLock(kubeClient kubernetes.Interface, namespace, name, identity string) *leaseLock {
+	return &leaseLock{
+		lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Client:     kubeClient.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		identity: identity,
+	}
+}
+
+func (l *leaseLock) tryAcquire(ctx context.Context, leaseDuration time.Duration) (string, error) {
+	now := metav1.Now()
+	record := resourcelock.LeaderElectionRecord{
+		HolderIdentity:       l.identity,
+		LeaseDurationSeconds: int(leaseDuration / time.Second),
+		AcquireTime:          now,
+		RenewTime:            now,
+	}
+	current, _, err := l.lock.Get(ctx)
+	if apierrors.IsNotFound(err) {
+		return l.identity, l.lock.Create(ctx, record)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	expires := current.RenewTime.Add(time.Duration(current.LeaseDurationSeconds) * time.Second)
+	if current.HolderIdentity != "" && current.HolderIdentity != l.identity && now.Time.Before(expires) {
+		return current.HolderIdentity, nil
+	}
+	record.LeaderTransitions = current.LeaderTransitions
+	if current.HolderIdentity == l.identity {
+		record.AcquireTime = current.AcquireTime
+	} else {
+		record.LeaderTransitions++
+	}
+	// Update fails if another replica updated the Lease since Get
+	return l.identity, l.lock.Update(ctx, record)
+}
+
+func (l *leaseLock) release(ctx context.Context) error {
+	current, _, err := l.lock.Get(ctx)
+	if err != nil || current.HolderIdentity != l.identity {
+		return err
+	}
+	now := metav1.Now()
+	return l.lock.Update(ctx, resourcelock.LeaderElectionRecord{
+		LeaseDurationSeconds: 1,
+		AcquireTime:          now,
+		RenewTime:            now,
+		LeaderTransitions:    current.LeaderTransitions,
+	})
+}
@@ -0,0 +1,241 @@
+package tagd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ryanuber/go-glob"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	instanceIDIndex = "instanceID"
+
+	// Labels for instances whose node hasn't registered yet are kept this long.
+	pendingLabelsTTL = 30 * time.Minute
+
+	maxLabelNameLength = 63
+)
+
+// invalidLabelChars matches characters not allowed in label names and values.
+var invalidLabelChars = regexp.MustCompile(`[^-A-Za-z0-9_.]+`)
+
+// NodeLabelConfig configures writing instance tags back as Kubernetes node labels.
+type NodeLabelConfig struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+	// Tags are globs of tag keys to apply as labels.
+	Tags []string `yaml:"tags,omitempty"`
+	// Prefix is prepended to label names, e.g. "tagd.io/".
+	Prefix string `yaml:"prefix,omitempty"`
+	// Mapping maps tag keys to label keys, overriding the prefix and sanitizing.
+	Mapping map[string]string `yaml:"mapping,omitempty"`
+}
+
+// labelKey returns the label key for a tag key. Tag keys that aren't mapped are
+// sanitized into a valid label name and prefixed with the configured prefix.
+func (c *NodeLabelConfig) labelKey(tagKey string) string {
+	if k, ok := c.Mapping[tagKey]; ok {
+		return k
+	}
+	return c.Prefix + sanitizeLabel(tagKey)
+}
+
+// selects returns true if the tag key matches one of the configured globs.
+func (c *NodeLabelConfig) selects(tagKey string) bool {
+	for _, pattern := range c.Tags {
+		if glob.Glob(pattern, tagKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeLabel replaces invalid characters with dashes, trims the result to
+// 63 characters and makes sure it begins and ends with an alphanumeric character.
+func sanitizeLabel(s string) string {
+	s = invalidLabelChars.ReplaceAllString(s, "-")
+	if len(s) > maxLabelNameLength {
+		s = s[:maxLabelNameLength]
+	}
+	return strings.Trim(s, "-_.")
+}
+
+type pendingLabels struct {
+	labels map[string]string
+	added  time.Time
+}
+
+// NodeLabeler applies instance tags as labels on the Kubernetes node of the instance.
+type NodeLabeler struct {
+	config     *NodeLabelConfig
+	kubeClient kubernetes.Interface
+	log        *zap.Logger
+	mu         sync.Mutex
+	indexer    cache.Indexer
+	pending    map[string]pendingLabels
+	timeouts   TimeoutConfig
+}
+
+// NewNodeLabeler returns a new NodeLabeler.
+func NewNodeLabeler(config *NodeLabelConfig, kubeClient kubernetes.Interface, logger *zap.Logger) *NodeLabeler {
+	return &NodeLabeler{
+		config:     config,
+		kubeClient: kubeClient,
+		log:        logger,
+		pending:    make(map[string]pendingLabels),
+	}
+}
+
+// Run watches Nodes to look them up by instance ID until ctx is cancelled.
+// Labels for nodes that register after their instance was tagged are applied
+// when they appear, with work, which may outlive ctx.
+func (n *NodeLabeler) Run(ctx, work context.Context) error {
+	factory := informers.NewSharedInformerFactory(n.kubeClient, nodeResyncPeriod)
+	informer := factory.Core().V1().Nodes().Informer()
+	err := informer.AddIndexers(cache.Indexers{
+		instanceIDIndex: func(obj interface{}) ([]string, error) {
+			node, ok := obj.(*corev1.Node)
+			if !ok {
+				return nil, nil
+			}
+			if id := nodeInstanceID(node); id != "" {
+				return []string{id}, nil
+			}
+			return nil, nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			n.applyPending(work, obj)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			n.applyPending(work, obj)
+		},
+	})
+
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("failed to sync node informer")
+	}
+	n.mu.Lock()
+	n.indexer = informer.GetIndexer()
+	n.mu.Unlock()
+	<-ctx.Done()
+	return nil
+}
+
+// LabelNode applies the selected tags as labels on the node of instanceID. If the
+// node isn't known yet, the labels are applied once it registers.
+func (n *NodeLabeler) LabelNode(ctx context.Context, instanceID string, tags map[string]string) error {
+	labels := n.labels(tags)
+	if len(labels) == 0 {
+		return nil
+	}
+
+	n.mu.Lock()
+	var node *corev1.Node
+	if n.indexer != nil {
+		objs, err := n.indexer.ByIndex(instanceIDIndex, instanceID)
+		if err != nil {
+			n.mu.Unlock()
+			return err
+		}
+		if len(objs) > 0 {
+			node = objs[0].(*corev1.Node)
+		}
+	}
+	if node == nil {
+		n.log.Debug(fmt.Sprintf("No node for instance %s yet, labelling it once it registers", instanceID))
+		n.pending[instanceID] = pendingLabels{labels: labels, added: time.Now()}
+		n.mu.Unlock()
+		return nil
+	}
+	n.mu.Unlock()
+
+	return n.patchLabels(ctx, node, labels)
+}
+
+// labels returns the node labels for the selected tags, skipping tags that can't
+// be expressed as labels.
+func (n *NodeLabeler) labels(tags map[string]string) map[string]string {
+	labels := make(map[string]string)
+	for k, v := range tags {
+		if !n.config.selects(k) {
+			continue
+		}
+		key := n.config.labelKey(k)
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			n.log.Warn(fmt.Sprintf("Skipping tag %s, invalid label key %s", k, key), zap.Strings("errors", errs))
+			continue
+		}
+		value := sanitizeLabel(v)
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			n.log.Warn(fmt.Sprintf("Skipping tag %s, invalid label value %s", k, value), zap.Strings("errors", errs))
+			continue
+		}
+		labels[key] = value
+	}
+	return labels
+}
+
+// applyPending labels a node that registered after its instance was tagged.
+func (n *NodeLabeler) applyPending(ctx context.Context, obj interface{}) {
+	node, ok := obj.(*corev1.Node)
+	if !ok {
+		return
+	}
+	instanceID := nodeInstanceID(node)
+
+	n.mu.Lock()
+	p, ok := n.pending[instanceID]
+	delete(n.pending, instanceID)
+	for id, other := range n.pending {
+		if time.Since(other.added) > pendingLabelsTTL {
+			delete(n.pending, id)
+		}
+	}
+	n.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	if err := n.patchLabels(ctx, node, p.labels); err != nil {
+		n.log.Error(fmt.Sprintf("failed to label node %s", node.Name), zap.String("instance", instanceID), zap.Error(err))
+	}
+}
+
+// patchLabels merges labels into the node's labels, if any of them differ,
+// within the tag timeout.
+func (n *NodeLabeler) patchLabels(ctx context.Context, node *corev1.Node, labels map[string]string) error {
+	if containsTags(node.Labels, labels) {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": labels,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	n.log.Info(fmt.Sprintf("Labelling node %s", node.Name), zap.Any("labels", labels))
+	ctx, cancel := context.WithTimeout(ctx, n.timeouts.tag())
+	defer cancel()
+	_, err = n.kubeClient.CoreV1().Nodes().Patch(ctx, node.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
@@ -0,0 +1,90 @@
+package tagd
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSanitizeLabel(t *testing.T) {
+	tests := map[string]string{
+		"team":                   "team",
+		"cost center":            "cost-center",
+		"aws:cloudformation:foo": "aws-cloudformation-foo",
+		"-edge.":                 "edge",
+		"a/b=c":                  "a-b-c",
+	}
+	for in, want := range tests {
+		if got := sanitizeLabel(in); got != want {
+			t.Errorf("sanitizeLabel(%q) = %q, want %q", in, got, want)
+		}
+	}
+	long := sanitizeLabel(strings.Repeat("a", 100))
+	if len(long) != maxLabelNameLength {
+		t.Errorf("sanitizeLabel returned %d characters, want %d", len(long), maxLabelNameLength)
+	}
+}
+
+func runNodeLabeler(t *testing.T, ctx context.Context, n *NodeLabeler) {
+	go n.Run(ctx, ctx)
+	waitFor(t, "the node informer to sync", func() bool {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		return n.indexer != nil
+	})
+}
+
+func TestNodeLabelerLabelsNodes(t *testing.T) {
+	config := &NodeLabelConfig{
+		Enabled: true,
+		Tags:    []string{"team", "cost*"},
+		Prefix:  "tagd.io/",
+		Mapping: map[string]string{"env": "environment"},
+	}
+	kubeClient := fake.NewSimpleClientset(testNode("node-1", "i-1", map[string]string{"role": "worker"}))
+	n := NewNodeLabeler(config, kubeClient, zap.NewNop())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runNodeLabeler(t, ctx, n)
+
+	tags := map[string]string{"team": "data eng", "cost center": "42", "env": "prod", "Name": "node-1"}
+	if err := n.LabelNode(ctx, "i-1", tags); err != nil {
+		t.Fatal(err)
+	}
+	node, err := kubeClient.CoreV1().Nodes().Get(ctx, "node-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"role": "worker", "tagd.io/team": "data-eng", "tagd.io/cost-center": "42"}
+	if !containsTags(node.Labels, want) || len(node.Labels) != len(want) {
+		t.Errorf("node labels = %v, want %v", node.Labels, want)
+	}
+}
+
+func TestNodeLabelerLabelsLateNodes(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset()
+	n := NewNodeLabeler(&NodeLabelConfig{Enabled: true, Tags: []string{"team"}}, kubeClient, zap.NewNop())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runNodeLabeler(t, ctx, n)
+
+	if err := n.LabelNode(ctx, "i-2", map[string]string{"team": "infra"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kubeClient.CoreV1().Nodes().Create(ctx, testNode("node-2", "i-2", nil), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the late node to be labelled", func() bool {
+		node, err := kubeClient.CoreV1().Nodes().Get(ctx, "node-2", metav1.GetOptions{})
+		return err == nil && node.Labels["team"] == "infra"
+	})
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.pending) != 0 {
+		t.Errorf("pending labels left after the node registered: %v", n.pending)
+	}
+}
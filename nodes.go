@@ -0,0 +1,192 @@
+package tagd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	nodeResyncPeriod = 30 * time.Minute
+
+	// Nodes created more recently than this are handled like launch events.
+	nodeLaunchWindow = 10 * time.Minute
+)
+
+// nodeTagger pairs a TaggingConfig's node selector with the tagger that handles matching nodes.
+type nodeTagger struct {
+	selector labels.Selector
+	conf     *TaggingConfig
+	tagger   *AutoscalingTagger
+}
+
+// NodeWatcher is an event source that watches Kubernetes Nodes and runs the
+// handlers of every TaggingConfig whose NodeSelector matches the node.
+type NodeWatcher struct {
+	kubeClient kubernetes.Interface
+	taggers    []*nodeTagger
+	handlers   *drainGroup
+	timeouts   TimeoutConfig
+	log        *zap.Logger
+	mu         sync.Mutex
+	handled    map[types.UID]string
+}
+
+// NewNodeWatcher returns a new NodeWatcher for the TaggingConfigs with a NodeSelector.
+func NewNodeWatcher(config *Config, kubeClient kubernetes.Interface, asgClient AutoscalingClient, ec2Client EC2Client, logger *zap.Logger) (*NodeWatcher, error) {
+	w := &NodeWatcher{
+		kubeClient: kubeClient,
+		timeouts:   config.Timeouts,
+		log:        logger,
+		handled:    make(map[types.UID]string),
+	}
+	for i := range config.TaggingConfigs {
+		conf := &config.TaggingConfigs[i]
+		if conf.NodeSelector == "" {
+			continue
+		}
+		selector, err := labels.Parse(conf.NodeSelector)
+		if err != nil {
+			return nil, fmt.Errorf("tagConfig %s: invalid nodeSelector: %w", conf.ASGName, err)
+		}
+		w.taggers = append(w.taggers, &nodeTagger{
+			selector: selector,
+			conf:     conf,
+			tagger:   NewAutoscalingTagger(conf.ASGName, conf, nil, asgClient, ec2Client, logger),
+		})
+	}
+	return w, nil
+}
+
+// Run watches Nodes until ctx is cancelled. Nodes are handled with work, which
+// may outlive ctx.
+func (w *NodeWatcher) Run(ctx, work context.Context) error {
+	factory := informers.NewSharedInformerFactory(w.kubeClient, nodeResyncPeriod)
+	nodeInformer := factory.Core().V1().Nodes().Informer()
+	nodeInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			w.handle(work, obj)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			w.handle(work, obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if node, ok := obj.(*corev1.Node); ok {
+				w.mu.Lock()
+				delete(w.handled, node.UID)
+				w.mu.Unlock()
+			}
+		},
+	})
+
+	w.log.Info("Watching Nodes")
+	factory.Start(ctx.Done())
+	for informer, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return fmt.Errorf("failed to sync %s informer", informer)
+		}
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// handle runs the matching handlers for a node in the background, as waiting for
+// volumes to attach must not block the informer. Nodes aren't handled once the
+// handlers are draining.
+func (w *NodeWatcher) handle(work context.Context, obj interface{}) {
+	node, ok := obj.(*corev1.Node)
+	if !ok {
+		return
+	}
+	instanceID := nodeInstanceID(node)
+	if instanceID == "" {
+		return
+	}
+
+	// Only handle a node again if its labels changed
+	key := instanceID + "/" + labels.Set(node.Labels).String()
+	w.mu.Lock()
+	if w.handled[node.UID] == key {
+		w.mu.Unlock()
+		return
+	}
+	w.handled[node.UID] = key
+	w.mu.Unlock()
+
+	launch := time.Since(node.CreationTimestamp.Time) < nodeLaunchWindow
+	handling := w.handlers.goHandler(func() {
+		ctx, cancel := w.timeouts.eventContext(work)
+		defer cancel()
+		if err := w.HandleNode(ctx, node, launch); err != nil {
+			w.log.Error(fmt.Sprintf("failed to tag node %s", node.Name), zap.String("instance", instanceID), zap.Error(err))
+			w.forget(node.UID)
+		}
+	})
+	if !handling {
+		w.forget(node.UID)
+	}
+}
+
+// forget lets a node be handled again on its next update or resync.
+func (w *NodeWatcher) forget(uid types.UID) {
+	w.mu.Lock()
+	delete(w.handled, uid)
+	w.mu.Unlock()
+}
+
+// HandleNode runs the handlers of every TaggingConfig matching the node's labels
+// against its instance. If launch is true, it waits for volumes to attach.
+func (w *NodeWatcher) HandleNode(ctx context.Context, node *corev1.Node, launch bool) error {
+	instanceID := nodeInstanceID(node)
+	if instanceID == "" {
+		return fmt.Errorf("node %s has no EC2 providerID", node.Name)
+	}
+	nodeLabels := labels.Set(node.Labels)
+	for _, nt := range w.taggers {
+		if !nt.selector.Matches(nodeLabels) {
+			continue
+		}
+		w.log.Debug(fmt.Sprintf("Node %s matches selector %s", node.Name, nt.conf.NodeSelector), zap.String("instance", instanceID))
+
+		extraTags := make(map[string]string, len(nt.conf.NodeLabels))
+		for _, k := range nt.conf.NodeLabels {
+			if v, ok := node.Labels[k]; ok {
+				extraTags[k] = v
+			}
+		}
+		cause := CauseNode
+		if launch {
+			cause = CauseNodeLaunch
+		}
+		if err := nt.tagger.handle(ctx, instanceID, cause, extraTags); err != nil {
+			return err
+		}
+		if launch {
+			nt.tagger.scheduleRecheck(instanceID, extraTags)
+		}
+	}
+	return nil
+}
+
+// nodeInstanceID returns the EC2 instance ID from a node's providerID, which is
+// in the form aws:///us-west-2a/i-0123456789, or an empty string.
+func nodeInstanceID(node *corev1.Node) string {
+	if !strings.HasPrefix(node.Spec.ProviderID, "aws://") {
+		return ""
+	}
+	id := node.Spec.ProviderID[strings.LastIndex(node.Spec.ProviderID, "/")+1:]
+	if !strings.HasPrefix(id, "i-") {
+		return ""
+	}
+	return id
+}
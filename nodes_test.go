@@ -0,0 +1,152 @@
+package tagd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/leosunmo/tagd/tagdtest"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testNode(name, instanceID string, labels map[string]string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, UID: types.UID(name), Labels: labels},
+		Spec:       corev1.NodeSpec{ProviderID: "aws:///us-east-1a/" + instanceID},
+	}
+}
+
+func TestNodeInstanceID(t *testing.T) {
+	tests := map[string]string{
+		"aws:///us-east-1a/i-0123456789abcdef0": "i-0123456789abcdef0",
+		"aws://us-east-1a/i-0123":               "i-0123",
+		"aws:///us-east-1a/fargate-ip-10-0-0-1": "",
+		"gce://project/zone/instance":           "",
+		"":                                      "",
+	}
+	for providerID, want := range tests {
+		node := &corev1.Node{Spec: corev1.NodeSpec{ProviderID: providerID}}
+		if got := nodeInstanceID(node); got != want {
+			t.Errorf("nodeInstanceID(%q) = %q, want %q", providerID, got, want)
+		}
+	}
+}
+
+func TestNodeWatcherTagsMatchingNodes(t *testing.T) {
+	backend := tagdtest.NewBackend("", "")
+	worker, _ := backend.LaunchInstance("", tagdtest.InstanceSpec{})
+	infra, _ := backend.LaunchInstance("", tagdtest.InstanceSpec{})
+
+	config := &Config{
+		TaggingConfigs: []TaggingConfig{{
+			ASGName:      "workers",
+			NodeSelector: "role=worker",
+			NodeLabels:   []string{"role", "zone"},
+			Tags:         map[string]string{"owner": "tagd"},
+		}},
+	}
+	kubeClient := fake.NewSimpleClientset(
+		testNode("worker", worker, map[string]string{"role": "worker"}),
+		testNode("infra", infra, map[string]string{"role": "infra"}),
+	)
+	w, err := NewNodeWatcher(config, kubeClient, backend.Autoscaling(), backend.EC2(), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx, ctx)
+
+	workerVolume := backend.Volumes(worker)[0]
+	waitFor(t, "the worker's volume to be tagged", func() bool {
+		return containsTags(backend.Tags(workerVolume), map[string]string{"owner": "tagd", "role": "worker", MarkerTagInstance: worker})
+	})
+
+	// A label change tags the node's resources again
+	node := testNode("worker", worker, map[string]string{"role": "worker", "zone": "a"})
+	if _, err := kubeClient.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the worker's volume to be tagged with the new label", func() bool {
+		return backend.Tags(workerVolume)["zone"] == "a"
+	})
+
+	time.Sleep(50 * time.Millisecond)
+	if tags := backend.Tags(backend.Volumes(infra)[0]); len(tags) > 0 {
+		t.Errorf("volume of a node not matching the selector was tagged: %v", tags)
+	}
+}
+
+func TestNodeWatcherRetriesFailedNodes(t *testing.T) {
+	backend := tagdtest.NewBackend("", "")
+	id, _ := backend.LaunchInstance("", tagdtest.InstanceSpec{})
+	backend.InjectFault("CreateTags", tagdtest.Fault{Err: tagdtest.Error("RequestLimitExceeded", "Request limit exceeded."), Times: 1})
+
+	config := &Config{
+		TaggingConfigs: []TaggingConfig{{
+			ASGName:      "workers",
+			NodeSelector: "role=worker",
+			Tags:         map[string]string{"owner": "tagd"},
+		}},
+	}
+	kubeClient := fake.NewSimpleClientset(testNode("worker", id, map[string]string{"role": "worker"}))
+	w, err := NewNodeWatcher(config, kubeClient, backend.Autoscaling(), backend.EC2(), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx, ctx)
+
+	waitFor(t, "the failed CreateTags", func() bool { return backend.Calls("CreateTags") == 1 })
+	// The failed node is handled again on its next update, even if its labels are the same
+	waitFor(t, "the node to be forgotten", func() bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return len(w.handled) == 0
+	})
+	node := testNode("worker", id, map[string]string{"role": "worker"})
+	node.Annotations = map[string]string{"touched": "true"}
+	if _, err := kubeClient.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the volume to be tagged", func() bool {
+		return backend.Tags(backend.Volumes(id)[0])["owner"] == "tagd"
+	})
+}
+
+func TestNodeWatcherSkipsNodesWhileDraining(t *testing.T) {
+	backend := tagdtest.NewBackend("", "")
+	id, _ := backend.LaunchInstance("", tagdtest.InstanceSpec{})
+
+	config := &Config{
+		TaggingConfigs: []TaggingConfig{{
+			ASGName:      "workers",
+			NodeSelector: "role=worker",
+			Tags:         map[string]string{"owner": "tagd"},
+		}},
+	}
+	w, err := NewNodeWatcher(config, fake.NewSimpleClientset(), backend.Autoscaling(), backend.EC2(), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.handlers = &drainGroup{}
+	w.handlers.drain(context.Background())
+
+	node := testNode("worker", id, map[string]string{"role": "worker"})
+	w.handle(context.Background(), node)
+	time.Sleep(50 * time.Millisecond)
+	if calls := backend.Calls("CreateTags"); calls != 0 {
+		t.Errorf("CreateTags calls while draining = %d, want 0", calls)
+	}
+	// It's handled once the handlers accept new ones again
+	w.handlers.reset(context.Background())
+	w.handle(context.Background(), node)
+	waitFor(t, "the volume to be tagged", func() bool {
+		return backend.Tags(backend.Volumes(id)[0])["owner"] == "tagd"
+	})
+}
@@ -0,0 +1,402 @@
+package tagd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+)
+
+const (
+	// MarkerTagOrphanedSince records when tagd first saw a volume as orphaned.
+	// Retention is measured from this timestamp.
+	MarkerTagOrphanedSince = "tagd:orphaned-since"
+
+	errCodeInstanceNotFound = "InvalidInstanceID.NotFound"
+
+	// minOrphanRetention is the shortest retention deleting orphans is allowed
+	// with, so volumes only detached for a moment, e.g. while a node is
+	// replaced, are never removed.
+	minOrphanRetention = time.Hour
+)
+
+// kubernetesOwnerTags mark volumes owned by Kubernetes, e.g. PersistentVolumes
+// that are only detached while their pod moves. They are never orphans.
+var kubernetesOwnerTags = []string{
+	"kubernetes.io/created-for/pv/name",
+	"kubernetes.io/created-for/pvc/name",
+	"ebs.csi.aws.com/cluster",
+	"KubernetesCluster",
+}
+
+// OrphanConfig configures the orphaned volume report and cleanup.
+// Without Delete set, the cleanup only reports what it would do.
+type OrphanConfig struct {
+	Interval   time.Duration `yaml:"interval,omitempty"`
+	Retention  time.Duration `yaml:"retention,omitempty"`
+	Snapshot   bool          `yaml:"snapshot,omitempty"`
+	Delete     bool          `yaml:"delete,omitempty"`
+	ReportTags []string      `yaml:"reportTags,omitempty"`
+}
+
+func (c *OrphanConfig) validate() error {
+	if c.Interval < 0 || c.Retention < 0 {
+		return fmt.Errorf("orphans interval and retention must not be negative")
+	}
+	if c.Delete && c.Retention < minOrphanRetention {
+		return fmt.Errorf("orphans: delete requires a retention of at least %s", minOrphanRetention)
+	}
+	return nil
+}
+
+// OrphanAction describes what the cleanup did, or would do, with an orphan.
+type OrphanAction string
+
+const (
+	// OrphanActionNone means the volume is reported only.
+	OrphanActionNone OrphanAction = "none"
+	// OrphanActionMark means the volume was marked with MarkerTagOrphanedSince.
+	OrphanActionMark OrphanAction = "mark"
+	// OrphanActionRetain means the volume is still within its retention period.
+	OrphanActionRetain OrphanAction = "retain"
+	// OrphanActionDelete means the volume was deleted.
+	OrphanActionDelete OrphanAction = "delete"
+	// OrphanActionSnapshotDelete means the volume was snapshotted, then deleted.
+	OrphanActionSnapshotDelete OrphanAction = "snapshot-delete"
+)
+
+// Orphan is an available EBS volume managed by tagd whose instance no longer exists.
+type Orphan struct {
+	VolumeID         string
+	Size             int64
+	VolumeType       string
+	AvailabilityZone string
+	CreateTime       time.Time
+	OrphanedSince    time.Time
+	ASG              string
+	InstanceID       string
+	Tags             map[string]string
+	Action           OrphanAction
+	SnapshotID       string
+	DryRun           bool
+}
+
+// Age of the volume since it was created.
+func (o *Orphan) Age() time.Duration {
+	return time.Since(o.CreateTime)
+}
+
+// OrphanReaper finds, reports and optionally removes orphaned volumes.
+type OrphanReaper struct {
+	config    *Config
+	ec2Client EC2Client
+	audit     *Auditor
+	log       *zap.Logger
+}
+
+// NewOrphanReaper returns a new OrphanReaper for the TaggingConfigs in config.
+func NewOrphanReaper(config *Config, ec2Client EC2Client, logger *zap.Logger) *OrphanReaper {
+	return &OrphanReaper{
+		config:    config,
+		ec2Client: ec2Client,
+		log:       logger,
+	}
+}
+
+// SetAuditor records the orphan markers with a, which may be nil.
+func (r *OrphanReaper) SetAuditor(a *Auditor) {
+	r.audit = a
+}
+
+// Run finds all orphans and applies the cleanup policy to them.
+// Errors cleaning up individual volumes are logged and recorded as OrphanActionNone.
+func (r *OrphanReaper) Run(ctx context.Context) ([]*Orphan, error) {
+	// Flags may have changed the config after it was validated
+	if err := r.config.Orphans.validate(); err != nil {
+		return nil, err
+	}
+	orphans, err := r.FindOrphans(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range orphans {
+		if err := r.cleanupOrphan(ctx, o); err != nil {
+			r.log.Error(fmt.Sprintf("failed to clean up orphaned volume %s", o.VolumeID), zap.Error(err))
+			o.Action = OrphanActionNone
+		}
+	}
+	return orphans, nil
+}
+
+// FindOrphans returns available volumes carrying tagd marker tags or the tags of a
+// TaggingConfig whose instance no longer exists. Volumes without MarkerTagInstance,
+// e.g. tagged by an older tagd, are never orphans.
+func (r *OrphanReaper) FindOrphans(ctx context.Context) ([]*Orphan, error) {
+	input := &ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("status"),
+				Values: aws.StringSlice([]string{ec2.VolumeStateAvailable}),
+			},
+		},
+	}
+	var candidates []*Orphan
+	// Each page is bounded by the describe timeout, however many there are
+	for {
+		describeCtx, cancel := context.WithTimeout(ctx, r.config.Timeouts.describe())
+		page, err := r.ec2Client.DescribeVolumesWithContext(describeCtx, input)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, vol := range page.Volumes {
+			if o := r.candidate(vol); o != nil {
+				candidates = append(candidates, o)
+			}
+		}
+		if aws.StringValue(page.NextToken) == "" {
+			break
+		}
+		input.NextToken = page.NextToken
+	}
+
+	var orphans []*Orphan
+	for _, o := range candidates {
+		exists, err := r.instanceExists(ctx, o.InstanceID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up instance %s: %w", o.InstanceID, err)
+		}
+		if exists {
+			r.log.Debug(fmt.Sprintf("Volume %s is detached but instance %s still exists", o.VolumeID, o.InstanceID))
+			continue
+		}
+		orphans = append(orphans, o)
+	}
+	return orphans, nil
+}
+
+// candidate returns an Orphan if the volume is managed by tagd and not by
+// Kubernetes, otherwise nil.
+func (r *OrphanReaper) candidate(vol *ec2.Volume) *Orphan {
+	tags := ec2TagMap(vol.Tags)
+
+	asgName, managed := tags[MarkerTagASG]
+	if !managed {
+		for _, conf := range r.config.TaggingConfigs {
+			if matchesTags(conf.Tags, tags) {
+				asgName = conf.ASGName
+				managed = true
+				break
+			}
+		}
+	}
+	if !managed {
+		return nil
+	}
+	for _, k := range kubernetesOwnerTags {
+		if _, ok := tags[k]; ok {
+			r.log.Debug(fmt.Sprintf("Skipping volume %s owned by Kubernetes", aws.StringValue(vol.VolumeId)), zap.String("tag", k))
+			return nil
+		}
+	}
+	// Without the instance it was attached to, there's no telling whether it's gone
+	if tags[MarkerTagInstance] == "" {
+		r.log.Debug(fmt.Sprintf("Skipping volume %s without a %s tag", aws.StringValue(vol.VolumeId), MarkerTagInstance))
+		return nil
+	}
+
+	o := &Orphan{
+		VolumeID:         aws.StringValue(vol.VolumeId),
+		Size:             aws.Int64Value(vol.Size),
+		VolumeType:       aws.StringValue(vol.VolumeType),
+		AvailabilityZone: aws.StringValue(vol.AvailabilityZone),
+		CreateTime:       aws.TimeValue(vol.CreateTime),
+		ASG:              asgName,
+		InstanceID:       tags[MarkerTagInstance],
+		Tags:             tags,
+		Action:           OrphanActionNone,
+		DryRun:           !r.config.Orphans.Delete,
+	}
+	if since, ok := tags[MarkerTagOrphanedSince]; ok {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			r.log.Warn(fmt.Sprintf("Ignoring invalid %s tag on volume %s", MarkerTagOrphanedSince, o.VolumeID), zap.Error(err))
+		} else {
+			o.OrphanedSince = t
+		}
+	}
+	return o
+}
+
+// matchesTags returns true if want is not empty and every tag in it is present in have.
+func matchesTags(want, have map[string]string) bool {
+	return len(want) > 0 && containsTags(have, want)
+}
+
+func (r *OrphanReaper) instanceExists(ctx context.Context, instanceID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.config.Timeouts.describe())
+	defer cancel()
+	out, err := r.ec2Client.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: aws.StringSlice([]string{instanceID}),
+	})
+	if err != nil {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == errCodeInstanceNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, res := range out.Reservations {
+		for _, inst := range res.Instances {
+			if aws.StringValue(inst.State.Name) != ec2.InstanceStateNameTerminated {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// cleanupOrphan cleans up an orphan within the event timeout, which includes
+// waiting for its snapshot to complete.
+func (r *OrphanReaper) cleanupOrphan(ctx context.Context, o *Orphan) error {
+	ctx, cancel := r.config.Timeouts.eventContext(ctx)
+	defer cancel()
+	return r.cleanup(ctx, o)
+}
+
+// cleanup applies the retention policy to an orphan. Volumes are marked the first time
+// they are seen and removed once they have been orphaned for longer than the retention.
+// A dry run never marks, so it measures the retention of unmarked volumes from their
+// creation instead, the earliest they could have been orphaned.
+func (r *OrphanReaper) cleanup(ctx context.Context, o *Orphan) error {
+	conf := r.config.Orphans
+	now := time.Now()
+
+	since := o.OrphanedSince
+	if since.IsZero() {
+		if !o.DryRun {
+			o.Action = OrphanActionMark
+			o.OrphanedSince = now
+			tags := map[string]string{MarkerTagOrphanedSince: now.UTC().Format(time.RFC3339)}
+			rec := AuditRecord{ASG: o.ASG, Cause: CauseOrphan, Instance: o.InstanceID}
+			tagCtx, cancel := context.WithTimeout(ctx, r.config.Timeouts.tag())
+			defer cancel()
+			return r.audit.tagResources(tagCtx, r.ec2Client, rec, aws.StringSlice([]string{o.VolumeID}), tags, nil)
+		}
+		since = o.CreateTime
+		if since.IsZero() || now.Sub(since) < conf.Retention {
+			o.Action = OrphanActionMark
+			return nil
+		}
+	}
+
+	if now.Sub(since) < conf.Retention {
+		o.Action = OrphanActionRetain
+		return nil
+	}
+
+	o.Action = OrphanActionDelete
+	if conf.Snapshot {
+		o.Action = OrphanActionSnapshotDelete
+	}
+	if o.DryRun {
+		return nil
+	}
+
+	if conf.Snapshot {
+		snapshotID, err := r.snapshot(ctx, o)
+		if err != nil {
+			return fmt.Errorf("failed to snapshot volume: %w", err)
+		}
+		o.SnapshotID = snapshotID
+	}
+
+	r.log.Info(fmt.Sprintf("Deleting orphaned volume %s", o.VolumeID), zap.String("asg", o.ASG))
+	deleteCtx, cancel := context.WithTimeout(ctx, r.config.Timeouts.tag())
+	defer cancel()
+	_, err := r.ec2Client.DeleteVolumeWithContext(deleteCtx, &ec2.DeleteVolumeInput{
+		VolumeId: aws.String(o.VolumeID),
+	})
+	return err
+}
+
+// snapshot creates a snapshot of the orphan carrying its tags and waits for it to complete.
+func (r *OrphanReaper) snapshot(ctx context.Context, o *Orphan) (string, error) {
+	r.log.Info(fmt.Sprintf("Snapshotting orphaned volume %s", o.VolumeID), zap.String("asg", o.ASG))
+	tags := make(map[string]string, len(o.Tags))
+	for k, v := range o.Tags {
+		if checkTag(k, v) == nil {
+			tags[k] = v
+		}
+	}
+	delete(tags, MarkerTagOrphanedSince)
+
+	createCtx, cancel := context.WithTimeout(ctx, r.config.Timeouts.tag())
+	defer cancel()
+	snap, err := r.ec2Client.CreateSnapshotWithContext(createCtx, &ec2.CreateSnapshotInput{
+		VolumeId:    aws.String(o.VolumeID),
+		Description: aws.String(fmt.Sprintf("tagd: orphaned volume %s", o.VolumeID)),
+		TagSpecifications: []*ec2.TagSpecification{
+			{
+				ResourceType: aws.String(ec2.ResourceTypeSnapshot),
+				Tags:         toEC2Tags(tags),
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	// Waiting is bounded by the event timeout of the cleanup
+	err = r.ec2Client.WaitUntilSnapshotCompletedWithContext(ctx, &ec2.DescribeSnapshotsInput{
+		SnapshotIds: []*string{snap.SnapshotId},
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(snap.SnapshotId), nil
+}
+
+// LogOrphans writes a report line for each orphan to the log.
+func (r *OrphanReaper) LogOrphans(orphans []*Orphan) {
+	for _, o := range orphans {
+		fields := []zap.Field{
+			zap.String("volume", o.VolumeID),
+			zap.Int64("sizeGiB", o.Size),
+			zap.String("type", o.VolumeType),
+			zap.Duration("age", o.Age()),
+			zap.String("asg", o.ASG),
+			zap.String("instance", o.InstanceID),
+			zap.String("action", string(o.Action)),
+			zap.Bool("dryRun", o.DryRun),
+		}
+		for _, k := range r.config.Orphans.ReportTags {
+			fields = append(fields, zap.String("tag:"+k, o.Tags[k]))
+		}
+		r.log.Info("Orphaned volume", fields...)
+	}
+}
+
+// runOrphanReaper periodically runs the reaper with the work context until ctx is cancelled.
+func (d *Daemon) runOrphanReaper(ctx, work context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		d.log.Debug("Looking for orphaned volumes")
+		orphans, err := d.orphans.Run(work)
+		if err != nil {
+			d.log.Error("failed to process orphaned volumes", zap.Error(err))
+		}
+		d.orphans.LogOrphans(orphans)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
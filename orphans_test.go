@@ -0,0 +1,71 @@
+package tagd
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leosunmo/tagd/tagdtest"
+	"go.uber.org/zap"
+)
+
+func TestOrphanConfigRequiresRetentionToDelete(t *testing.T) {
+	for _, retention := range []time.Duration{0, time.Minute} {
+		conf := OrphanConfig{Delete: true, Retention: retention}
+		if err := conf.validate(); err == nil || !strings.Contains(err.Error(), "retention") {
+			t.Errorf("validate() with retention %s error = %v, want a retention error", retention, err)
+		}
+	}
+	if err := (&OrphanConfig{Retention: 0}).validate(); err != nil {
+		t.Errorf("validate() of a dry run error = %v", err)
+	}
+	if err := (&OrphanConfig{Delete: true, Retention: minOrphanRetention}).validate(); err != nil {
+		t.Errorf("validate() error = %v", err)
+	}
+}
+
+func TestOrphanReaperNeverDeletesKubernetesVolumes(t *testing.T) {
+	backend := tagdtest.NewBackend("", "")
+	markers := func(extra map[string]string) map[string]string {
+		tags := map[string]string{
+			MarkerTagASG:           "web",
+			MarkerTagInstance:      "i-0123456789abcdef0",
+			MarkerTagOrphanedSince: time.Now().Add(-48 * time.Hour).UTC().Format(time.RFC3339),
+		}
+		for k, v := range extra {
+			tags[k] = v
+		}
+		return tags
+	}
+	orphan := backend.CreateVolume(tagdtest.VolumeSpec{Tags: markers(nil)})
+	var pvs []string
+	for _, k := range kubernetesOwnerTags {
+		pvs = append(pvs, backend.CreateVolume(tagdtest.VolumeSpec{Tags: markers(map[string]string{k: "x"})}))
+	}
+
+	config := &Config{Orphans: OrphanConfig{Retention: 24 * time.Hour, Delete: true}}
+	orphans, err := NewOrphanReaper(config, backend.EC2(), zap.NewNop()).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 || orphans[0].VolumeID != orphan || orphans[0].Action != OrphanActionDelete {
+		t.Errorf("Run() = %v, want only %s deleted", orphans, orphan)
+	}
+	if backend.VolumeExists(orphan) {
+		t.Errorf("orphan %s wasn't deleted", orphan)
+	}
+	for _, vol := range pvs {
+		if !backend.VolumeExists(vol) {
+			t.Errorf("Kubernetes volume %s was deleted", vol)
+		}
+	}
+}
+
+func TestOrphanReaperRejectsDeletingWithoutRetention(t *testing.T) {
+	backend := tagdtest.NewBackend("", "")
+	config := &Config{Orphans: OrphanConfig{Delete: true}}
+	if _, err := NewOrphanReaper(config, backend.EC2(), zap.NewNop()).Run(context.Background()); err == nil {
+		t.Error("Run() deleting without a retention succeeded")
+	}
+}
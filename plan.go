@@ -0,0 +1,130 @@
+package tagd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Change is a tag update tagd would make to a resource.
+type Change struct {
+	Scope    Scope
+	ASG      string
+	Resource string
+	// Tags are the tags that would be added or changed.
+	Tags map[string]string
+	// Previous holds the current values of the changed tags that already exist.
+	Previous map[string]string
+}
+
+// planner records the tags a tagger would write instead of writing them.
+type planner struct {
+	mu      sync.Mutex
+	changes []*Change
+}
+
+// record compares tags with the current tags of each resource and records the differences.
+func (p *planner) record(ctx context.Context, l *AutoscalingTagger, resourceIDs []*string, tags map[string]string) error {
+	current, err := describeResourceTags(ctx, l.ec2Client, resourceIDs)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, id := range aws.StringValueSlice(resourceIDs) {
+		change := &Change{
+			ASG:      l.asgName,
+			Resource: id,
+			Tags:     make(map[string]string),
+			Previous: make(map[string]string),
+		}
+		for k, v := range tags {
+			old, exists := current[id][k]
+			if exists && old == v {
+				continue
+			}
+			change.Tags[k] = v
+			if exists {
+				change.Previous[k] = old
+			}
+		}
+		if len(change.Tags) > 0 {
+			p.changes = append(p.changes, change)
+		}
+	}
+	return nil
+}
+
+// planning returns a copy of the tagger that records changes in p instead of making them.
+func (l *AutoscalingTagger) planning(p *planner) *AutoscalingTagger {
+	tagger := NewAutoscalingTagger(l.asgName, l.tags, l.queue, l.autoscaling, l.ec2Client, l.log)
+	tagger.planner = p
+	tagger.timeouts = l.timeouts
+	l.mu.Lock()
+	tagger.asgTags = l.asgTags
+	l.mu.Unlock()
+	return tagger
+}
+
+// Plan returns the tag changes Apply would make, without making them.
+func (d *Daemon) Plan(ctx context.Context) ([]*Change, error) {
+	var changes []*Change
+	for _, s := range d.scoped() {
+		p := &planner{}
+		if err := s.plan(ctx, p); err != nil {
+			if len(d.scopes) > 0 {
+				return nil, fmt.Errorf("%s: %w", s.scope, err)
+			}
+			return nil, err
+		}
+		for _, c := range p.changes {
+			c.Scope = s.scope
+		}
+		changes = append(changes, p.changes...)
+	}
+	return changes, nil
+}
+
+func (d *Daemon) plan(ctx context.Context, p *planner) error {
+	for _, asg := range d.taggers() {
+		tagger := asg.planning(p)
+		instances, err := tagger.instances(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to look up instances for ASG %s: %w", asg.asgName, err)
+		}
+		for _, instance := range instances {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := tagger.Handle(ctx, instance); err != nil {
+				return fmt.Errorf("failed to plan instance %s of ASG %s: %w", instance, asg.asgName, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Apply tags the existing resources of every managed ASG once, like Backfill does
+// on startup, including instances the dedupe store has seen. It returns an error
+// if any ASG could not be tagged completely.
+func (d *Daemon) Apply(ctx context.Context) error {
+	var failed []string
+	for _, s := range d.scoped() {
+		for _, asg := range s.taggers() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := s.backfill(ctx, asg, false); err != nil {
+				failed = append(failed, asg.asgName)
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to tag ASGs %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package tagd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	ebsCSIDriver = "ebs.csi.aws.com"
+
+	pvcResyncPeriod = 30 * time.Minute
+
+	// Sources that can be renamed with PVCConfig.TagMapping. Labels and
+	// annotations are mapped with "label:<key>" and "annotation:<key>".
+	pvcSourceCluster   = "cluster"
+	pvcSourceNamespace = "namespace"
+	pvcSourcePVC       = "pvc"
+	pvcSourcePV        = "pv"
+)
+
+// defaultPVCTagMapping matches the tags the in-tree EBS provisioner adds.
+var defaultPVCTagMapping = map[string]string{
+	pvcSourceCluster:   "KubernetesCluster",
+	pvcSourceNamespace: "kubernetes.io/created-for/pvc/namespace",
+	pvcSourcePVC:       "kubernetes.io/created-for/pvc/name",
+	pvcSourcePV:        "kubernetes.io/created-for/pv/name",
+}
+
+// PVCConfig configures tagging EBS volumes backing Kubernetes PersistentVolumes.
+type PVCConfig struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+	// Labels and Annotations of the PVC to copy to the volume.
+	Labels      []string `yaml:"labels,omitempty"`
+	Annotations []string `yaml:"annotations,omitempty"`
+	// TagMapping maps a source (cluster, namespace, pvc, pv, label:<key> or
+	// annotation:<key>) to the tag key it is written to. An empty tag key drops it.
+	TagMapping map[string]string `yaml:"tagMapping,omitempty"`
+	// Tags are added to every volume as is.
+	Tags map[string]string `yaml:"tags,omitempty"`
+}
+
+// tagKey returns the tag key a source is written to.
+func (c *PVCConfig) tagKey(source, fallback string) string {
+	if k, ok := c.TagMapping[source]; ok {
+		return k
+	}
+	if k, ok := defaultPVCTagMapping[source]; ok {
+		return k
+	}
+	return fallback
+}
+
+// PVCTagger watches PersistentVolumes backed by EBS and tags the underlying
+// volumes with the metadata of their PersistentVolumeClaims.
+type PVCTagger struct {
+	config     *KubernetesConfig
+	kubeClient kubernetes.Interface
+	ec2Client  EC2Client
+	pvcLister  corelisters.PersistentVolumeClaimLister
+	audit      *Auditor
+	timeouts   TimeoutConfig
+	log        *zap.Logger
+	mu         sync.Mutex
+	tagged     map[types.UID]map[string]string
+}
+
+// NewPVCTagger returns a new PVCTagger.
+func NewPVCTagger(config *KubernetesConfig, kubeClient kubernetes.Interface, ec2Client EC2Client, logger *zap.Logger) *PVCTagger {
+	return &PVCTagger{
+		config:     config,
+		kubeClient: kubeClient,
+		ec2Client:  ec2Client,
+		log:        logger,
+		tagged:     make(map[types.UID]map[string]string),
+	}
+}
+
+// Run watches PersistentVolumes until ctx is cancelled. Volumes are tagged with
+// work, which may outlive ctx.
+func (p *PVCTagger) Run(ctx, work context.Context) error {
+	factory := informers.NewSharedInformerFactory(p.kubeClient, pvcResyncPeriod)
+	pvInformer := factory.Core().V1().PersistentVolumes().Informer()
+	pvcInformer := factory.Core().V1().PersistentVolumeClaims()
+	p.pvcLister = pvcInformer.Lister()
+
+	pvInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			p.handle(work, obj)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			p.handle(work, obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if pv, ok := obj.(*corev1.PersistentVolume); ok {
+				p.mu.Lock()
+				delete(p.tagged, pv.UID)
+				p.mu.Unlock()
+			}
+		},
+	})
+	// Register the PVC informer before starting the factory
+	pvcInformer.Informer()
+
+	p.log.Info("Watching PersistentVolumes")
+	factory.Start(ctx.Done())
+	for informer, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return fmt.Errorf("failed to sync %s informer", informer)
+		}
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func (p *PVCTagger) handle(work context.Context, obj interface{}) {
+	pv, ok := obj.(*corev1.PersistentVolume)
+	if !ok {
+		return
+	}
+	ctx, cancel := p.timeouts.eventContext(work)
+	defer cancel()
+	if err := p.HandlePersistentVolume(ctx, pv); err != nil {
+		p.log.Error(fmt.Sprintf("failed to tag volume of PersistentVolume %s", pv.Name), zap.Error(err))
+	}
+}
+
+// HandlePersistentVolume tags the EBS volume backing pv, if it is bound to a claim
+// and the tags changed since it was last tagged.
+func (p *PVCTagger) HandlePersistentVolume(ctx context.Context, pv *corev1.PersistentVolume) error {
+	volumeID := ebsVolumeID(pv)
+	if volumeID == "" || pv.Spec.ClaimRef == nil || pv.Status.Phase != corev1.VolumeBound {
+		return nil
+	}
+
+	var pvc *corev1.PersistentVolumeClaim
+	if p.pvcLister != nil {
+		claim, err := p.pvcLister.PersistentVolumeClaims(pv.Spec.ClaimRef.Namespace).Get(pv.Spec.ClaimRef.Name)
+		if err == nil {
+			pvc = claim
+		}
+	}
+	if pvc == nil {
+		claim, err := p.kubeClient.CoreV1().PersistentVolumeClaims(pv.Spec.ClaimRef.Namespace).
+			Get(ctx, pv.Spec.ClaimRef.Name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get PersistentVolumeClaim %s/%s: %w", pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name, err)
+		}
+		pvc = claim
+	}
+
+	tags := p.buildTags(pv, pvc)
+
+	p.mu.Lock()
+	previous := p.tagged[pv.UID]
+	p.mu.Unlock()
+	if previous != nil && containsTags(previous, tags) {
+		return nil
+	}
+
+	p.log.Info(fmt.Sprintf("Tagging volume %s of PersistentVolumeClaim %s/%s", volumeID, pvc.Namespace, pvc.Name))
+	set := NewTagSet()
+	for k, v := range tags {
+		rank := rankCopied
+		if _, static := p.config.PVC.Tags[k]; static {
+			rank = rankStatic
+		}
+		set.Set(k, v, rank)
+	}
+	describeCtx, cancel := context.WithTimeout(ctx, p.timeouts.describe())
+	current, err := describeResourceTags(describeCtx, p.ec2Client, aws.StringSlice([]string{volumeID}))
+	cancel()
+	if err != nil {
+		return fmt.Errorf("failed to look up tags of volume %s: %w", volumeID, err)
+	}
+	if violations := set.Normalize(MaxTags, current); len(violations) > 0 {
+		p.log.Warn(fmt.Sprintf("Dropped %d tag(s) for volume %s", len(violations), volumeID),
+			zap.Strings("violations", violationStrings(violations)))
+	}
+	rec := AuditRecord{Cause: CausePVC}
+	tagCtx, cancel := context.WithTimeout(ctx, p.timeouts.tag())
+	defer cancel()
+	if err := p.audit.tagResources(tagCtx, p.ec2Client, rec, aws.StringSlice([]string{volumeID}), set.Map(), current); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.tagged[pv.UID] = tags
+	p.mu.Unlock()
+	return nil
+}
+
+// buildTags returns the tags for the volume backing pv, applying the tag mapping.
+func (p *PVCTagger) buildTags(pv *corev1.PersistentVolume, pvc *corev1.PersistentVolumeClaim) map[string]string {
+	conf := &p.config.PVC
+	tags := make(map[string]string)
+	set := func(source, fallback, value string) {
+		if k := conf.tagKey(source, fallback); k != "" && value != "" {
+			tags[k] = value
+		}
+	}
+
+	for k, v := range conf.Tags {
+		tags[k] = v
+	}
+	set(pvcSourceCluster, "", p.config.ClusterName)
+	set(pvcSourceNamespace, "", pvc.Namespace)
+	set(pvcSourcePVC, "", pvc.Name)
+	set(pvcSourcePV, "", pv.Name)
+	for _, k := range conf.Labels {
+		set("label:"+k, k, pvc.Labels[k])
+	}
+	for _, k := range conf.Annotations {
+		set("annotation:"+k, k, pvc.Annotations[k])
+	}
+	return tags
+}
+
+// ebsVolumeID returns the EBS volume ID backing an in-tree or CSI PersistentVolume,
+// or an empty string if it isn't backed by EBS.
+func ebsVolumeID(pv *corev1.PersistentVolume) string {
+	switch {
+	case pv.Spec.AWSElasticBlockStore != nil:
+		// In-tree volume IDs may be in the form aws://us-west-2a/vol-0123456789
+		id := pv.Spec.AWSElasticBlockStore.VolumeID
+		return id[strings.LastIndex(id, "/")+1:]
+	case pv.Spec.CSI != nil && pv.Spec.CSI.Driver == ebsCSIDriver:
+		return pv.Spec.CSI.VolumeHandle
+	}
+	return ""
+}
@@ -0,0 +1,194 @@
+package tagd
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/leosunmo/tagd/tagdtest"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testPVC(namespace, name string, labels, annotations map[string]string) *corev1.PersistentVolumeClaim {
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels, Annotations: annotations},
+	}
+}
+
+func testPV(name string, source corev1.PersistentVolumeSource, claim *corev1.PersistentVolumeClaim) *corev1.PersistentVolume {
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name, UID: types.UID(name)},
+		Spec:       corev1.PersistentVolumeSpec{PersistentVolumeSource: source},
+		Status:     corev1.PersistentVolumeStatus{Phase: corev1.VolumeAvailable},
+	}
+	if claim != nil {
+		pv.Spec.ClaimRef = &corev1.ObjectReference{Namespace: claim.Namespace, Name: claim.Name}
+		pv.Status.Phase = corev1.VolumeBound
+	}
+	return pv
+}
+
+func csiSource(volumeID string) corev1.PersistentVolumeSource {
+	return corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{Driver: ebsCSIDriver, VolumeHandle: volumeID}}
+}
+
+func TestEBSVolumeID(t *testing.T) {
+	tests := []struct {
+		source corev1.PersistentVolumeSource
+		want   string
+	}{
+		{corev1.PersistentVolumeSource{AWSElasticBlockStore: &corev1.AWSElasticBlockStoreVolumeSource{VolumeID: "aws://us-east-1a/vol-1"}}, "vol-1"},
+		{corev1.PersistentVolumeSource{AWSElasticBlockStore: &corev1.AWSElasticBlockStoreVolumeSource{VolumeID: "vol-2"}}, "vol-2"},
+		{csiSource("vol-3"), "vol-3"},
+		{corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{Driver: "efs.csi.aws.com", VolumeHandle: "fs-1"}}, ""},
+		{corev1.PersistentVolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/data"}}, ""},
+	}
+	for i, tt := range tests {
+		if got := ebsVolumeID(testPV("pv", tt.source, nil)); got != tt.want {
+			t.Errorf("%d: ebsVolumeID() = %q, want %q", i, got, tt.want)
+		}
+	}
+}
+
+func TestPVCTaggerBuildTags(t *testing.T) {
+	p := &PVCTagger{config: &KubernetesConfig{
+		ClusterName: "prod",
+		PVC: PVCConfig{
+			Labels:      []string{"app", "missing"},
+			Annotations: []string{"owner"},
+			TagMapping:  map[string]string{"annotation:owner": "Owner", "pv": ""},
+			Tags:        map[string]string{"managed-by": "tagd"},
+		},
+	}}
+	pvc := testPVC("default", "data", map[string]string{"app": "db", "tier": "backend"}, map[string]string{"owner": "team-a"})
+	got := p.buildTags(testPV("pv-data", csiSource("vol-1"), pvc), pvc)
+	want := map[string]string{
+		"managed-by":        "tagd",
+		"KubernetesCluster": "prod",
+		"kubernetes.io/created-for/pvc/namespace": "default",
+		"kubernetes.io/created-for/pvc/name":      "data",
+		"app":                                     "db",
+		"Owner":                                   "team-a",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("buildTags() = %v, want %v", got, want)
+	}
+}
+
+func TestPVCTaggerPropagatesLabelsAndAnnotations(t *testing.T) {
+	backend := tagdtest.NewBackend("", "")
+	csiVolume := backend.CreateVolume(tagdtest.VolumeSpec{})
+	inTreeVolume := backend.CreateVolume(tagdtest.VolumeSpec{})
+	unboundVolume := backend.CreateVolume(tagdtest.VolumeSpec{})
+
+	config := &KubernetesConfig{
+		ClusterName: "prod",
+		PVC: PVCConfig{
+			Enabled:     true,
+			Labels:      []string{"app"},
+			Annotations: []string{"owner"},
+			TagMapping:  map[string]string{"annotation:owner": "Owner", "pv": ""},
+			Tags:        map[string]string{"managed-by": "tagd"},
+		},
+	}
+	data := testPVC("default", "data", map[string]string{"app": "db", "tier": "backend"}, map[string]string{"owner": "team-a"})
+	logs := testPVC("monitoring", "logs", nil, nil)
+	inTree := corev1.PersistentVolumeSource{AWSElasticBlockStore: &corev1.AWSElasticBlockStoreVolumeSource{VolumeID: "aws://us-east-1a/" + inTreeVolume}}
+	kubeClient := fake.NewSimpleClientset(
+		data, logs,
+		testPV("pv-data", csiSource(csiVolume), data),
+		testPV("pv-logs", inTree, logs),
+		testPV("pv-unbound", csiSource(unboundVolume), nil),
+	)
+	p := NewPVCTagger(config, kubeClient, backend.EC2(), zap.NewNop())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx, ctx)
+
+	waitFor(t, "the CSI volume to be tagged", func() bool {
+		return containsTags(backend.Tags(csiVolume), map[string]string{
+			"managed-by":        "tagd",
+			"KubernetesCluster": "prod",
+			"kubernetes.io/created-for/pvc/namespace": "default",
+			"kubernetes.io/created-for/pvc/name":      "data",
+			"app":                                     "db",
+			"Owner":                                   "team-a",
+		})
+	})
+	waitFor(t, "the in-tree volume to be tagged", func() bool {
+		return backend.Tags(inTreeVolume)["kubernetes.io/created-for/pvc/namespace"] == "monitoring"
+	})
+	tags := backend.Tags(csiVolume)
+	for _, k := range []string{"kubernetes.io/created-for/pv/name", "tier", "owner"} {
+		if _, ok := tags[k]; ok {
+			t.Errorf("unexpected tag %s on the CSI volume: %v", k, tags)
+		}
+	}
+
+	// A relabelled claim is tagged again the next time its volume is handled
+	data = testPVC("default", "data", map[string]string{"app": "postgres"}, map[string]string{"owner": "team-a"})
+	if _, err := kubeClient.CoreV1().PersistentVolumeClaims("default").Update(ctx, data, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the claim to be updated in the lister", func() bool {
+		claim, err := p.pvcLister.PersistentVolumeClaims("default").Get("data")
+		return err == nil && claim.Labels["app"] == "postgres"
+	})
+	pv := testPV("pv-data", csiSource(csiVolume), data)
+	pv.Annotations = map[string]string{"touched": "true"}
+	if _, err := kubeClient.CoreV1().PersistentVolumes().Update(ctx, pv, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the CSI volume to be tagged with the new label", func() bool {
+		return backend.Tags(csiVolume)["app"] == "postgres"
+	})
+
+	time.Sleep(50 * time.Millisecond)
+	if tags := backend.Tags(unboundVolume); len(tags) > 0 {
+		t.Errorf("volume of an unbound PersistentVolume was tagged: %v", tags)
+	}
+}
+
+func TestPVCTaggerSkipsUnchangedTags(t *testing.T) {
+	backend := tagdtest.NewBackend("", "")
+	volumeID := backend.CreateVolume(tagdtest.VolumeSpec{})
+	claim := testPVC("default", "data", nil, nil)
+	pv := testPV("pv-data", csiSource(volumeID), claim)
+	kubeClient := fake.NewSimpleClientset(claim)
+	p := NewPVCTagger(&KubernetesConfig{PVC: PVCConfig{Enabled: true}}, kubeClient, backend.EC2(), zap.NewNop())
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := p.HandlePersistentVolume(ctx, pv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls := backend.Calls("CreateTags"); calls != 1 {
+		t.Errorf("CreateTags was called %d times, want 1", calls)
+	}
+	if got := backend.Tags(volumeID)["kubernetes.io/created-for/pvc/name"]; got != "data" {
+		t.Errorf("pvc name tag = %q, want data", got)
+	}
+}
+
+func TestPVCTaggerStopsTaggingWithWork(t *testing.T) {
+	backend := tagdtest.NewBackend("", "")
+	volume := backend.CreateVolume(tagdtest.VolumeSpec{})
+	config := &KubernetesConfig{PVC: PVCConfig{Enabled: true, Tags: map[string]string{"managed-by": "tagd"}}}
+	data := testPVC("default", "data", nil, nil)
+	pv := testPV("pv-data", csiSource(volume), data)
+	p := NewPVCTagger(config, fake.NewSimpleClientset(data, pv), backend.EC2(), zap.NewNop())
+
+	// Informer events after the grace period aren't handled anymore
+	work, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.handle(work, pv)
+	if calls := backend.Calls("CreateTags"); calls != 0 {
+		t.Errorf("CreateTags calls after work was cancelled = %d, want 0", calls)
+	}
+}
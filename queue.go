@@ -6,6 +6,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -19,6 +20,19 @@ import (
 
 const (
 	longPollingWaitTimeSeconds = 20
+	// messageVisibilityTimeout hides a received message from other receivers. It's
+	// extended while the message is handled, however long that takes.
+	messageVisibilityTimeout = 30 * time.Second
+	// sqsCallTimeout bounds the SQS calls made outside of an event.
+	sqsCallTimeout = 10 * time.Second
+	// maxMessageAttempts is how many times handling a message may fail before
+	// it's dropped, retrying after 1, 2, 4 and 8 seconds.
+	maxMessageAttempts = 5
+	// failureTTL is how long the failed attempts at a message are remembered.
+	failureTTL = time.Hour
+	// maxInFlightMessages bounds the messages handled at once, as handling a
+	// launch may wait minutes for its volumes to attach.
+	maxInFlightMessages = 10
 )
 
 // SQSClient for testing purposes
@@ -49,13 +63,13 @@ func NewQueue(queueName, topicArn string, sqsClient SQSClient, snsClient SNSClie
 	}
 	// Only check for SNS topic existance if we want tagd to manage it
 	if topicArn != "" {
-		snsCtx, snsCancel := context.WithTimeout(context.Background(), 10*time.Second)
+		snsCtx, snsCancel := context.WithTimeout(context.Background(), sqsCallTimeout)
 		defer snsCancel()
 		if err := queue.TopicExists(snsCtx); err != nil {
 			return nil, err
 		}
 	}
-	sqsCtx, sqsCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	sqsCtx, sqsCancel := context.WithTimeout(context.Background(), sqsCallTimeout)
 	defer sqsCancel()
 	qURL, err := queue.QueueExists(sqsCtx)
 	if err != nil {
@@ -150,7 +164,7 @@ func (q *Queue) GetMessages(ctx context.Context) ([]*sqs.Message, error) {
 		QueueUrl:            aws.String(q.url),
 		MaxNumberOfMessages: aws.Int64(1),
 		WaitTimeSeconds:     aws.Int64(longPollingWaitTimeSeconds),
-		VisibilityTimeout:   aws.Int64(0),
+		VisibilityTimeout:   aws.Int64(int64(messageVisibilityTimeout / time.Second)),
 	})
 	if err != nil {
 		// Ignore error if the context was cancelled (i.e. we are shutting down)
@@ -176,3 +190,68 @@ func (q *Queue) DeleteMessage(ctx context.Context, receiptHandle string) error {
 	}
 	return nil
 }
+
+// ChangeMessageVisibility hides a received message from the queue for timeout,
+// counting from now. A timeout of zero makes it visible again right away.
+func (q *Queue) ChangeMessageVisibility(ctx context.Context, receiptHandle string, timeout time.Duration) error {
+	_, err := q.sqsClient.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(q.url),
+		ReceiptHandle:     aws.String(receiptHandle),
+		VisibilityTimeout: aws.Int64(int64(timeout / time.Second)),
+	})
+	if err != nil {
+		if e, ok := err.(awserr.Error); ok && e.Code() == request.CanceledErrorCode {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// messageFailures counts the failed attempts at handling each message by ID. SQS'
+// ApproximateReceiveCount can't be used, as it also counts the receives of
+// replicas that left the message for the ASG's owner.
+type messageFailures struct {
+	mu     sync.Mutex
+	counts map[string]messageFailure
+}
+
+type messageFailure struct {
+	count int
+	last  time.Time
+}
+
+// add counts a failed attempt at handling the message id, returning the number
+// of attempts that failed so far. Messages that didn't fail for failureTTL are
+// forgotten, e.g. when another replica handled them.
+func (f *messageFailures) add(id string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if f.counts == nil {
+		f.counts = make(map[string]messageFailure)
+	}
+	for other, failure := range f.counts {
+		if now.Sub(failure.last) > failureTTL {
+			delete(f.counts, other)
+		}
+	}
+	failure := f.counts[id]
+	failure.count++
+	failure.last = now
+	f.counts[id] = failure
+	return failure.count
+}
+
+// clear forgets the failed attempts at handling the message id.
+func (f *messageFailures) clear(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.counts, id)
+}
+
+// retryDelay returns how long a message that failed on its attempt-th attempt is
+// hidden before it's retried, doubling from a second.
+func retryDelay(attempt int) time.Duration {
+	return time.Second << uint(attempt-1)
+}
@@ -0,0 +1,129 @@
+package tagd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+)
+
+// ResourceKind selects a kind of resource belonging to an instance to tag.
+type ResourceKind string
+
+const (
+	// ResourceInstance is the instance itself, for tags the ASG doesn't propagate.
+	ResourceInstance ResourceKind = "instance"
+	// ResourceVolumes are the EBS volumes attached to the instance.
+	ResourceVolumes ResourceKind = "volumes"
+	// ResourceNetworkInterfaces are the ENIs attached to the instance, including secondary ones.
+	ResourceNetworkInterfaces ResourceKind = "networkInterfaces"
+	// ResourceElasticIPs are the Elastic IPs associated with the instance.
+	ResourceElasticIPs ResourceKind = "elasticIPs"
+)
+
+// DefaultResources are tagged when a TaggingConfig doesn't list any.
+var DefaultResources = []ResourceKind{ResourceVolumes}
+
+// resources returns the configured resource kinds, or DefaultResources if unset.
+func (c *TaggingConfig) resources() []ResourceKind {
+	if len(c.Resources) == 0 {
+		return DefaultResources
+	}
+	return c.Resources
+}
+
+// tagsResource returns true if the TaggingConfig tags resources of kind.
+func (c *TaggingConfig) tagsResource(kind ResourceKind) bool {
+	for _, k := range c.resources() {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (k ResourceKind) valid() bool {
+	switch k {
+	case ResourceInstance, ResourceVolumes, ResourceNetworkInterfaces, ResourceElasticIPs:
+		return true
+	}
+	return false
+}
+
+// tagInstance tags the instance itself.
+func (l *AutoscalingTagger) tagInstance(ctx context.Context, cause Cause, instanceID string, tags map[string]string) error {
+	l.log.Info(fmt.Sprintf("Tagging instance %s", instanceID), zap.String("asg", l.asgName))
+	return l.tag(ctx, cause, instanceID, aws.StringSlice([]string{instanceID}), tags)
+}
+
+// tagNetworkInterfaces tags all network interfaces attached to the instance.
+func (l *AutoscalingTagger) tagNetworkInterfaces(ctx context.Context, cause Cause, instanceID string, tags map[string]string) error {
+	l.log.Info(fmt.Sprintf("Tagging network interfaces attached to instance %s", instanceID), zap.String("asg", l.asgName))
+	describeCtx, cancel := context.WithTimeout(ctx, l.timeouts.describe())
+	defer cancel()
+	out, err := l.ec2Client.DescribeNetworkInterfacesWithContext(describeCtx, &ec2.DescribeNetworkInterfacesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("attachment.instance-id"),
+				Values: aws.StringSlice([]string{instanceID}),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if len(out.NetworkInterfaces) == 0 {
+		l.log.Debug(fmt.Sprintf("No network interfaces found on instance %s", instanceID))
+		return nil
+	}
+
+	var eniIDs []*string
+	for _, eni := range out.NetworkInterfaces {
+		l.log.Debug(fmt.Sprintf("Found network interface %s", aws.StringValue(eni.NetworkInterfaceId)))
+		eniIDs = append(eniIDs, eni.NetworkInterfaceId)
+	}
+	if err := l.tag(ctx, cause, instanceID, eniIDs, tags); err != nil {
+		return err
+	}
+	l.log.Debug(fmt.Sprintf("Tagged %d network interface(s) attached to %s", len(eniIDs), instanceID))
+	return nil
+}
+
+// tagElasticIPs tags all Elastic IPs associated with the instance.
+func (l *AutoscalingTagger) tagElasticIPs(ctx context.Context, cause Cause, instanceID string, tags map[string]string) error {
+	l.log.Info(fmt.Sprintf("Tagging Elastic IPs associated with instance %s", instanceID), zap.String("asg", l.asgName))
+	describeCtx, cancel := context.WithTimeout(ctx, l.timeouts.describe())
+	defer cancel()
+	out, err := l.ec2Client.DescribeAddressesWithContext(describeCtx, &ec2.DescribeAddressesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("instance-id"),
+				Values: aws.StringSlice([]string{instanceID}),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	var allocationIDs []*string
+	for _, addr := range out.Addresses {
+		// Only VPC addresses have an allocation ID that can be tagged
+		if addr.AllocationId == nil {
+			continue
+		}
+		l.log.Debug(fmt.Sprintf("Found Elastic IP %s", aws.StringValue(addr.PublicIp)))
+		allocationIDs = append(allocationIDs, addr.AllocationId)
+	}
+	if len(allocationIDs) == 0 {
+		l.log.Debug(fmt.Sprintf("No Elastic IPs found on instance %s", instanceID))
+		return nil
+	}
+	if err := l.tag(ctx, cause, instanceID, allocationIDs, tags); err != nil {
+		return err
+	}
+	l.log.Debug(fmt.Sprintf("Tagged %d Elastic IP(s) associated with %s", len(allocationIDs), instanceID))
+	return nil
+}
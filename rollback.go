@@ -0,0 +1,230 @@
+package tagd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+)
+
+// Revert restores the tags of a resource to their values before the rolled
+// back changes.
+type Revert struct {
+	Scope    Scope
+	Resource string
+	// Tags to restore to their previous values.
+	Tags map[string]string
+	// Delete are keys that didn't exist before the changes.
+	Delete []string
+	// Current holds the values of the restored and deleted keys now.
+	Current map[string]string
+	// Conflicts are keys changed since the rolled back changes, which are left
+	// alone unless forced, with their current values, empty if deleted.
+	Conflicts map[string]string
+}
+
+// SelectChanges returns the entries made at or after since, or with one of ids if
+// any are given, oldest first.
+func SelectChanges(entries []*JournalEntry, since time.Time, ids []string) []*JournalEntry {
+	var selected []*JournalEntry
+	for _, e := range entries {
+		if len(ids) > 0 {
+			if containsString(ids, e.ID) {
+				selected = append(selected, e)
+			}
+		} else if !e.Time.Before(since) {
+			selected = append(selected, e)
+		}
+	}
+	return selected
+}
+
+// Rollback reverts the changes of journal entries. Reverting changes is itself
+// recorded by the auditor, so a rollback can be rolled back too.
+type Rollback struct {
+	scopes  []Scope
+	clients map[string]EC2Client
+	auditor *Auditor
+	log     *zap.Logger
+}
+
+// NewRollback returns a Rollback for changes in scopes, recording its own changes
+// with auditor, which may be nil.
+func NewRollback(scopes []Scope, auditor *Auditor, logger *zap.Logger) *Rollback {
+	return &Rollback{
+		scopes:  scopes,
+		clients: make(map[string]EC2Client),
+		auditor: auditor,
+		log:     logger,
+	}
+}
+
+// client returns the EC2 client of a Scope.
+func (r *Rollback) client(s Scope) EC2Client {
+	svc, ok := r.clients[s.String()]
+	if !ok {
+		svc = ec2.New(s.Session)
+		r.clients[s.String()] = svc
+	}
+	return svc
+}
+
+// rollbackTarget is the value a key is restored to and the value the rolled back
+// changes left it at.
+type rollbackTarget struct {
+	previous string
+	existed  bool
+	changed  string
+	deleted  bool
+}
+
+// Plan returns the Reverts undoing entries, sorted by scope and resource. A key
+// changed several times is restored to its value before the oldest change. Keys
+// whose value is no longer the one the newest change wrote are conflicts, and are
+// only reverted if force is set.
+func (r *Rollback) Plan(ctx context.Context, entries []*JournalEntry, force bool) ([]*Revert, error) {
+	type resourceKey struct {
+		scope    string
+		resource string
+	}
+	targets := make(map[resourceKey]map[string]*rollbackTarget)
+	scopes := make(map[resourceKey]Scope)
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		s, ok := r.scope(e.Account, e.Region)
+		if !ok {
+			return nil, fmt.Errorf("change %s is in %s, which is not managed", e.ID, Scope{Account: e.Account, Region: e.Region})
+		}
+		for _, id := range e.Resources {
+			key := resourceKey{s.String(), id}
+			scopes[key] = s
+			if targets[key] == nil {
+				targets[key] = make(map[string]*rollbackTarget)
+			}
+			for k, v := range e.Tags {
+				t := targets[key][k]
+				if t == nil {
+					// The newest change decides what the key should be now
+					t = &rollbackTarget{changed: v, deleted: e.Action == AuditDeleteTags}
+					targets[key][k] = t
+				}
+				t.previous, t.existed = e.Previous[id][k]
+			}
+		}
+	}
+
+	// Look up the current tags of each scope's resources
+	byScope := make(map[string][]*string)
+	for key := range targets {
+		byScope[key.scope] = append(byScope[key.scope], aws.String(key.resource))
+	}
+	current := make(map[resourceKey]map[string]string)
+	for scope, ids := range byScope {
+		svc := r.client(scopes[resourceKey{scope, aws.StringValue(ids[0])}])
+		for len(ids) > 0 {
+			n := len(ids)
+			if n > maxFilterValues {
+				n = maxFilterValues
+			}
+			tags, err := describeResourceTags(ctx, svc, ids[:n])
+			if err != nil {
+				return nil, fmt.Errorf("%s: failed to look up current tags: %w", scope, err)
+			}
+			for id, t := range tags {
+				current[resourceKey{scope, id}] = t
+			}
+			ids = ids[n:]
+		}
+	}
+
+	var reverts []*Revert
+	for key, keyTargets := range targets {
+		rev := &Revert{
+			Scope:     scopes[key],
+			Resource:  key.resource,
+			Tags:      make(map[string]string),
+			Current:   make(map[string]string),
+			Conflicts: make(map[string]string),
+		}
+		for k, t := range keyTargets {
+			now, exists := current[key][k]
+			if exists == t.existed && (!exists || now == t.previous) {
+				// Already restored
+				continue
+			}
+			unchanged := exists != t.deleted && (!exists || now == t.changed)
+			if !unchanged && !force {
+				rev.Conflicts[k] = now
+				continue
+			}
+			if exists {
+				rev.Current[k] = now
+			}
+			if t.existed {
+				rev.Tags[k] = t.previous
+			} else {
+				rev.Delete = append(rev.Delete, k)
+			}
+		}
+		sort.Strings(rev.Delete)
+		if len(rev.Tags) > 0 || len(rev.Delete) > 0 || len(rev.Conflicts) > 0 {
+			reverts = append(reverts, rev)
+		}
+	}
+	sort.Slice(reverts, func(i, j int) bool {
+		if a, b := reverts[i].Scope.String(), reverts[j].Scope.String(); a != b {
+			return a < b
+		}
+		return reverts[i].Resource < reverts[j].Resource
+	})
+	return reverts, nil
+}
+
+// Apply restores the tags of each Revert, skipping conflicts. It continues past
+// resources that fail and returns an error with the number that did.
+func (r *Rollback) Apply(ctx context.Context, reverts []*Revert) error {
+	failed := 0
+	for _, rev := range reverts {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		svc := r.client(rev.Scope)
+		auditor := r.auditor.ForScope(rev.Scope)
+		rec := AuditRecord{Cause: CauseRollback}
+		ids := aws.StringSlice([]string{rev.Resource})
+
+		var err error
+		if len(rev.Tags) > 0 {
+			err = auditor.tagResources(ctx, svc, rec, ids, rev.Tags, nil)
+		}
+		if err == nil && len(rev.Delete) > 0 {
+			keys := make(map[string]string, len(rev.Delete))
+			for _, k := range rev.Delete {
+				keys[k] = ""
+			}
+			err = auditor.deleteTags(ctx, svc, rec, ids, keys)
+		}
+		if err != nil {
+			r.log.Error(fmt.Sprintf("Failed to roll back tags of %s", rev.Resource), zap.Stringer("scope", rev.Scope), zap.Error(err))
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to roll back %d of %d resources", failed, len(reverts))
+	}
+	return nil
+}
+
+// scope returns the Scope of the account and region of a journal entry.
+func (r *Rollback) scope(account, region string) (Scope, bool) {
+	for _, s := range r.scopes {
+		if s.Account == account && s.Region == region {
+			return s, true
+		}
+	}
+	return Scope{}, false
+}
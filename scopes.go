@@ -0,0 +1,197 @@
+package tagd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// Scope is an account and region managed by tagd, with a session for it.
+type Scope struct {
+	// Account is the name of an AccountConfig, or empty for the session's own account.
+	Account string
+	Region  string
+	Session *session.Session
+}
+
+func (s Scope) String() string {
+	if s.Account == "" {
+		return s.Region
+	}
+	return s.Account + "/" + s.Region
+}
+
+// Scopes returns a Scope for every region of the session's own account and of
+// every configured account. Sessions for other accounts assume the account's
+// role, refreshing the credentials before they expire.
+func (c *Config) Scopes(sess *session.Session) []Scope {
+	regions := c.RegionList(aws.StringValue(sess.Config.Region))
+	accounts := []*AccountConfig{nil}
+	for i := range c.Accounts {
+		accounts = append(accounts, &c.Accounts[i])
+	}
+
+	var scopes []Scope
+	for _, account := range accounts {
+		accountSess, name := sess, ""
+		if account != nil {
+			accountSess = sess.Copy(&aws.Config{Credentials: account.credentials(sess)})
+			name = account.Name
+		}
+		for _, region := range regions {
+			regionSess := accountSess
+			if region != "" {
+				regionSess = accountSess.Copy(&aws.Config{Region: aws.String(region)})
+			}
+			scopes = append(scopes, Scope{Account: name, Region: region, Session: regionSess})
+		}
+	}
+	return scopes
+}
+
+// RegionList returns the configured Regions, or home if none are configured.
+func (c *Config) RegionList(home string) []string {
+	if len(c.Regions) == 0 {
+		return []string{home}
+	}
+	return c.Regions
+}
+
+// kubernetesRegion returns the region the Kubernetes handlers run in, which is
+// assumed to be our own, or the first configured region if ours isn't managed.
+func (c *Config) kubernetesRegion(home string) string {
+	regions := c.RegionList(home)
+	if containsString(regions, home) {
+		return home
+	}
+	return regions[0]
+}
+
+// inRegion returns true if the TaggingConfig applies to region.
+func (c *TaggingConfig) inRegion(region string) bool {
+	return len(c.Regions) == 0 || containsString(c.Regions, region)
+}
+
+// inScope returns true if the TaggingConfig applies to the Scope.
+func (c *TaggingConfig) inScope(s Scope) bool {
+	return c.Account == s.Account && c.inRegion(s.Region)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// forScope returns a copy of the config for the Daemon of a Scope, with the
+// TaggingConfigs of the scope's account applying to its region, its queue name,
+// and the SNS topic in its account and region. Without kubernetes, the Kubernetes
+// handlers and node selectors are left out.
+func (c *Config) forScope(s Scope, kubernetes bool) *Config {
+	rc := *c
+	rc.Regions = []string{s.Region}
+	rc.TaggingConfigs = nil
+	for _, conf := range c.TaggingConfigs {
+		if !conf.inScope(s) {
+			continue
+		}
+		if !kubernetes {
+			if conf.ASGName == "" {
+				continue
+			}
+			conf.NodeSelector = ""
+		}
+		rc.TaggingConfigs = append(rc.TaggingConfigs, conf)
+	}
+	if !kubernetes {
+		rc.Kubernetes = KubernetesConfig{}
+	}
+	if name, ok := c.QueueNames[s.String()]; ok {
+		rc.SQSQueueName = name
+	}
+	rc.SNSTopicARN = scopedARN(c.SNSTopicARN, s.Region, c.account(s.Account).id())
+	return &rc
+}
+
+// validateQueueNames checks that every key of QueueNames is a region, or an
+// account/region of a configured account, and every name is set.
+func (c *Config) validateQueueNames() error {
+	for key, name := range c.QueueNames {
+		account, region := "", key
+		if i := strings.Index(key, "/"); i >= 0 {
+			account, region = key[:i], key[i+1:]
+			if c.account(account) == nil {
+				return fmt.Errorf("queueNames: unknown account %s in %q", account, key)
+			}
+		}
+		if region == "" || (len(c.Regions) > 0 && !containsString(c.Regions, region)) {
+			return fmt.Errorf("queueNames: %q is not a managed region", key)
+		}
+		if name == "" {
+			return fmt.Errorf("queueNames: empty queue name for %q", key)
+		}
+	}
+	return nil
+}
+
+// scopedARN returns arn with its region and account ID replaced, if not empty,
+// e.g. the same SNS topic in another account or region.
+func scopedARN(arn, region, accountID string) string {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) < 6 {
+		return arn
+	}
+	if region != "" && parts[3] != "" {
+		parts[3] = region
+	}
+	if accountID != "" {
+		parts[4] = accountID
+	}
+	return strings.Join(parts, ":")
+}
+
+// scoped returns the Daemons of each Scope, which is d itself unless it manages several.
+func (d *Daemon) scoped() []*Daemon {
+	if len(d.scopes) > 0 {
+		return d.scopes
+	}
+	return []*Daemon{d}
+}
+
+// Scope returns the account and region of a Daemon managing a single Scope.
+func (d *Daemon) Scope() Scope {
+	return d.scope
+}
+
+// startScopes starts the Daemons of each Scope and waits for them to stop. If
+// one fails, the others are stopped too.
+func (d *Daemon) startScopes(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(d.scopes))
+	for _, s := range d.scopes {
+		go func(s *Daemon) {
+			err := s.start(ctx)
+			if err != nil {
+				err = fmt.Errorf("%s: %w", s.scope, err)
+			}
+			errs <- err
+		}(s)
+	}
+
+	var first error
+	for range d.scopes {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+			cancel()
+		}
+	}
+	return first
+}
@@ -0,0 +1,77 @@
+package tagd
+
+import "testing"
+
+func TestForScope(t *testing.T) {
+	config := &Config{
+		SQSQueueName: "tagd",
+		SNSTopicARN:  "arn:aws:sns:us-west-2:000000000000:tagd",
+		Regions:      []string{"us-west-2", "eu-west-1"},
+		Accounts:     []AccountConfig{{Name: "prod", RoleARN: "arn:aws:iam::111111111111:role/tagd"}},
+		QueueNames:   map[string]string{"eu-west-1": "tagd-eu", "prod/us-west-2": "tagd-prod"},
+		TaggingConfigs: []TaggingConfig{
+			{ASGName: "web"},
+			{ASGName: "eu-*", Regions: []string{"eu-west-1"}},
+			{ASGName: "prod-*", Account: "prod"},
+			{NodeSelector: "role=worker"},
+		},
+	}
+	tests := []struct {
+		scope      Scope
+		kubernetes bool
+		queue      string
+		topic      string
+		asgs       []string
+	}{
+		{Scope{Region: "us-west-2"}, true, "tagd", "arn:aws:sns:us-west-2:000000000000:tagd", []string{"web", ""}},
+		{Scope{Region: "eu-west-1"}, false, "tagd-eu", "arn:aws:sns:eu-west-1:000000000000:tagd", []string{"web", "eu-*"}},
+		{Scope{Account: "prod", Region: "us-west-2"}, false, "tagd-prod", "arn:aws:sns:us-west-2:111111111111:tagd", []string{"prod-*"}},
+		{Scope{Account: "prod", Region: "eu-west-1"}, false, "tagd", "arn:aws:sns:eu-west-1:111111111111:tagd", []string{"prod-*"}},
+	}
+	for _, tt := range tests {
+		rc := config.forScope(tt.scope, tt.kubernetes)
+		if rc.SQSQueueName != tt.queue {
+			t.Errorf("%s: queue = %s, want %s", tt.scope, rc.SQSQueueName, tt.queue)
+		}
+		if rc.SNSTopicARN != tt.topic {
+			t.Errorf("%s: topic = %s, want %s", tt.scope, rc.SNSTopicARN, tt.topic)
+		}
+		var asgs []string
+		for _, conf := range rc.TaggingConfigs {
+			asgs = append(asgs, conf.ASGName)
+		}
+		if len(asgs) != len(tt.asgs) {
+			t.Errorf("%s: tagConfigs = %q, want %q", tt.scope, asgs, tt.asgs)
+			continue
+		}
+		for i := range asgs {
+			if asgs[i] != tt.asgs[i] {
+				t.Errorf("%s: tagConfigs = %q, want %q", tt.scope, asgs, tt.asgs)
+				break
+			}
+		}
+	}
+}
+
+func TestValidateQueueNames(t *testing.T) {
+	tests := []struct {
+		queueNames map[string]string
+		ok         bool
+	}{
+		{map[string]string{"eu-west-1": "tagd-eu", "prod/us-west-2": "tagd-prod"}, true},
+		{map[string]string{"ap-southeast-2": "tagd-ap"}, false},
+		{map[string]string{"staging/us-west-2": "tagd"}, false},
+		{map[string]string{"prod/": "tagd"}, false},
+		{map[string]string{"us-west-2": ""}, false},
+	}
+	for _, tt := range tests {
+		config := &Config{
+			Regions:    []string{"us-west-2", "eu-west-1"},
+			Accounts:   []AccountConfig{{Name: "prod", RoleARN: "arn:aws:iam::111111111111:role/tagd"}},
+			QueueNames: tt.queueNames,
+		}
+		if err := config.validateQueueNames(); (err == nil) != tt.ok {
+			t.Errorf("validateQueueNames(%v) = %v, want ok %t", tt.queueNames, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package tagd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	defaultShardingRefreshInterval = 30 * time.Second
+	defaultShardingVirtualNodes    = 100
+	// notOwnedVisibilityTimeout hides messages left for another replica, so
+	// replicas not owning their ASG don't hot-loop on them.
+	notOwnedVisibilityTimeout = 2 * time.Second
+)
+
+// errNotOwned is returned by handlers for events of a managed ASG owned by
+// another replica. Such messages are left on the queue for the owner.
+var errNotOwned = errors.New("ASG is owned by another replica")
+
+var errShardingWithLeader = errors.New("sharding and leaderElection are mutually exclusive, every replica runs with sharding")
+
+// ShardingConfig partitions the managed ASGs between replicas by consistent
+// hashing, so each replica only handles the events and backfill of its own ASGs.
+type ShardingConfig struct {
+	// Peers is a static list of the identities of all replicas.
+	Peers []string `yaml:"peers,omitempty"`
+	// Endpoints is the name of a Kubernetes Endpoints, usually of a headless Service
+	// selecting the tagd pods. Its ready pods are the replicas.
+	Endpoints string `yaml:"endpoints,omitempty"`
+	// Namespace of the Endpoints, defaults to the POD_NAMESPACE environment variable or default.
+	Namespace string `yaml:"namespace,omitempty"`
+	// Identity of this replica in Peers or the Endpoints, defaults to the POD_NAME
+	// environment variable or the hostname.
+	Identity string `yaml:"identity,omitempty"`
+	// RefreshInterval is how often the Endpoints are checked for replicas joining
+	// or leaving, defaults to 30 seconds.
+	RefreshInterval time.Duration `yaml:"refreshInterval,omitempty"`
+	// VirtualNodes is the number of points of each replica on the hash ring,
+	// defaults to 100. More spread the ASGs more evenly.
+	VirtualNodes int `yaml:"virtualNodes,omitempty"`
+}
+
+func (c *ShardingConfig) enabled() bool {
+	return len(c.Peers) > 0 || c.Endpoints != ""
+}
+
+func (c *ShardingConfig) validate() error {
+	if len(c.Peers) > 0 && c.Endpoints != "" {
+		return fmt.Errorf("sharding: peers and endpoints are mutually exclusive")
+	}
+	if c.RefreshInterval < 0 || c.VirtualNodes < 0 {
+		return fmt.Errorf("sharding: refreshInterval and virtualNodes must not be negative")
+	}
+	return nil
+}
+
+// hashRing assigns keys to members by consistent hashing, so only about 1/n of
+// the keys move when a member joins or leaves.
+type hashRing struct {
+	points  []uint64
+	members map[uint64]string
+}
+
+func newHashRing(members []string, virtualNodes int) *hashRing {
+	r := &hashRing{members: make(map[uint64]string, len(members)*virtualNodes)}
+	for _, m := range members {
+		for i := 0; i < virtualNodes; i++ {
+			p := hashKey(m + "#" + strconv.Itoa(i))
+			r.points = append(r.points, p)
+			r.members[p] = m
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// owner returns the member owning key, or an empty string if the ring is empty.
+func (r *hashRing) owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.members[r.points[i]]
+}
+
+// hashKey hashes key with SHA-256, as FNV clusters the points of similar member
+// names and spreads the ASGs unevenly.
+func hashKey(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Sharder decides which ASGs this replica owns, following the membership of
+// the replicas. A nil Sharder owns every ASG.
+type Sharder struct {
+	identity        string
+	virtualNodes    int
+	refreshInterval time.Duration
+	// members lists the replicas, nil for a static list of peers
+	members func(ctx context.Context) ([]string, error)
+	log     *zap.Logger
+
+	mu          sync.RWMutex
+	ring        *hashRing
+	current     []string
+	subscribers []chan struct{}
+}
+
+// newSharder returns the configured Sharder, or nil if sharding is disabled.
+func newSharder(config *Config, logger *zap.Logger) (*Sharder, error) {
+	conf := &config.Sharding
+	if !conf.enabled() {
+		return nil, nil
+	}
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	if config.LeaderElection.Backend != "" {
+		return nil, errShardingWithLeader
+	}
+	s := &Sharder{
+		identity:        conf.Identity,
+		virtualNodes:    conf.VirtualNodes,
+		refreshInterval: conf.RefreshInterval,
+		log:             logger,
+	}
+	if s.identity == "" {
+		s.identity = os.Getenv("POD_NAME")
+	}
+	if s.identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("sharding: failed to get hostname for the identity: %w", err)
+		}
+		s.identity = hostname
+	}
+	if s.virtualNodes == 0 {
+		s.virtualNodes = defaultShardingVirtualNodes
+	}
+	if s.refreshInterval == 0 {
+		s.refreshInterval = defaultShardingRefreshInterval
+	}
+
+	if conf.Endpoints != "" {
+		kubeClient, err := NewKubernetesClient(config.Kubernetes.Kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create kubernetes client: %w", err)
+		}
+		namespace := conf.Namespace
+		if namespace == "" {
+			namespace = os.Getenv("POD_NAMESPACE")
+		}
+		if namespace == "" {
+			namespace = metav1.NamespaceDefault
+		}
+		s.members = endpointsMembers(kubeClient, namespace, conf.Endpoints)
+	} else if !containsString(conf.Peers, s.identity) {
+		return nil, fmt.Errorf("sharding: identity %s is not one of the peers", s.identity)
+	}
+
+	// Start with a ring, so the ASGs owned at startup are backfilled
+	members := conf.Peers
+	if s.members != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		var err error
+		if members, err = s.members(ctx); err != nil {
+			return nil, fmt.Errorf("sharding: failed to list replicas: %w", err)
+		}
+	}
+	s.update(members)
+	return s, nil
+}
+
+// Owns returns true if this replica handles asgName of the Scope.
+func (s *Sharder) Owns(scope Scope, asgName string) bool {
+	if s == nil {
+		return true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ring.owner(scope.String()+"/"+asgName) == s.identity
+}
+
+// subscribe returns a channel notified whenever the replicas change.
+func (s *Sharder) subscribe() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := make(chan struct{}, 1)
+	s.subscribers = append(s.subscribers, ch)
+	return ch
+}
+
+// Run refreshes the replicas every refresh interval until ctx is cancelled.
+// A static list of peers never changes.
+func (s *Sharder) Run(ctx context.Context) {
+	if s.members == nil {
+		return
+	}
+	ticker := time.NewTicker(s.refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		members, err := s.members(ctx)
+		if err != nil {
+			// Keep the current ring rather than dropping every ASG
+			s.log.Warn("Failed to list replicas for sharding", zap.Error(err))
+			continue
+		}
+		s.update(members)
+	}
+}
+
+// update rebuilds the ring if the replicas changed and notifies the subscribers.
+func (s *Sharder) update(members []string) {
+	members = append([]string(nil), members...)
+	sort.Strings(members)
+
+	s.mu.Lock()
+	if s.ring != nil && equalStrings(s.current, members) {
+		s.mu.Unlock()
+		return
+	}
+	s.ring = newHashRing(members, s.virtualNodes)
+	s.current = members
+	subscribers := s.subscribers
+	s.mu.Unlock()
+
+	s.log.Info(fmt.Sprintf("Sharding ASGs between %d replica(s): %s", len(members), strings.Join(members, ", ")))
+	if !containsString(members, s.identity) {
+		s.log.Warn(fmt.Sprintf("Replica %s is not a member yet, handling no ASGs", s.identity))
+	}
+	for _, ch := range subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// runRebalance takes over the ASGs moved to this replica with the work context
+// whenever the replicas change, until ctx is cancelled. ASGs moved away are left
+// to their new owner.
+func (d *Daemon) runRebalance(ctx, work context.Context, changes <-chan struct{}) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changes:
+		}
+		d.takeOver(work)
+	}
+}
+
+// endpointsMembers lists the ready pods of an Endpoints by name, falling back to
+// the address's hostname or IP for addresses that aren't pods.
+func endpointsMembers(kubeClient kubernetes.Interface, namespace, name string) func(ctx context.Context) ([]string, error) {
+	return func(ctx context.Context) ([]string, error) {
+		ep, err := kubeClient.CoreV1().Endpoints(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		var members []string
+		for _, subset := range ep.Subsets {
+			for _, addr := range subset.Addresses {
+				if m := addressMember(addr); !containsString(members, m) {
+					members = append(members, m)
+				}
+			}
+		}
+		return members, nil
+	}
+}
+
+func addressMember(addr corev1.EndpointAddress) string {
+	switch {
+	case addr.TargetRef != nil && addr.TargetRef.Kind == "Pod":
+		return addr.TargetRef.Name
+	case addr.Hostname != "":
+		return addr.Hostname
+	}
+	return addr.IP
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,205 @@
+package tagd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/leosunmo/tagd/tagdtest"
+	"go.uber.org/zap"
+)
+
+// testSharder returns a Sharder of replica a among a and b.
+func testSharder() *Sharder {
+	s := &Sharder{identity: "a", virtualNodes: defaultShardingVirtualNodes, log: zap.NewNop()}
+	s.update([]string{"a", "b"})
+	return s
+}
+
+// shardedASGs returns an ASG name owned by the Sharder and one that isn't.
+func shardedASGs(t *testing.T, s *Sharder) (owned, foreign string) {
+	t.Helper()
+	for i := 0; owned == "" || foreign == ""; i++ {
+		if i == 100 {
+			t.Fatal("no ASG names owned by both replicas")
+		}
+		name := fmt.Sprintf("asg-%d", i)
+		if s.Owns(Scope{}, name) {
+			owned = name
+		} else {
+			foreign = name
+		}
+	}
+	return owned, foreign
+}
+
+func TestHashRingMovesOnlyKeysOfNewMembers(t *testing.T) {
+	before := newHashRing([]string{"a", "b"}, defaultShardingVirtualNodes)
+	after := newHashRing([]string{"a", "b", "c"}, defaultShardingVirtualNodes)
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("asg-%d", i)
+		if before.owner(key) == after.owner(key) {
+			continue
+		}
+		if owner := after.owner(key); owner != "c" {
+			t.Fatalf("%s moved from %s to %s, want the new member c", key, before.owner(key), owner)
+		}
+		moved++
+	}
+	// About a third of the keys move to the new member
+	if moved < 200 || moved > 470 {
+		t.Errorf("moved %d of 1000 keys, want about 333", moved)
+	}
+}
+
+func TestSharderSplitsASGsBetweenReplicas(t *testing.T) {
+	a := testSharder()
+	b := &Sharder{identity: "b", virtualNodes: defaultShardingVirtualNodes, log: zap.NewNop()}
+	b.update([]string{"b", "a"})
+	var all *Sharder
+
+	owned := 0
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("asg-%d", i)
+		if a.Owns(Scope{}, name) == b.Owns(Scope{}, name) {
+			t.Errorf("%s is owned by both or neither replica", name)
+		}
+		if a.Owns(Scope{}, name) {
+			owned++
+		}
+		if !all.Owns(Scope{}, name) {
+			t.Errorf("nil Sharder doesn't own %s", name)
+		}
+	}
+	if owned == 0 || owned == 100 {
+		t.Errorf("replica a owns %d of 100 ASGs, want them split", owned)
+	}
+}
+
+func TestHandleQueueMessageHidesForeignMessages(t *testing.T) {
+	backend := tagdtest.NewBackend("", "")
+	backend.CreateQueue("tagd")
+	sharder := testSharder()
+	_, foreign := shardedASGs(t, sharder)
+	if err := backend.CreateASG(foreign, nil); err != nil {
+		t.Fatal(err)
+	}
+	d := newTestDaemon(t, backend, &Config{
+		SQSQueueName:   "tagd",
+		TaggingConfigs: []TaggingConfig{{ASGName: foreign, Tags: map[string]string{"team": "web"}}},
+	})
+	d.sharder = sharder
+
+	body := fmt.Sprintf(`{"AutoScalingGroupName":%q,"Event":"autoscaling:EC2_INSTANCE_LAUNCH","EC2InstanceId":"i-0123"}`, foreign)
+	if err := backend.SendMessage("tagd", body); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	messages, err := d.queue.GetMessages(ctx)
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("GetMessages() = %v, %v", messages, err)
+	}
+	d.handleQueueMessage(ctx, messages[0])
+
+	if got := backend.Messages("tagd"); len(got) != 1 {
+		t.Fatalf("messages left on the queue = %d, want 1", len(got))
+	}
+	if got := backend.Calls("ChangeMessageVisibility"); got != 1 {
+		t.Errorf("ChangeMessageVisibility calls = %d, want 1", got)
+	}
+	out, err := backend.SQS().ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{QueueUrl: aws.String(d.queue.url)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Messages) != 0 {
+		t.Error("message left for another replica is visible again right away")
+	}
+}
+
+func TestTagSnapshotsOfOwnedASGs(t *testing.T) {
+	backend := tagdtest.NewBackend("", "")
+	sharder := testSharder()
+	owned, foreign := shardedASGs(t, sharder)
+	for _, name := range []string{owned, foreign} {
+		if err := backend.CreateASG(name, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := newTestDaemon(t, backend, &Config{
+		TaggingConfigs: []TaggingConfig{{ASGName: "asg-*", Tags: map[string]string{"team": "web"}}},
+	})
+	d.sharder = sharder
+
+	snapshot := func(asgName string) *ec2.Snapshot {
+		vol := backend.CreateVolume(tagdtest.VolumeSpec{Tags: map[string]string{MarkerTagASG: asgName}})
+		id, err := backend.CreateSnapshot(vol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &ec2.Snapshot{SnapshotId: aws.String(id), VolumeId: aws.String(vol)}
+	}
+	ctx := context.Background()
+
+	ownedSnap, foreignSnap := snapshot(owned), snapshot(foreign)
+	if err := d.tagSnapshots(ctx, []*ec2.Snapshot{ownedSnap, foreignSnap}); err != nil {
+		t.Fatalf("tagSnapshots() of a mixed event error = %v", err)
+	}
+	if got := backend.Tags(aws.StringValue(ownedSnap.SnapshotId)); got["team"] != "web" || got[MarkerTagASG] != owned {
+		t.Errorf("tags of the owned snapshot = %v", got)
+	}
+	if got := backend.Tags(aws.StringValue(foreignSnap.SnapshotId)); len(got) != 0 {
+		t.Errorf("tags of the foreign snapshot = %v, want none", got)
+	}
+
+	if err := d.tagSnapshots(ctx, []*ec2.Snapshot{foreignSnap}); !errors.Is(err, errNotOwned) {
+		t.Errorf("tagSnapshots() of foreign snapshots error = %v, want errNotOwned", err)
+	}
+}
+
+func TestBouncedMessagesAreNotCountedAsFailures(t *testing.T) {
+	backend := tagdtest.NewBackend("", "")
+	backend.CreateQueue("tagd")
+	sharder := testSharder()
+	owned, _ := shardedASGs(t, sharder)
+	if err := backend.CreateASG(owned, nil); err != nil {
+		t.Fatal(err)
+	}
+	d := newTestDaemon(t, backend, &Config{
+		SQSQueueName:   "tagd",
+		TaggingConfigs: []TaggingConfig{{ASGName: owned, Tags: map[string]string{"team": "web"}}},
+	})
+	d.sharder = sharder
+	id, err := backend.LaunchInstance(owned, tagdtest.InstanceSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := fmt.Sprintf(`{"AutoScalingGroupName":%q,"Event":"autoscaling:EC2_INSTANCE_LAUNCH","EC2InstanceId":%q}`, owned, id)
+	if err := backend.SendMessage("tagd", body); err != nil {
+		t.Fatal(err)
+	}
+
+	// Other replicas received the message many times before its owner did
+	ctx := context.Background()
+	for i := 0; i < 2*maxMessageAttempts; i++ {
+		if _, err := backend.SQS().ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:          aws.String(d.queue.url),
+			VisibilityTimeout: aws.Int64(0),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backend.InjectFault("CreateTags", tagdtest.Fault{Err: tagdtest.Error("RequestLimitExceeded", "Request limit exceeded."), Times: 1})
+	messages, err := d.queue.GetMessages(ctx)
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("GetMessages() = %v, %v", messages, err)
+	}
+	d.handleQueueMessage(ctx, messages[0])
+	if got := backend.Messages("tagd"); len(got) != 1 {
+		t.Fatalf("messages left on the queue after the first failure = %d, want 1", len(got))
+	}
+}
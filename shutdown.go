@@ -0,0 +1,251 @@
+package tagd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultShutdownGracePeriod = 20 * time.Second
+	// shutdownHookTimeout bounds the shutdown hooks, after the grace period.
+	shutdownHookTimeout = 10 * time.Second
+)
+
+// ShutdownHook is run by Start once the Daemon has stopped.
+type ShutdownHook func(ctx context.Context) error
+
+type namedHook struct {
+	name string
+	hook ShutdownHook
+}
+
+// drainGroup counts running handlers like a sync.WaitGroup, but refuses new
+// ones once it is draining, so handlers may start at any time. It also holds
+// the timers of delayed handlers, stopped when draining. A nil drainGroup
+// never drains.
+type drainGroup struct {
+	mu       sync.Mutex
+	running  int
+	draining bool
+	idle     chan struct{}
+	work     context.Context
+	timers   map[*time.Timer]struct{}
+}
+
+// begin registers a handler, returning false if the group is draining and the
+// handler must not run.
+func (g *drainGroup) begin() bool {
+	if g == nil {
+		return true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.draining {
+		return false
+	}
+	g.running++
+	return true
+}
+
+// end unregisters a handler registered by begin.
+func (g *drainGroup) end() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.running--
+	if g.draining && g.running == 0 && g.idle != nil {
+		close(g.idle)
+		g.idle = nil
+	}
+}
+
+// drain refuses new handlers and waits for the running ones to end, or for ctx
+// to be cancelled. It returns the number of handlers still running.
+func (g *drainGroup) drain(ctx context.Context) int {
+	g.mu.Lock()
+	g.draining = true
+	for timer := range g.timers {
+		timer.Stop()
+	}
+	g.timers = nil
+	if g.running == 0 {
+		g.mu.Unlock()
+		return 0
+	}
+	idle := make(chan struct{})
+	g.idle = idle
+	g.mu.Unlock()
+
+	select {
+	case <-idle:
+	case <-ctx.Done():
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.running
+}
+
+// reset accepts handlers again after draining, e.g. when leadership is regained.
+// Delayed handlers run with work.
+func (g *drainGroup) reset(work context.Context) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.draining = false
+	g.work = work
+}
+
+// afterFunc runs f as a handler after delay, with the context given to reset.
+// It's dropped if the group drains first.
+func (g *drainGroup) afterFunc(delay time.Duration, f func(work context.Context)) {
+	if g == nil {
+		time.AfterFunc(delay, func() { f(context.Background()) })
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.draining {
+		return
+	}
+	if g.timers == nil {
+		g.timers = make(map[*time.Timer]struct{})
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		g.mu.Lock()
+		delete(g.timers, timer)
+		work := g.work
+		g.mu.Unlock()
+		if !g.begin() {
+			return
+		}
+		defer g.end()
+		if work == nil {
+			work = context.Background()
+		}
+		f(work)
+	})
+	g.timers[timer] = struct{}{}
+}
+
+// goHandler runs f in a goroutine, counted as running until it returns. f is
+// skipped once the group is draining, and goHandler returns false.
+func (g *drainGroup) goHandler(f func()) bool {
+	if !g.begin() {
+		return false
+	}
+	go func() {
+		defer g.end()
+		f()
+	}()
+	return true
+}
+
+// goHandler runs f in a goroutine, counted as running until it returns. f is
+// skipped once the handlers are draining, and goHandler returns false.
+func (d *Daemon) goHandler(f func()) bool {
+	return d.handlers.goHandler(f)
+}
+
+// OnShutdown registers a hook to run when Start returns, after the in-flight
+// handlers were drained. Hooks run in the reverse order of registration, and
+// their errors are logged.
+func (d *Daemon) OnShutdown(name string, hook ShutdownHook) {
+	d.hooks = append(d.hooks, namedHook{name: name, hook: hook})
+}
+
+// gracePeriod returns how long in-flight handlers may run after ctx is cancelled.
+func (d *Daemon) gracePeriod() time.Duration {
+	if d.config.ShutdownGracePeriod == 0 {
+		return defaultShutdownGracePeriod
+	}
+	return d.config.ShutdownGracePeriod
+}
+
+// setStopping sets the channel closed on shutdown, for d and its scopes.
+func (d *Daemon) setStopping(stopping <-chan struct{}) {
+	d.stopping = stopping
+	for _, s := range d.scopes {
+		s.setStopping(stopping)
+	}
+}
+
+// shuttingDown returns true if the Daemon is shutting down, rather than only
+// lost leadership.
+func (d *Daemon) shuttingDown() bool {
+	if d.stopping == nil {
+		return true
+	}
+	select {
+	case <-d.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// workContext returns the context handlers run with. On shutdown, it isn't
+// cancelled with ctx but a grace period later, so handlers can finish what
+// they're doing. When leadership is lost, it's cancelled right away, as the
+// new leader may already be handling the same events.
+func (d *Daemon) workContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	work, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-work.Done():
+			return
+		case <-ctx.Done():
+		}
+		if !d.shuttingDown() {
+			d.log.Warn("Lost leadership, cancelling handlers")
+			cancel()
+			return
+		}
+		timer := time.NewTimer(d.gracePeriod())
+		defer timer.Stop()
+		select {
+		case <-work.Done():
+		case <-timer.C:
+			cancel()
+		}
+	}()
+	return work, cancel
+}
+
+// drain waits for the in-flight handlers until work is cancelled at the end of
+// the grace period, or right away when leadership was lost.
+func (d *Daemon) drain(work context.Context) {
+	if !d.shuttingDown() {
+		if n := d.handlers.drain(work); n > 0 {
+			d.log.Warn(fmt.Sprintf("Cancelled %d handler(s) after losing leadership", n))
+		}
+		return
+	}
+	d.log.Info(fmt.Sprintf("Stopped receiving, waiting up to %s for in-flight handlers", d.gracePeriod()))
+	if n := d.handlers.drain(work); n > 0 {
+		d.log.Warn(fmt.Sprintf("Shutdown grace period is over, cancelling %d handler(s)", n))
+		return
+	}
+	d.log.Info("All handlers finished")
+}
+
+// runShutdownHooks runs the hooks registered with OnShutdown.
+func (d *Daemon) runShutdownHooks() {
+	if len(d.hooks) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownHookTimeout)
+	defer cancel()
+	for i := len(d.hooks) - 1; i >= 0; i-- {
+		h := d.hooks[i]
+		d.log.Debug(fmt.Sprintf("Running shutdown hook %s", h.name))
+		if err := h.hook(ctx); err != nil {
+			d.log.Error(fmt.Sprintf("Shutdown hook %s failed", h.name), zap.Error(err))
+		}
+	}
+}
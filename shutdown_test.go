@@ -0,0 +1,176 @@
+package tagd
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/leosunmo/tagd/tagdtest"
+	"go.uber.org/zap"
+)
+
+func TestDrainGroupWaitsForRunningHandlers(t *testing.T) {
+	var g drainGroup
+	if !g.begin() {
+		t.Fatal("handler refused before draining")
+	}
+	go g.end()
+	if n := g.drain(context.Background()); n != 0 {
+		t.Errorf("handlers running after drain = %d, want 0", n)
+	}
+	if g.begin() {
+		t.Error("handler started while draining")
+	}
+}
+
+func TestDrainGroupStopsWaitingWithContext(t *testing.T) {
+	var g drainGroup
+	g.begin()
+	defer g.end()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if n := g.drain(ctx); n != 1 {
+		t.Errorf("handlers running after drain = %d, want 1", n)
+	}
+}
+
+func TestShutdownHooksRunInReverseOrder(t *testing.T) {
+	d := &Daemon{log: zap.NewNop()}
+	var order []string
+	d.OnShutdown("first", func(context.Context) error {
+		order = append(order, "first")
+		return nil
+	})
+	d.OnShutdown("second", func(context.Context) error {
+		order = append(order, "second")
+		return fmt.Errorf("failed")
+	})
+	d.runShutdownHooks()
+	if len(order) != 2 || order[0] != "second" || order[1] != "first" {
+		t.Errorf("hooks ran in order %v, want second, first", order)
+	}
+}
+
+func TestGoHandlerSkipsWhileDraining(t *testing.T) {
+	d := &Daemon{log: zap.NewNop()}
+	d.handlers.drain(context.Background())
+
+	ran := make(chan struct{}, 1)
+	d.goHandler(func() { ran <- struct{}{} })
+	d.handlers.reset(context.Background())
+	d.goHandler(func() { ran <- struct{}{} })
+	<-ran
+	select {
+	case <-ran:
+		t.Error("handler started while draining ran")
+	default:
+	}
+	if n := d.handlers.drain(context.Background()); n != 0 {
+		t.Errorf("handlers running after drain = %d, want 0", n)
+	}
+}
+
+func TestHandleQueueMessageKeepsMessagesHidden(t *testing.T) {
+	backend := tagdtest.NewBackend("", "")
+	backend.CreateQueue("tagd")
+	if err := backend.CreateASG("web", nil); err != nil {
+		t.Fatal(err)
+	}
+	d := newTestDaemon(t, backend, &Config{
+		SQSQueueName:   "tagd",
+		TaggingConfigs: []TaggingConfig{{ASGName: "web", Tags: map[string]string{"team": "web"}}},
+	})
+	receive := func() []*sqs.Message {
+		out, err := backend.SQS().ReceiveMessageWithContext(context.Background(), &sqs.ReceiveMessageInput{
+			QueueUrl:          aws.String(d.queue.url),
+			VisibilityTimeout: aws.Int64(0),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out.Messages
+	}
+
+	id, err := backend.LaunchInstance("web", tagdtest.InstanceSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := fmt.Sprintf(`{"AutoScalingGroupName":"web","Event":"autoscaling:EC2_INSTANCE_LAUNCH","EC2InstanceId":%q}`, id)
+	if err := backend.SendMessage("tagd", body); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := d.queue.GetMessages(context.Background())
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("GetMessages() = %v, %v", messages, err)
+	}
+	if got := receive(); len(got) != 0 {
+		t.Fatal("received message is visible to other receivers")
+	}
+
+	// A message cut short by shutdown is visible again right away
+	work, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.handleQueueMessage(work, messages[0])
+	if got := backend.Messages("tagd"); len(got) != 1 {
+		t.Fatalf("messages left on the queue = %d, want 1", len(got))
+	}
+	if got := receive(); len(got) != 1 {
+		t.Error("unfinished message isn't visible again")
+	}
+}
+
+func TestDrainStopsDelayedHandlers(t *testing.T) {
+	var g drainGroup
+	g.reset(context.Background())
+
+	ran := make(chan struct{}, 1)
+	g.afterFunc(50*time.Millisecond, func(context.Context) { ran <- struct{}{} })
+	g.drain(context.Background())
+	g.afterFunc(0, func(context.Context) { ran <- struct{}{} })
+	select {
+	case <-ran:
+		t.Error("delayed handler ran after drain")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	work, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	g.reset(work)
+	got := make(chan context.Context, 1)
+	g.afterFunc(0, func(ctx context.Context) { got <- ctx })
+	if ctx := <-got; ctx != work {
+		t.Error("delayed handler didn't run with the work context")
+	}
+}
+
+func TestWorkContextCancelsOnLostLeadership(t *testing.T) {
+	d := &Daemon{config: &Config{ShutdownGracePeriod: time.Hour}, log: zap.NewNop()}
+	stopping := make(chan struct{})
+	d.setStopping(stopping)
+
+	// Losing leadership cancels work right away
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	work, cancelWork := d.workContext(leaderCtx)
+	defer cancelWork()
+	cancel()
+	select {
+	case <-work.Done():
+	case <-time.After(time.Second):
+		t.Fatal("work not cancelled after losing leadership")
+	}
+
+	// Shutting down gives handlers the grace period
+	ctx, cancel := context.WithCancel(context.Background())
+	work, cancelWork = d.workContext(ctx)
+	defer cancelWork()
+	close(stopping)
+	cancel()
+	select {
+	case <-work.Done():
+		t.Fatal("work cancelled before the grace period")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
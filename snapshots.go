@@ -0,0 +1,292 @@
+package tagd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+)
+
+const (
+	detailTypeSnapshot = "EBS Snapshot Notification"
+
+	// DescribeVolumes accepts at most 200 filter values
+	maxFilterValues = 200
+)
+
+// SnapshotConfig configures propagating tags to EBS snapshots of managed volumes.
+// Snapshot events are always handled; Interval enables a periodic scan as well.
+type SnapshotConfig struct {
+	Interval time.Duration `yaml:"interval,omitempty"`
+}
+
+// SnapshotDetail is the detail of an "EBS Snapshot Notification" event.
+// Single snapshots set SnapshotID and Source, multi-volume snapshots set Snapshots.
+type SnapshotDetail struct {
+	Event      string `json:"event"`
+	Result     string `json:"result"`
+	SnapshotID string `json:"snapshot_id"`
+	Source     string `json:"source"`
+	Snapshots  []struct {
+		SnapshotID string `json:"snapshot_id"`
+		Source     string `json:"source"`
+		Status     string `json:"status"`
+	} `json:"snapshots"`
+}
+
+// snapshotTags returns the tags a snapshot of a volume with volumeTags should carry:
+// the static tags, and the volume's tags written by the copy rules, node labels
+// and volume selectors. Tags of other tools and the instance marker aren't copied.
+func (l *AutoscalingTagger) snapshotTags(volumeTags map[string]string) map[string]string {
+	tags := make(map[string]string, len(volumeTags)+len(l.tags.Tags)+1)
+	for k, v := range volumeTags {
+		if l.tags.writesTag(k) {
+			tags[k] = v
+		}
+	}
+	for k, v := range l.tags.Tags {
+		tags[k] = v
+	}
+	tags[MarkerTagASG] = l.asgName
+	return tags
+}
+
+// writesTag returns true if the TaggingConfig writes the tag key to volumes,
+// other than tagd's markers.
+func (c *TaggingConfig) writesTag(key string) bool {
+	switch key {
+	case MarkerTagASG, MarkerTagInstance, MarkerTagOrphanedSince:
+		return false
+	}
+	if _, ok := c.Tags[key]; ok {
+		return true
+	}
+	for i := range c.Volumes {
+		if _, ok := c.Volumes[i].Tags[key]; ok {
+			return true
+		}
+	}
+	for _, label := range c.NodeLabels {
+		if label == key {
+			return true
+		}
+	}
+	return c.copier().writes(key)
+}
+
+// handleSnapshotEvent tags the snapshots of a successful snapshot event.
+func (d *Daemon) handleSnapshotEvent(ctx context.Context, event *Event) error {
+	var detail SnapshotDetail
+	if err := json.Unmarshal(event.Detail, &detail); err != nil {
+		d.log.Error("Failed to unmarshal snapshot event detail", zap.Error(err))
+		return nil
+	}
+	if detail.Result != "succeeded" {
+		d.log.Debug(fmt.Sprintf("Skipping snapshot event, %s %s", detail.Event, detail.Result))
+		return nil
+	}
+
+	var snapshotIDs []string
+	if detail.SnapshotID != "" {
+		snapshotIDs = append(snapshotIDs, arnResourceID(detail.SnapshotID))
+	}
+	for _, s := range detail.Snapshots {
+		if s.Status == "completed" {
+			snapshotIDs = append(snapshotIDs, arnResourceID(s.SnapshotID))
+		}
+	}
+	if len(snapshotIDs) == 0 {
+		return nil
+	}
+
+	describeCtx, cancel := context.WithTimeout(ctx, d.config.Timeouts.describe())
+	defer cancel()
+	out, err := d.ec2Client.DescribeSnapshotsWithContext(describeCtx, &ec2.DescribeSnapshotsInput{
+		SnapshotIds: aws.StringSlice(snapshotIDs),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to describe snapshots %s: %w", strings.Join(snapshotIDs, ", "), err)
+	}
+	if err := d.tagSnapshots(ctx, out.Snapshots); err != nil {
+		return fmt.Errorf("failed to tag snapshots %s: %w", strings.Join(snapshotIDs, ", "), err)
+	}
+	return nil
+}
+
+// arnResourceID returns the resource ID from an ARN such as
+// arn:aws:ec2::us-west-2:snapshot/snap-01234567.
+func arnResourceID(arn string) string {
+	return arn[strings.LastIndex(arn, "/")+1:]
+}
+
+// scanSnapshots tags all snapshots owned by the account that belong to a managed
+// ASG. Each page is looked up within the describe timeout.
+func (d *Daemon) scanSnapshots(ctx context.Context) error {
+	input := &ec2.DescribeSnapshotsInput{
+		OwnerIds: aws.StringSlice([]string{"self"}),
+	}
+	for {
+		describeCtx, cancel := context.WithTimeout(ctx, d.config.Timeouts.describe())
+		page, err := d.ec2Client.DescribeSnapshotsWithContext(describeCtx, input)
+		cancel()
+		if err != nil {
+			return err
+		}
+		// Snapshots of ASGs owned by other replicas are tagged by their own scans
+		if err := d.tagSnapshots(ctx, page.Snapshots); err != nil && !errors.Is(err, errNotOwned) {
+			return err
+		}
+		if aws.StringValue(page.NextToken) == "" {
+			return nil
+		}
+		input.NextToken = page.NextToken
+	}
+}
+
+// tagSnapshots resolves the managed ASG of each snapshot, either from its own tagd
+// tags or from its source volume, and copies the configured tags onto it. With
+// sharding, it only tags the snapshots of ASGs this replica owns, and returns
+// errNotOwned if none of the snapshots of managed ASGs are, so their owner gets
+// the event. Snapshots taken together usually belong to one instance, and those
+// of other ASGs in a mixed event are left to their owner's snapshot scan.
+func (d *Daemon) tagSnapshots(ctx context.Context, snapshots []*ec2.Snapshot) error {
+	var volumeIDs []string
+	for _, snap := range snapshots {
+		if snap.VolumeId != nil {
+			volumeIDs = append(volumeIDs, aws.StringValue(snap.VolumeId))
+		}
+	}
+	volumes, err := d.describeVolumesByID(ctx, volumeIDs)
+	if err != nil {
+		return err
+	}
+
+	instanceASGs := make(map[string]string)
+	var owned int
+	var notOwned []string
+	for _, snap := range snapshots {
+		snapTags := ec2TagMap(snap.Tags)
+		volumeTags := map[string]string{}
+
+		asgName := snapTags[MarkerTagASG]
+		if vol, ok := volumes[aws.StringValue(snap.VolumeId)]; ok {
+			volumeTags = ec2TagMap(vol.Tags)
+			if asgName == "" {
+				asgName = volumeTags[MarkerTagASG]
+			}
+			if asgName == "" {
+				for _, a := range vol.Attachments {
+					instanceID := aws.StringValue(a.InstanceId)
+					if _, cached := instanceASGs[instanceID]; !cached {
+						if instanceASGs[instanceID], err = d.instanceASG(ctx, instanceID); err != nil {
+							return err
+						}
+					}
+					asgName = instanceASGs[instanceID]
+				}
+			}
+		}
+
+		tagger, exists := d.tagger(asgName)
+		if !exists {
+			continue
+		}
+		if !d.owns(asgName) {
+			notOwned = append(notOwned, aws.StringValue(snap.SnapshotId))
+			continue
+		}
+		owned++
+
+		tags := tagger.snapshotTags(volumeTags)
+		if containsTags(snapTags, tags) {
+			continue
+		}
+		d.log.Info(fmt.Sprintf("Tagging snapshot %s of volume %s", aws.StringValue(snap.SnapshotId), aws.StringValue(snap.VolumeId)),
+			zap.String("asg", asgName))
+		if err := tagger.tag(ctx, CauseSnapshot, "", []*string{snap.SnapshotId}, tags); err != nil {
+			return fmt.Errorf("failed to tag snapshot %s: %w", aws.StringValue(snap.SnapshotId), err)
+		}
+	}
+	switch {
+	case len(notOwned) > 0 && owned == 0:
+		return fmt.Errorf("snapshots %s: %w", strings.Join(notOwned, ", "), errNotOwned)
+	case len(notOwned) > 0:
+		d.log.Debug(fmt.Sprintf("Skipping snapshots %s of ASGs owned by other replicas", strings.Join(notOwned, ", ")))
+	}
+	return nil
+}
+
+// describeVolumesByID returns the volumes that still exist out of volumeIDs, keyed by ID.
+func (d *Daemon) describeVolumesByID(ctx context.Context, volumeIDs []string) (map[string]*ec2.Volume, error) {
+	volumes := make(map[string]*ec2.Volume, len(volumeIDs))
+	for len(volumeIDs) > 0 {
+		n := len(volumeIDs)
+		if n > maxFilterValues {
+			n = maxFilterValues
+		}
+		// Filtering on volume-id instead of passing VolumeIds ignores deleted volumes
+		input := &ec2.DescribeVolumesInput{
+			Filters: []*ec2.Filter{
+				{
+					Name:   aws.String("volume-id"),
+					Values: aws.StringSlice(volumeIDs[:n]),
+				},
+			},
+		}
+		describeCtx, cancel := context.WithTimeout(ctx, d.config.Timeouts.describe())
+		err := d.ec2Client.DescribeVolumesPagesWithContext(describeCtx, input, func(page *ec2.DescribeVolumesOutput, lastPage bool) bool {
+			for _, vol := range page.Volumes {
+				volumes[aws.StringValue(vol.VolumeId)] = vol
+			}
+			return true
+		})
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		volumeIDs = volumeIDs[n:]
+	}
+	return volumes, nil
+}
+
+// runSnapshotScan periodically tags snapshots with the work context until ctx is cancelled.
+func (d *Daemon) runSnapshotScan(ctx, work context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		d.log.Debug("Scanning snapshots")
+		if err := d.scanSnapshots(work); err != nil {
+			d.log.Error("failed to scan snapshots", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func ec2TagMap(tags []*ec2.Tag) map[string]string {
+	m := make(map[string]string, len(tags))
+	for _, t := range tags {
+		m[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return m
+}
+
+// containsTags returns true if every tag in want is present in have.
+func containsTags(have, want map[string]string) bool {
+	for k, v := range want {
+		if hv, ok := have[k]; !ok || hv != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package tagd
+
+import (
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestSnapshotTagsOnlyCopyTagsOfTheTaggingConfig(t *testing.T) {
+	config := &Config{TaggingConfigs: []TaggingConfig{{
+		ASGName:   "web",
+		Tags:      map[string]string{"env": "prod"},
+		KeyPrefix: []string{"team"},
+		CopyTags: CopyTagsConfig{
+			Include: []string{"/^k8s\\.io\\/(.+)$/"},
+			Rename: []RenameRule{
+				{From: "/^k8s\\.io\\/(.+)$/", To: "k8s-$1"},
+				{From: "cost-*", To: "billing:*"},
+			},
+		},
+		Volumes:    []VolumeSelector{{Device: "/dev/xvdb", Tags: map[string]string{"role": "data"}}},
+		NodeLabels: []string{"zone"},
+	}}}
+	if err := config.Validate().Err(); err != nil {
+		t.Fatal(err)
+	}
+	tagger := NewAutoscalingTagger("web", &config.TaggingConfigs[0], nil, nil, nil, zap.NewNop())
+
+	got := tagger.snapshotTags(map[string]string{
+		"env":                               "dev",
+		"team":                              "web",
+		"k8s-role":                          "worker",
+		"billing:center":                    "42",
+		"role":                              "data",
+		"zone":                              "a",
+		"kubernetes.io/created-for/pv/name": "pv-data",
+		"ebs.csi.aws.com/cluster":           "true",
+		"aws:cloudformation:stack-name":     "web",
+		MarkerTagASG:                        "other",
+		MarkerTagInstance:                   "i-1",
+		MarkerTagOrphanedSince:              "2020-01-01T00:00:00Z",
+	})
+	want := map[string]string{
+		"env":            "prod",
+		"team":           "web",
+		"k8s-role":       "worker",
+		"billing:center": "42",
+		"role":           "data",
+		"zone":           "a",
+		MarkerTagASG:     "web",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshotTags() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,181 @@
+package tagdtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+)
+
+// Autoscaling is a fake Auto Scaling client of a Backend. Calls tagd doesn't make panic.
+type Autoscaling struct {
+	autoscalingiface.AutoScalingAPI
+	backend *Backend
+}
+
+var _ autoscalingiface.AutoScalingAPI = (*Autoscaling)(nil)
+
+// notification is the message an ASG publishes to its notification topics.
+type notification struct {
+	AccountID            string `json:"AccountId"`
+	RequestID            string `json:"RequestId"`
+	AutoScalingGroupARN  string `json:"AutoScalingGroupARN"`
+	AutoScalingGroupName string `json:"AutoScalingGroupName"`
+	Service              string `json:"Service"`
+	Event                string `json:"Event"`
+	Time                 string `json:"Time"`
+	ActivityID           string `json:"ActivityId,omitempty"`
+	Description          string `json:"Description,omitempty"`
+	Cause                string `json:"Cause,omitempty"`
+	StatusCode           string `json:"StatusCode,omitempty"`
+	EC2InstanceID        string `json:"EC2InstanceId,omitempty"`
+}
+
+// DescribeAutoScalingGroupsWithContext returns the requested ASGs, or all of
+// them, sorted by name. Missing ASGs are left out like Auto Scaling does.
+func (c *Autoscaling) DescribeAutoScalingGroupsWithContext(ctx aws.Context, input *autoscaling.DescribeAutoScalingGroupsInput, opts ...request.Option) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+	b := c.backend
+	if err := b.call(ctx, "DescribeAutoScalingGroups"); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	names := aws.StringValueSlice(input.AutoScalingGroupNames)
+	if len(names) == 0 {
+		for name := range b.asgs {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	out := &autoscaling.DescribeAutoScalingGroupsOutput{}
+	for _, name := range names {
+		if group, ok := b.asgs[name]; ok {
+			out.AutoScalingGroups = append(out.AutoScalingGroups, b.describeASG(group))
+		}
+	}
+	return out, nil
+}
+
+// DescribeAutoScalingGroupsPagesWithContext returns all ASGs in a single page.
+func (c *Autoscaling) DescribeAutoScalingGroupsPagesWithContext(ctx aws.Context, input *autoscaling.DescribeAutoScalingGroupsInput, fn func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool, opts ...request.Option) error {
+	out, err := c.DescribeAutoScalingGroupsWithContext(ctx, input, opts...)
+	if err != nil {
+		return err
+	}
+	fn(out, true)
+	return nil
+}
+
+// PutNotificationConfigurationWithContext sets the notification types an ASG
+// publishes to a topic, and publishes a test notification like Auto Scaling does.
+func (c *Autoscaling) PutNotificationConfigurationWithContext(ctx aws.Context, input *autoscaling.PutNotificationConfigurationInput, opts ...request.Option) (*autoscaling.PutNotificationConfigurationOutput, error) {
+	b := c.backend
+	if err := b.call(ctx, "PutNotificationConfiguration"); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	name := aws.StringValue(input.AutoScalingGroupName)
+	group, ok := b.asgs[name]
+	if !ok {
+		return nil, awserr.New("ValidationError", fmt.Sprintf("AutoScalingGroup name not found - %s", name), nil)
+	}
+	topicARN := aws.StringValue(input.TopicARN)
+	if _, ok := b.topics[topicARN]; !ok {
+		return nil, awserr.New("ValidationError", fmt.Sprintf("Topic %s not found", topicARN), nil)
+	}
+	group.notifications[topicARN] = aws.StringValueSlice(input.NotificationTypes)
+	subject := fmt.Sprintf("Auto Scaling: %s for group \"%s\"", eventVerb(eventTest), name)
+	b.publish(topicARN, subject, b.notificationMessage(group, eventTest, ""))
+	return &autoscaling.PutNotificationConfigurationOutput{}, nil
+}
+
+func (b *Backend) describeASG(group *asg) *autoscaling.Group {
+	out := &autoscaling.Group{
+		AutoScalingGroupName: aws.String(group.name),
+		AutoScalingGroupARN:  aws.String(b.asgARN(group.name)),
+		DesiredCapacity:      aws.Int64(int64(len(group.instances))),
+	}
+	for _, id := range group.instances {
+		out.Instances = append(out.Instances, &autoscaling.Instance{
+			InstanceId:     aws.String(id),
+			LifecycleState: aws.String(autoscaling.LifecycleStateInService),
+			HealthStatus:   aws.String("Healthy"),
+		})
+	}
+	for _, k := range sortedKeys(group.tags) {
+		out.Tags = append(out.Tags, &autoscaling.TagDescription{
+			ResourceId:        aws.String(group.name),
+			ResourceType:      aws.String("auto-scaling-group"),
+			Key:               aws.String(k),
+			Value:             aws.String(group.tags[k]),
+			PropagateAtLaunch: aws.Bool(true),
+		})
+	}
+	return out
+}
+
+// notify publishes event of instanceID to the topics the ASG notifies of event.
+func (b *Backend) notify(group *asg, event, instanceID string) {
+	topics := make([]string, 0, len(group.notifications))
+	for topicARN, types := range group.notifications {
+		for _, t := range types {
+			if t == event {
+				topics = append(topics, topicARN)
+				break
+			}
+		}
+	}
+	sort.Strings(topics)
+	for _, topicARN := range topics {
+		subject := fmt.Sprintf("Auto Scaling: %s for group \"%s\"", eventVerb(event), group.name)
+		b.publish(topicARN, subject, b.notificationMessage(group, event, instanceID))
+	}
+}
+
+func (b *Backend) notificationMessage(group *asg, event, instanceID string) string {
+	msg := notification{
+		AccountID:            b.account,
+		RequestID:            b.newUUID(),
+		AutoScalingGroupARN:  b.asgARN(group.name),
+		AutoScalingGroupName: group.name,
+		Service:              autoscalingService,
+		Event:                event,
+		Time:                 time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if instanceID != "" {
+		msg.ActivityID = msg.RequestID
+		msg.EC2InstanceID = instanceID
+		msg.StatusCode = "InProgress"
+		if event == eventLaunch {
+			msg.Description = fmt.Sprintf("Launching a new EC2 instance: %s", instanceID)
+		} else {
+			msg.Description = fmt.Sprintf("Terminating EC2 instance: %s", instanceID)
+		}
+		msg.Cause = fmt.Sprintf("At %s an instance %s was requested by tagdtest.", msg.Time, eventVerb(event))
+	}
+	body, _ := json.Marshal(msg)
+	return string(body)
+}
+
+func (b *Backend) asgARN(name string) string {
+	return fmt.Sprintf("arn:aws:autoscaling:%s:%s:autoScalingGroup:00000000-0000-4000-8000-000000000000:autoScalingGroupName/%s", b.region, b.account, name)
+}
+
+func eventVerb(event string) string {
+	switch event {
+	case eventLaunch:
+		return "launch"
+	case eventTerminate:
+		return "termination"
+	}
+	return "test notification"
+}
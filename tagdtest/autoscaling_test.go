@@ -0,0 +1,57 @@
+package tagdtest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+func TestASGNotificationsReachSubscribedQueues(t *testing.T) {
+	b := NewBackend("", "")
+	b.CreateQueue("tagd")
+	topic := b.CreateTopic("tagd")
+	if err := b.CreateASG("web", nil); err != nil {
+		t.Fatal(err)
+	}
+	queueARN := "arn:aws:sqs:" + DefaultRegion + ":" + DefaultAccount + ":tagd"
+	_, err := b.SNS().SubscribeWithContext(context.Background(), &sns.SubscribeInput{
+		TopicArn: aws.String(topic),
+		Protocol: aws.String("sqs"),
+		Endpoint: aws.String(queueARN),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a notification configuration, launches aren't published
+	if _, err := b.LaunchInstance("web", InstanceSpec{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Messages("tagd"); len(got) != 0 {
+		t.Fatalf("messages = %v, want none", got)
+	}
+	_, err = b.Autoscaling().PutNotificationConfigurationWithContext(context.Background(), &autoscaling.PutNotificationConfigurationInput{
+		AutoScalingGroupName: aws.String("web"),
+		TopicARN:             aws.String(topic),
+		NotificationTypes:    aws.StringSlice([]string{eventLaunch}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := b.LaunchInstance("web", InstanceSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The test notification, then the launch
+	got := b.Messages("tagd")
+	if len(got) != 2 {
+		t.Fatalf("messages = %d, want 2", len(got))
+	}
+	seeded, err := NewBackend("", "").Seed(got[1])
+	if err != nil || len(seeded) == 0 || seeded[0] != id {
+		t.Errorf("launch notification of %s seeds %v, %v", id, seeded, err)
+	}
+}
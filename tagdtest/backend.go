@@ -0,0 +1,708 @@
+// Package tagdtest is a stateful in-memory fake of the AWS APIs tagd uses, so tagd
+// and its configs can be tested end-to-end without AWS:
+//
+//	backend := tagdtest.NewBackend("", "")
+//	backend.CreateQueue("tagd")
+//	topic := backend.CreateTopic("tagd")
+//	backend.CreateASG("web", map[string]string{"team": "web"})
+//
+//	config.SQSQueueName, config.SNSTopicARN = "tagd", topic
+//	d, err := tagd.NewDaemon(config, backend.SQS(), backend.SNS(), backend.Autoscaling(), backend.EC2(), nil, nil, logger)
+//	go d.Start(ctx)
+//
+//	// The launch notification reaches the queue through the topic once tagd enabled it
+//	id, err := backend.LaunchInstance("web", tagdtest.InstanceSpec{})
+//	tags := backend.Tags(backend.Volumes(id)[0])
+//
+// The clients implement the calls tagd makes, with the context and pagination
+// variants tagd uses. Other calls panic. Errors use the AWS error codes, and
+// faults can be injected into any implemented call with InjectFault.
+package tagdtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRegion and DefaultAccount are used by NewBackend if none are given.
+	DefaultRegion  = "us-east-1"
+	DefaultAccount = "123456789012"
+
+	defaultVolumeSize   = 8
+	defaultVolumeType   = "gp2"
+	defaultRootDevice   = "/dev/xvda"
+	asgNameTagKey       = "aws:autoscaling:groupName"
+	reservedTagPrefix   = "aws:"
+	eventLaunch         = "autoscaling:EC2_INSTANCE_LAUNCH"
+	eventTerminate      = "autoscaling:EC2_INSTANCE_TERMINATE"
+	eventTest           = "autoscaling:TEST_NOTIFICATION"
+	autoscalingService  = "AWS Auto Scaling"
+	cloudTrailEventType = "AWS API Call via CloudTrail"
+)
+
+// Backend holds the state shared by the fake clients: ASGs, instances, volumes,
+// network interfaces, Elastic IPs, snapshots, tags, queues, topics and DynamoDB
+// tables of a single account and region. It is safe for concurrent use.
+type Backend struct {
+	region  string
+	account string
+
+	mu         sync.Mutex
+	nextID     uint64
+	asgs       map[string]*asg
+	instances  map[string]*instance
+	volumes    map[string]*volume
+	interfaces map[string]*networkInterface
+	addresses  map[string]*address
+	snapshots  map[string]*snapshot
+	// tags of every EC2 resource by ID
+	tags   map[string]map[string]string
+	queues map[string]*queue
+	topics map[string]*topic
+	tables map[string]*table
+	faults map[string][]*Fault
+	calls  map[string]int
+}
+
+type asg struct {
+	name string
+	tags map[string]string
+	// instances in launch order
+	instances []string
+	// notification types by topic ARN
+	notifications map[string][]string
+}
+
+type instance struct {
+	id         string
+	asg        string
+	state      string
+	rootDevice string
+	launched   time.Time
+}
+
+type volume struct {
+	id                string
+	size              int64
+	volumeType        string
+	created           time.Time
+	instanceID        string
+	device            string
+	keepOnTermination bool
+}
+
+type networkInterface struct {
+	id         string
+	instanceID string
+}
+
+type address struct {
+	allocationID string
+	publicIP     string
+	instanceID   string
+}
+
+type snapshot struct {
+	id          string
+	volumeID    string
+	size        int64
+	description string
+	started     time.Time
+}
+
+// InstanceSpec describes an instance launched by LaunchInstance.
+type InstanceSpec struct {
+	// ID of the instance, a new ID by default.
+	ID string
+	// Tags of the instance, over the tags of its ASG.
+	Tags map[string]string
+	// Volumes attached at launch, defaults to an 8 GiB gp2 root volume on /dev/xvda.
+	Volumes []VolumeSpec
+	// RootDeviceName defaults to the device of the first volume.
+	RootDeviceName string
+	// ElasticIP associates an Elastic IP with the instance.
+	ElasticIP bool
+}
+
+// VolumeSpec describes an EBS volume.
+type VolumeSpec struct {
+	// ID of the volume, a new ID by default.
+	ID string
+	// Device the volume is attached as, ignored by CreateVolume.
+	Device string
+	// Size in GiB, defaults to 8.
+	Size int64
+	// Type defaults to gp2.
+	Type string
+	Tags map[string]string
+	// KeepOnTermination keeps the volume, detached, when its instance terminates.
+	KeepOnTermination bool
+}
+
+// NewBackend returns an empty Backend for region and account, which default to
+// DefaultRegion and DefaultAccount if empty.
+func NewBackend(region, account string) *Backend {
+	if region == "" {
+		region = DefaultRegion
+	}
+	if account == "" {
+		account = DefaultAccount
+	}
+	return &Backend{
+		region:     region,
+		account:    account,
+		asgs:       make(map[string]*asg),
+		instances:  make(map[string]*instance),
+		volumes:    make(map[string]*volume),
+		interfaces: make(map[string]*networkInterface),
+		addresses:  make(map[string]*address),
+		snapshots:  make(map[string]*snapshot),
+		tags:       make(map[string]map[string]string),
+		queues:     make(map[string]*queue),
+		topics:     make(map[string]*topic),
+		tables:     make(map[string]*table),
+		faults:     make(map[string][]*Fault),
+		calls:      make(map[string]int),
+	}
+}
+
+// Region of the Backend.
+func (b *Backend) Region() string {
+	return b.region
+}
+
+// Account of the Backend.
+func (b *Backend) Account() string {
+	return b.account
+}
+
+// EC2 returns an EC2 client of the Backend.
+func (b *Backend) EC2() *EC2 {
+	return &EC2{backend: b}
+}
+
+// Autoscaling returns an Auto Scaling client of the Backend.
+func (b *Backend) Autoscaling() *Autoscaling {
+	return &Autoscaling{backend: b}
+}
+
+// SQS returns an SQS client of the Backend.
+func (b *Backend) SQS() *SQS {
+	return &SQS{backend: b}
+}
+
+// SNS returns an SNS client of the Backend.
+func (b *Backend) SNS() *SNS {
+	return &SNS{backend: b}
+}
+
+// CreateASG creates an ASG whose tags propagate to the instances it launches.
+func (b *Backend) CreateASG(name string, tags map[string]string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.asgs[name]; ok {
+		return fmt.Errorf("ASG %s already exists", name)
+	}
+	b.asgs[name] = &asg{
+		name:          name,
+		tags:          copyTags(tags),
+		notifications: make(map[string][]string),
+	}
+	return nil
+}
+
+// DeleteASG deletes an ASG, leaving its instances running outside of it.
+func (b *Backend) DeleteASG(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	group, ok := b.asgs[name]
+	if !ok {
+		return fmt.Errorf("ASG %s doesn't exist", name)
+	}
+	for _, id := range group.instances {
+		b.instances[id].asg = ""
+	}
+	delete(b.asgs, name)
+	return nil
+}
+
+// SetASGTags replaces the tags of an ASG. Running instances keep theirs.
+func (b *Backend) SetASGTags(name string, tags map[string]string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	group, ok := b.asgs[name]
+	if !ok {
+		return fmt.Errorf("ASG %s doesn't exist", name)
+	}
+	group.tags = copyTags(tags)
+	return nil
+}
+
+// Instances returns the instances of an ASG in launch order.
+func (b *Backend) Instances(asgName string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if group, ok := b.asgs[asgName]; ok {
+		return append([]string(nil), group.instances...)
+	}
+	return nil
+}
+
+// NotificationConfigurations returns the notification types of an ASG by topic ARN.
+func (b *Backend) NotificationConfigurations(asgName string) map[string][]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	group, ok := b.asgs[asgName]
+	if !ok {
+		return nil
+	}
+	configs := make(map[string][]string, len(group.notifications))
+	for topicARN, types := range group.notifications {
+		configs[topicARN] = append([]string(nil), types...)
+	}
+	return configs
+}
+
+// LaunchInstance launches a running instance in an ASG, or outside of any ASG if
+// asgName is empty, and returns its ID. It carries the aws:autoscaling:groupName
+// tag, the ASG's tags and its own, and has a primary network interface. The ASG
+// publishes a launch notification to the topics configured for it.
+func (b *Backend) LaunchInstance(asgName string, spec InstanceSpec) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	inst, err := b.launchInstance(asgName, spec)
+	if err != nil {
+		return "", err
+	}
+	if group, ok := b.asgs[asgName]; ok {
+		b.notify(group, eventLaunch, inst.id)
+	}
+	return inst.id, nil
+}
+
+// launchInstance launches an instance without notifying its ASG's topics.
+func (b *Backend) launchInstance(asgName string, spec InstanceSpec) (*instance, error) {
+	var group *asg
+	if asgName != "" {
+		var ok bool
+		if group, ok = b.asgs[asgName]; !ok {
+			return nil, fmt.Errorf("ASG %s doesn't exist", asgName)
+		}
+	}
+	for k := range spec.Tags {
+		if strings.HasPrefix(k, reservedTagPrefix) {
+			return nil, fmt.Errorf("tag %s uses the reserved prefix %s", k, reservedTagPrefix)
+		}
+	}
+	if spec.ID != "" && b.exists(spec.ID) {
+		return nil, fmt.Errorf("instance %s already exists", spec.ID)
+	}
+	for _, v := range spec.Volumes {
+		if v.ID != "" && b.exists(v.ID) {
+			return nil, fmt.Errorf("volume %s already exists", v.ID)
+		}
+	}
+
+	volumes := spec.Volumes
+	if len(volumes) == 0 {
+		volumes = []VolumeSpec{{Device: defaultRootDevice}}
+	}
+	rootDevice := spec.RootDeviceName
+	if rootDevice == "" {
+		rootDevice = volumes[0].Device
+	}
+	inst := &instance{
+		id:         spec.ID,
+		asg:        asgName,
+		state:      "running",
+		rootDevice: rootDevice,
+		launched:   time.Now().UTC(),
+	}
+	if inst.id == "" {
+		inst.id = b.newID("i")
+	}
+	b.instances[inst.id] = inst
+
+	tags := make(map[string]string)
+	if group != nil {
+		for k, v := range group.tags {
+			tags[k] = v
+		}
+		tags[asgNameTagKey] = asgName
+		group.instances = append(group.instances, inst.id)
+	}
+	for k, v := range spec.Tags {
+		tags[k] = v
+	}
+	b.tags[inst.id] = tags
+
+	for _, v := range volumes {
+		vol := b.createVolume(v)
+		vol.instanceID = inst.id
+		vol.device = v.Device
+	}
+	eni := &networkInterface{id: b.newID("eni"), instanceID: inst.id}
+	b.interfaces[eni.id] = eni
+	b.tags[eni.id] = make(map[string]string)
+	if spec.ElasticIP {
+		addr := &address{
+			allocationID: b.newID("eipalloc"),
+			publicIP:     fmt.Sprintf("198.51.100.%d", len(b.addresses)%254+1),
+			instanceID:   inst.id,
+		}
+		b.addresses[addr.allocationID] = addr
+		b.tags[addr.allocationID] = make(map[string]string)
+	}
+	return inst, nil
+}
+
+// TerminateInstance terminates an instance and removes it from its ASG, which
+// publishes a terminate notification to the topics configured for it. Its volumes
+// are deleted, unless kept on termination, and its Elastic IP is disassociated.
+func (b *Backend) TerminateInstance(instanceID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	inst, ok := b.instances[instanceID]
+	if !ok || inst.state == "terminated" {
+		return fmt.Errorf("instance %s isn't running", instanceID)
+	}
+	inst.state = "terminated"
+	for _, vol := range b.attached(instanceID) {
+		if vol.keepOnTermination {
+			vol.instanceID, vol.device = "", ""
+			continue
+		}
+		delete(b.volumes, vol.id)
+		delete(b.tags, vol.id)
+	}
+	for id, eni := range b.interfaces {
+		if eni.instanceID == instanceID {
+			delete(b.interfaces, id)
+			delete(b.tags, id)
+		}
+	}
+	for _, addr := range b.addresses {
+		if addr.instanceID == instanceID {
+			addr.instanceID = ""
+		}
+	}
+	if group, ok := b.asgs[inst.asg]; ok {
+		group.instances = removeString(group.instances, instanceID)
+		b.notify(group, eventTerminate, instanceID)
+	}
+	return nil
+}
+
+// CreateVolume creates an available volume and returns its ID. A volume with
+// the ID of spec is replaced.
+func (b *Backend) CreateVolume(spec VolumeSpec) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.createVolume(spec).id
+}
+
+// AttachVolume attaches an available volume to a running instance as device.
+// Like EC2, it doesn't notify tagd, send AttachVolumeEvent to the queue for that.
+func (b *Backend) AttachVolume(volumeID, instanceID, device string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	vol, ok := b.volumes[volumeID]
+	if !ok {
+		return fmt.Errorf("volume %s doesn't exist", volumeID)
+	}
+	if vol.instanceID != "" {
+		return fmt.Errorf("volume %s is attached to %s", volumeID, vol.instanceID)
+	}
+	if inst, ok := b.instances[instanceID]; !ok || inst.state != "running" {
+		return fmt.Errorf("instance %s isn't running", instanceID)
+	}
+	vol.instanceID, vol.device = instanceID, device
+	return nil
+}
+
+// DetachVolume detaches a volume from its instance.
+func (b *Backend) DetachVolume(volumeID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	vol, ok := b.volumes[volumeID]
+	if !ok || vol.instanceID == "" {
+		return fmt.Errorf("volume %s isn't attached", volumeID)
+	}
+	vol.instanceID, vol.device = "", ""
+	return nil
+}
+
+// Volumes returns the volumes attached to an instance, ordered by device.
+func (b *Backend) Volumes(instanceID string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var ids []string
+	for _, vol := range b.attached(instanceID) {
+		ids = append(ids, vol.id)
+	}
+	return ids
+}
+
+// VolumeExists returns true if the volume wasn't deleted.
+func (b *Backend) VolumeExists(volumeID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.volumes[volumeID]
+	return ok
+}
+
+// NetworkInterfaces returns the network interfaces attached to an instance.
+func (b *Backend) NetworkInterfaces(instanceID string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var ids []string
+	for _, eni := range b.interfaces {
+		if eni.instanceID == instanceID {
+			ids = append(ids, eni.id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// ElasticIPs returns the allocation IDs of the Elastic IPs associated with an instance.
+func (b *Backend) ElasticIPs(instanceID string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var ids []string
+	for _, addr := range b.addresses {
+		if addr.instanceID == instanceID {
+			ids = append(ids, addr.allocationID)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// CreateSnapshot creates a completed snapshot of a volume, without tags, and
+// returns its ID. Like EC2, it doesn't notify tagd, send SnapshotEvent to the
+// queue for that.
+func (b *Backend) CreateSnapshot(volumeID string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	vol, ok := b.volumes[volumeID]
+	if !ok {
+		return "", fmt.Errorf("volume %s doesn't exist", volumeID)
+	}
+	return b.createSnapshot(vol, "", "").id, nil
+}
+
+// Snapshots returns the snapshots of a volume in the order they were created.
+func (b *Backend) Snapshots(volumeID string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var snaps []*snapshot
+	for _, snap := range b.snapshots {
+		if snap.volumeID == volumeID {
+			snaps = append(snaps, snap)
+		}
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].id < snaps[j].id })
+	ids := make([]string, len(snaps))
+	for i, snap := range snaps {
+		ids[i] = snap.id
+	}
+	return ids
+}
+
+// Tags returns a copy of the tags of an EC2 resource.
+func (b *Backend) Tags(resourceID string) map[string]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return copyTags(b.tags[resourceID])
+}
+
+// SetTags adds tags to an EC2 resource, e.g. to set up tags left by a previous run.
+func (b *Backend) SetTags(resourceID string, tags map[string]string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.exists(resourceID) {
+		return fmt.Errorf("resource %s doesn't exist", resourceID)
+	}
+	for k, v := range tags {
+		b.tags[resourceID][k] = v
+	}
+	return nil
+}
+
+// AttachVolumeEvent returns the body of the EventBridge event of a successful
+// AttachVolume call, as delivered to the queue by a CloudTrail rule.
+func (b *Backend) AttachVolumeEvent(volumeID, instanceID, device string) string {
+	detail := map[string]interface{}{
+		"eventSource": "ec2.amazonaws.com",
+		"eventName":   "AttachVolume",
+		"requestParameters": map[string]string{
+			"volumeId":   volumeID,
+			"instanceId": instanceID,
+			"device":     device,
+		},
+	}
+	return b.event(cloudTrailEventType, nil, detail)
+}
+
+// SnapshotEvent returns the body of the EventBridge event of a successful
+// snapshot, as delivered to the queue by an EBS snapshot rule.
+func (b *Backend) SnapshotEvent(snapshotID string) string {
+	b.mu.Lock()
+	var volumeID string
+	if snap, ok := b.snapshots[snapshotID]; ok {
+		volumeID = snap.volumeID
+	}
+	b.mu.Unlock()
+	snapshotARN := fmt.Sprintf("arn:aws:ec2::%s:snapshot/%s", b.region, snapshotID)
+	detail := map[string]string{
+		"event":       "createSnapshot",
+		"result":      "succeeded",
+		"snapshot_id": snapshotARN,
+		"source":      fmt.Sprintf("arn:aws:ec2::%s:volume/%s", b.region, volumeID),
+	}
+	return b.event("EBS Snapshot Notification", []string{snapshotARN}, detail)
+}
+
+func (b *Backend) event(detailType string, resources []string, detail interface{}) string {
+	b.mu.Lock()
+	id := b.newUUID()
+	b.mu.Unlock()
+	body, _ := json.Marshal(map[string]interface{}{
+		"version":     "0",
+		"id":          id,
+		"detail-type": detailType,
+		"source":      "aws.ec2",
+		"account":     b.account,
+		"time":        time.Now().UTC().Format(time.RFC3339),
+		"region":      b.region,
+		"resources":   resources,
+		"detail":      detail,
+	})
+	return string(body)
+}
+
+func (b *Backend) createVolume(spec VolumeSpec) *volume {
+	vol := &volume{
+		id:                spec.ID,
+		size:              spec.Size,
+		volumeType:        spec.Type,
+		created:           time.Now().UTC(),
+		keepOnTermination: spec.KeepOnTermination,
+	}
+	if vol.id == "" {
+		vol.id = b.newID("vol")
+	}
+	if vol.size == 0 {
+		vol.size = defaultVolumeSize
+	}
+	if vol.volumeType == "" {
+		vol.volumeType = defaultVolumeType
+	}
+	b.volumes[vol.id] = vol
+	b.tags[vol.id] = copyTags(spec.Tags)
+	return vol
+}
+
+// createSnapshot creates a snapshot of vol, with a new ID if id is empty.
+func (b *Backend) createSnapshot(vol *volume, id, description string) *snapshot {
+	if id == "" {
+		id = b.newID("snap")
+	}
+	snap := &snapshot{
+		id:          id,
+		volumeID:    vol.id,
+		size:        vol.size,
+		description: description,
+		started:     time.Now().UTC(),
+	}
+	b.snapshots[snap.id] = snap
+	b.tags[snap.id] = make(map[string]string)
+	return snap
+}
+
+// attached returns the volumes attached to instanceID, ordered by device.
+func (b *Backend) attached(instanceID string) []*volume {
+	var volumes []*volume
+	for _, vol := range b.volumes {
+		if vol.instanceID == instanceID {
+			volumes = append(volumes, vol)
+		}
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].device < volumes[j].device })
+	return volumes
+}
+
+// exists returns true if resourceID is an existing EC2 resource.
+func (b *Backend) exists(resourceID string) bool {
+	switch resourceType(resourceID) {
+	case "instance":
+		_, ok := b.instances[resourceID]
+		return ok
+	case "volume":
+		_, ok := b.volumes[resourceID]
+		return ok
+	case "network-interface":
+		_, ok := b.interfaces[resourceID]
+		return ok
+	case "elastic-ip":
+		_, ok := b.addresses[resourceID]
+		return ok
+	case "snapshot":
+		_, ok := b.snapshots[resourceID]
+		return ok
+	}
+	return false
+}
+
+// newID returns a new resource ID such as i-0123456789abcdef0.
+func (b *Backend) newID(prefix string) string {
+	b.nextID++
+	return fmt.Sprintf("%s-%017x", prefix, b.nextID)
+}
+
+// newUUID returns a new ID formatted like a UUID, for messages and requests.
+func (b *Backend) newUUID() string {
+	b.nextID++
+	return fmt.Sprintf("00000000-0000-4000-8000-%012x", b.nextID)
+}
+
+// resourceType returns the EC2 resource type of an ID by its prefix.
+func resourceType(resourceID string) string {
+	switch {
+	case strings.HasPrefix(resourceID, "i-"):
+		return "instance"
+	case strings.HasPrefix(resourceID, "vol-"):
+		return "volume"
+	case strings.HasPrefix(resourceID, "eni-"):
+		return "network-interface"
+	case strings.HasPrefix(resourceID, "eipalloc-"):
+		return "elastic-ip"
+	case strings.HasPrefix(resourceID, "snap-"):
+		return "snapshot"
+	}
+	return ""
+}
+
+func copyTags(tags map[string]string) map[string]string {
+	c := make(map[string]string, len(tags))
+	for k, v := range tags {
+		c[k] = v
+	}
+	return c
+}
+
+func removeString(s []string, r string) []string {
+	var result []string
+	for _, v := range s {
+		if v != r {
+			result = append(result, v)
+		}
+	}
+	return result
+}
@@ -0,0 +1,173 @@
+package tagdtest
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// DynamoDB is a fake DynamoDB client of a Backend, for tables with a string
+// partition key. Calls tagd doesn't make panic.
+type DynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	backend *Backend
+}
+
+var _ dynamodbiface.DynamoDBAPI = (*DynamoDB)(nil)
+
+type table struct {
+	name    string
+	hashKey string
+	items   map[string]item
+}
+
+// DynamoDB returns a DynamoDB client of the Backend.
+func (b *Backend) DynamoDB() *DynamoDB {
+	return &DynamoDB{backend: b}
+}
+
+// CreateTable creates a table, if it doesn't exist, with the string partition key hashKey.
+func (b *Backend) CreateTable(name, hashKey string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.tables[name]; !ok {
+		b.tables[name] = &table{name: name, hashKey: hashKey, items: make(map[string]item)}
+	}
+}
+
+// Item returns the string and number attributes of the item with the partition
+// key key, or nil if there is none.
+func (b *Backend) Item(tableName, key string) map[string]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, ok := b.tables[tableName]
+	if !ok {
+		return nil
+	}
+	it, ok := t.items[key]
+	if !ok {
+		return nil
+	}
+	attrs := make(map[string]string, len(it))
+	for k, v := range it {
+		switch {
+		case v.S != nil:
+			attrs[k] = *v.S
+		case v.N != nil:
+			attrs[k] = *v.N
+		}
+	}
+	return attrs
+}
+
+// PutItemWithContext creates or replaces an item if the ConditionExpression holds.
+func (c *DynamoDB) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	b := c.backend
+	if err := b.call(ctx, "PutItem"); err != nil {
+		return nil, err
+	}
+	cond, err := parseCondition(input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, err := b.table(aws.StringValue(input.TableName))
+	if err != nil {
+		return nil, err
+	}
+	key, err := t.key(input.Item)
+	if err != nil {
+		return nil, err
+	}
+	if cond != nil && !cond.eval(t.items[key]) {
+		return nil, conditionFailed()
+	}
+	t.items[key] = copyItem(input.Item)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+// GetItemWithContext returns an item by its key. Reads are always consistent.
+func (c *DynamoDB) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	b := c.backend
+	if err := b.call(ctx, "GetItem"); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, err := b.table(aws.StringValue(input.TableName))
+	if err != nil {
+		return nil, err
+	}
+	key, err := t.key(input.Key)
+	if err != nil {
+		return nil, err
+	}
+	out := &dynamodb.GetItemOutput{}
+	if it, ok := t.items[key]; ok {
+		out.Item = copyItem(it)
+	}
+	return out, nil
+}
+
+// DeleteItemWithContext deletes an item if the ConditionExpression holds.
+// Deleting a missing item succeeds unless the condition fails.
+func (c *DynamoDB) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	b := c.backend
+	if err := b.call(ctx, "DeleteItem"); err != nil {
+		return nil, err
+	}
+	cond, err := parseCondition(input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, err := b.table(aws.StringValue(input.TableName))
+	if err != nil {
+		return nil, err
+	}
+	key, err := t.key(input.Key)
+	if err != nil {
+		return nil, err
+	}
+	if cond != nil && !cond.eval(t.items[key]) {
+		return nil, conditionFailed()
+	}
+	delete(t.items, key)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func (b *Backend) table(name string) (*table, error) {
+	t, ok := b.tables[name]
+	if !ok {
+		return nil, awserr.New(dynamodb.ErrCodeResourceNotFoundException, "Requested resource not found", nil)
+	}
+	return t, nil
+}
+
+// key returns the partition key of an item or key.
+func (t *table) key(it map[string]*dynamodb.AttributeValue) (string, error) {
+	v, ok := it[t.hashKey]
+	if !ok || v.S == nil {
+		return "", awserr.New(errCodeValidation, fmt.Sprintf("One of the required keys was not given a value: %s", t.hashKey), nil)
+	}
+	return *v.S, nil
+}
+
+func conditionFailed() error {
+	return awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+}
+
+func copyItem(it map[string]*dynamodb.AttributeValue) item {
+	c := make(item, len(it))
+	for k, v := range it {
+		copied := *v
+		c[k] = &copied
+	}
+	return c
+}
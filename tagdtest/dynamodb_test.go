@@ -0,0 +1,118 @@
+package tagdtest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestDynamoDBConditions(t *testing.T) {
+	b := NewBackend("", "")
+	b.CreateTable("t", "ID")
+	db := b.DynamoDB()
+	ctx := context.Background()
+	put := func(cond string, names map[string]*string, values map[string]*dynamodb.AttributeValue) error {
+		input := &dynamodb.PutItemInput{
+			TableName: aws.String("t"),
+			Item: map[string]*dynamodb.AttributeValue{
+				"ID":    {S: aws.String("a")},
+				"Total": {N: aws.String("5")},
+				"Kind":  {S: aws.String("x")},
+			},
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: values,
+		}
+		if cond != "" {
+			input.ConditionExpression = aws.String(cond)
+		}
+		_, err := db.PutItemWithContext(ctx, input)
+		return err
+	}
+	n := func(v string) *dynamodb.AttributeValue { return &dynamodb.AttributeValue{N: aws.String(v)} }
+	s := func(v string) *dynamodb.AttributeValue { return &dynamodb.AttributeValue{S: aws.String(v)} }
+
+	if err := put("attribute_not_exists(ID)", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		cond   string
+		names  map[string]*string
+		values map[string]*dynamodb.AttributeValue
+		code   string
+	}{
+		{"attribute_not_exists(ID)", nil, nil, dynamodb.ErrCodeConditionalCheckFailedException},
+		{"attribute_exists(ID) AND Kind = :k", nil, map[string]*dynamodb.AttributeValue{":k": s("x")}, ""},
+		{"Kind <> :k", nil, map[string]*dynamodb.AttributeValue{":k": s("x")}, dynamodb.ErrCodeConditionalCheckFailedException},
+		{"#c < :n OR Kind = :k", map[string]*string{"#c": aws.String("Total")}, map[string]*dynamodb.AttributeValue{":n": n("10"), ":k": s("y")}, ""},
+		{"NOT (#c >= :n)", map[string]*string{"#c": aws.String("Total")}, map[string]*dynamodb.AttributeValue{":n": n("10")}, ""},
+		{"Total < :n", nil, map[string]*dynamodb.AttributeValue{":n": n("1")}, dynamodb.ErrCodeConditionalCheckFailedException},
+		// Numbers compare as numbers, not strings
+		{"Total < :n", nil, map[string]*dynamodb.AttributeValue{":n": n("10")}, ""},
+		{"Owner = :o", nil, map[string]*dynamodb.AttributeValue{":o": s("me")}, errCodeValidation},
+		{"Kind = :k", nil, map[string]*dynamodb.AttributeValue{":k": s("x"), ":unused": s("y")}, errCodeValidation},
+		{"Kind = :k", map[string]*string{"#unused": aws.String("Kind")}, map[string]*dynamodb.AttributeValue{":k": s("x")}, errCodeValidation},
+		{"Kind = :missing", nil, nil, errCodeValidation},
+		{"Kind = ", nil, nil, errCodeValidation},
+		{"", nil, map[string]*dynamodb.AttributeValue{":k": s("x")}, errCodeValidation},
+	}
+	for _, tt := range tests {
+		err := put(tt.cond, tt.names, tt.values)
+		code := ""
+		if aerr, ok := err.(awserr.Error); ok {
+			code = aerr.Code()
+		} else if err != nil {
+			t.Fatalf("%q: unexpected error %v", tt.cond, err)
+		}
+		if code != tt.code {
+			t.Errorf("%q: error = %v, want code %q", tt.cond, err, tt.code)
+		}
+	}
+}
+
+func TestDynamoDBGetAndDelete(t *testing.T) {
+	b := NewBackend("", "")
+	b.CreateTable("t", "ID")
+	db := b.DynamoDB()
+	ctx := context.Background()
+	key := map[string]*dynamodb.AttributeValue{"ID": {S: aws.String("a")}}
+
+	out, err := db.GetItemWithContext(ctx, &dynamodb.GetItemInput{TableName: aws.String("t"), Key: key})
+	if err != nil || out.Item != nil {
+		t.Fatalf("GetItem of a missing item = %v, %v", out.Item, err)
+	}
+	_, err = db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String("t"),
+		Item:      map[string]*dynamodb.AttributeValue{"ID": {S: aws.String("a")}, "V": {S: aws.String("1")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = db.GetItemWithContext(ctx, &dynamodb.GetItemInput{TableName: aws.String("t"), Key: key})
+	if err != nil || aws.StringValue(out.Item["V"].S) != "1" {
+		t.Fatalf("GetItem = %v, %v", out.Item, err)
+	}
+
+	_, err = db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName:                 aws.String("t"),
+		Key:                       key,
+		ConditionExpression:       aws.String("V = :v"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":v": {S: aws.String("2")}},
+	})
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+		t.Fatalf("conditional DeleteItem error = %v", err)
+	}
+	if _, err := db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{TableName: aws.String("t"), Key: key}); err != nil {
+		t.Fatal(err)
+	}
+	if item := b.Item("t", "a"); item != nil {
+		t.Errorf("item left after DeleteItem: %v", item)
+	}
+
+	_, err = db.GetItemWithContext(ctx, &dynamodb.GetItemInput{TableName: aws.String("missing"), Key: key})
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != dynamodb.ErrCodeResourceNotFoundException {
+		t.Errorf("GetItem of a missing table error = %v", err)
+	}
+}
@@ -0,0 +1,574 @@
+package tagdtest
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// EC2 is a fake EC2 client of a Backend. Calls tagd doesn't make panic.
+type EC2 struct {
+	ec2iface.EC2API
+	backend *Backend
+}
+
+var _ ec2iface.EC2API = (*EC2)(nil)
+
+// DescribeTagsWithContext supports the resource-id, resource-type, key and value filters.
+func (c *EC2) DescribeTagsWithContext(ctx aws.Context, input *ec2.DescribeTagsInput, opts ...request.Option) (*ec2.DescribeTagsOutput, error) {
+	b := c.backend
+	if err := b.call(ctx, "DescribeTags"); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ids := make([]string, 0, len(b.tags))
+	for id := range b.tags {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	out := &ec2.DescribeTagsOutput{}
+	for _, id := range ids {
+		tags := b.tags[id]
+		for _, k := range sortedKeys(tags) {
+			v := tags[k]
+			ok, err := matchFilters(input.Filters, func(name string) ([]string, bool) {
+				switch name {
+				case "resource-id":
+					return []string{id}, true
+				case "resource-type":
+					return []string{resourceType(id)}, true
+				case "key":
+					return []string{k}, true
+				case "value":
+					return []string{v}, true
+				}
+				return nil, false
+			})
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				out.Tags = append(out.Tags, &ec2.TagDescription{
+					ResourceId:   aws.String(id),
+					ResourceType: aws.String(resourceType(id)),
+					Key:          aws.String(k),
+					Value:        aws.String(v),
+				})
+			}
+		}
+	}
+	return out, nil
+}
+
+// DescribeTagsPagesWithContext returns all tags in a single page.
+func (c *EC2) DescribeTagsPagesWithContext(ctx aws.Context, input *ec2.DescribeTagsInput, fn func(*ec2.DescribeTagsOutput, bool) bool, opts ...request.Option) error {
+	out, err := c.DescribeTagsWithContext(ctx, input, opts...)
+	if err != nil {
+		return err
+	}
+	fn(out, true)
+	return nil
+}
+
+// CreateTagsWithContext fails for missing resources and tag keys with the
+// reserved aws: prefix, without tagging any resource.
+func (c *EC2) CreateTagsWithContext(ctx aws.Context, input *ec2.CreateTagsInput, opts ...request.Option) (*ec2.CreateTagsOutput, error) {
+	b := c.backend
+	if err := b.call(ctx, "CreateTags"); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, t := range input.Tags {
+		if strings.HasPrefix(aws.StringValue(t.Key), reservedTagPrefix) {
+			return nil, awserr.New("InvalidParameterValue", fmt.Sprintf("Tag keys starting with '%s' are reserved for internal use", reservedTagPrefix), nil)
+		}
+	}
+	for _, id := range aws.StringValueSlice(input.Resources) {
+		if !b.exists(id) {
+			return nil, notFound(id)
+		}
+	}
+	for _, id := range aws.StringValueSlice(input.Resources) {
+		for _, t := range input.Tags {
+			b.tags[id][aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+		}
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+// DeleteTagsWithContext deletes tags by key, or only if their value matches when
+// a value is given, like EC2.
+func (c *EC2) DeleteTagsWithContext(ctx aws.Context, input *ec2.DeleteTagsInput, opts ...request.Option) (*ec2.DeleteTagsOutput, error) {
+	b := c.backend
+	if err := b.call(ctx, "DeleteTags"); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, id := range aws.StringValueSlice(input.Resources) {
+		if !b.exists(id) {
+			return nil, notFound(id)
+		}
+	}
+	for _, id := range aws.StringValueSlice(input.Resources) {
+		tags := b.tags[id]
+		for _, t := range input.Tags {
+			k := aws.StringValue(t.Key)
+			if t.Value != nil && tags[k] != aws.StringValue(t.Value) {
+				continue
+			}
+			delete(tags, k)
+		}
+	}
+	return &ec2.DeleteTagsOutput{}, nil
+}
+
+// DescribeInstancesWithContext returns each instance in a reservation of its own.
+// It supports the instance-id, instance-state-name and tag filters.
+func (c *EC2) DescribeInstancesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	b := c.backend
+	if err := b.call(ctx, "DescribeInstances"); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ids, err := b.selectIDs(aws.StringValueSlice(input.InstanceIds), b.instanceIDs())
+	if err != nil {
+		return nil, err
+	}
+	out := &ec2.DescribeInstancesOutput{}
+	for _, id := range ids {
+		inst := b.instances[id]
+		ok, err := matchFilters(input.Filters, func(name string) ([]string, bool) {
+			switch name {
+			case "instance-id":
+				return []string{id}, true
+			case "instance-state-name":
+				return []string{inst.state}, true
+			}
+			return tagAttributes(b.tags[id], name)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			out.Reservations = append(out.Reservations, &ec2.Reservation{
+				ReservationId: aws.String("r-" + strings.TrimPrefix(id, "i-")),
+				OwnerId:       aws.String(b.account),
+				Instances:     []*ec2.Instance{b.describeInstance(inst)},
+			})
+		}
+	}
+	return out, nil
+}
+
+func (b *Backend) describeInstance(inst *instance) *ec2.Instance {
+	stateCode := int64(16)
+	if inst.state == "terminated" {
+		stateCode = 48
+	}
+	out := &ec2.Instance{
+		InstanceId:     aws.String(inst.id),
+		State:          &ec2.InstanceState{Name: aws.String(inst.state), Code: aws.Int64(stateCode)},
+		LaunchTime:     aws.Time(inst.launched),
+		RootDeviceName: aws.String(inst.rootDevice),
+		RootDeviceType: aws.String(ec2.DeviceTypeEbs),
+		Tags:           ec2Tags(b.tags[inst.id]),
+	}
+	for _, vol := range b.attached(inst.id) {
+		out.BlockDeviceMappings = append(out.BlockDeviceMappings, &ec2.InstanceBlockDeviceMapping{
+			DeviceName: aws.String(vol.device),
+			Ebs: &ec2.EbsInstanceBlockDevice{
+				VolumeId:            aws.String(vol.id),
+				Status:              aws.String(ec2.AttachmentStatusAttached),
+				DeleteOnTermination: aws.Bool(!vol.keepOnTermination),
+				AttachTime:          aws.Time(vol.created),
+			},
+		})
+	}
+	return out
+}
+
+// DescribeVolumesWithContext supports the volume-id, status, volume-type, size,
+// attachment.instance-id, attachment.device, attachment.status and tag filters.
+func (c *EC2) DescribeVolumesWithContext(ctx aws.Context, input *ec2.DescribeVolumesInput, opts ...request.Option) (*ec2.DescribeVolumesOutput, error) {
+	b := c.backend
+	if err := b.call(ctx, "DescribeVolumes"); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	all := make([]string, 0, len(b.volumes))
+	for id := range b.volumes {
+		all = append(all, id)
+	}
+	ids, err := b.selectIDs(aws.StringValueSlice(input.VolumeIds), all)
+	if err != nil {
+		return nil, err
+	}
+	out := &ec2.DescribeVolumesOutput{}
+	for _, id := range ids {
+		vol := b.volumes[id]
+		state, attachState := ec2.VolumeStateAvailable, ""
+		if vol.instanceID != "" {
+			state, attachState = ec2.VolumeStateInUse, ec2.VolumeAttachmentStateAttached
+		}
+		ok, err := matchFilters(input.Filters, func(name string) ([]string, bool) {
+			switch name {
+			case "volume-id":
+				return []string{id}, true
+			case "status":
+				return []string{state}, true
+			case "volume-type":
+				return []string{vol.volumeType}, true
+			case "size":
+				return []string{strconv.FormatInt(vol.size, 10)}, true
+			case "attachment.instance-id":
+				return values(vol.instanceID), true
+			case "attachment.device":
+				return values(vol.device), true
+			case "attachment.status":
+				return values(attachState), true
+			}
+			return tagAttributes(b.tags[id], name)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		v := &ec2.Volume{
+			VolumeId:   aws.String(id),
+			Size:       aws.Int64(vol.size),
+			VolumeType: aws.String(vol.volumeType),
+			State:      aws.String(state),
+			CreateTime: aws.Time(vol.created),
+			Tags:       ec2Tags(b.tags[id]),
+		}
+		if vol.instanceID != "" {
+			v.Attachments = []*ec2.VolumeAttachment{{
+				VolumeId:            aws.String(id),
+				InstanceId:          aws.String(vol.instanceID),
+				Device:              aws.String(vol.device),
+				State:               aws.String(attachState),
+				DeleteOnTermination: aws.Bool(!vol.keepOnTermination),
+				AttachTime:          aws.Time(vol.created),
+			}}
+		}
+		out.Volumes = append(out.Volumes, v)
+	}
+	return out, nil
+}
+
+// DescribeVolumesPagesWithContext returns all volumes in a single page.
+func (c *EC2) DescribeVolumesPagesWithContext(ctx aws.Context, input *ec2.DescribeVolumesInput, fn func(*ec2.DescribeVolumesOutput, bool) bool, opts ...request.Option) error {
+	out, err := c.DescribeVolumesWithContext(ctx, input, opts...)
+	if err != nil {
+		return err
+	}
+	fn(out, true)
+	return nil
+}
+
+// DeleteVolumeWithContext deletes an available volume.
+func (c *EC2) DeleteVolumeWithContext(ctx aws.Context, input *ec2.DeleteVolumeInput, opts ...request.Option) (*ec2.DeleteVolumeOutput, error) {
+	b := c.backend
+	if err := b.call(ctx, "DeleteVolume"); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := aws.StringValue(input.VolumeId)
+	vol, ok := b.volumes[id]
+	if !ok {
+		return nil, notFound(id)
+	}
+	if vol.instanceID != "" {
+		return nil, awserr.New("VolumeInUse", fmt.Sprintf("Volume %s is currently attached to %s", id, vol.instanceID), nil)
+	}
+	delete(b.volumes, id)
+	delete(b.tags, id)
+	return &ec2.DeleteVolumeOutput{}, nil
+}
+
+// DescribeNetworkInterfacesWithContext supports the network-interface-id,
+// attachment.instance-id and tag filters.
+func (c *EC2) DescribeNetworkInterfacesWithContext(ctx aws.Context, input *ec2.DescribeNetworkInterfacesInput, opts ...request.Option) (*ec2.DescribeNetworkInterfacesOutput, error) {
+	b := c.backend
+	if err := b.call(ctx, "DescribeNetworkInterfaces"); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	all := make([]string, 0, len(b.interfaces))
+	for id := range b.interfaces {
+		all = append(all, id)
+	}
+	ids, err := b.selectIDs(aws.StringValueSlice(input.NetworkInterfaceIds), all)
+	if err != nil {
+		return nil, err
+	}
+	out := &ec2.DescribeNetworkInterfacesOutput{}
+	for _, id := range ids {
+		eni := b.interfaces[id]
+		ok, err := matchFilters(input.Filters, func(name string) ([]string, bool) {
+			switch name {
+			case "network-interface-id":
+				return []string{id}, true
+			case "attachment.instance-id":
+				return values(eni.instanceID), true
+			}
+			return tagAttributes(b.tags[id], name)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			out.NetworkInterfaces = append(out.NetworkInterfaces, &ec2.NetworkInterface{
+				NetworkInterfaceId: aws.String(id),
+				Attachment: &ec2.NetworkInterfaceAttachment{
+					InstanceId:   aws.String(eni.instanceID),
+					DeviceIndex:  aws.Int64(0),
+					Status:       aws.String(ec2.AttachmentStatusAttached),
+					AttachmentId: aws.String("eni-attach-" + strings.TrimPrefix(id, "eni-")),
+				},
+				TagSet: ec2Tags(b.tags[id]),
+			})
+		}
+	}
+	return out, nil
+}
+
+// DescribeAddressesWithContext supports the allocation-id, instance-id,
+// public-ip and tag filters.
+func (c *EC2) DescribeAddressesWithContext(ctx aws.Context, input *ec2.DescribeAddressesInput, opts ...request.Option) (*ec2.DescribeAddressesOutput, error) {
+	b := c.backend
+	if err := b.call(ctx, "DescribeAddresses"); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	all := make([]string, 0, len(b.addresses))
+	for id := range b.addresses {
+		all = append(all, id)
+	}
+	ids, err := b.selectIDs(aws.StringValueSlice(input.AllocationIds), all)
+	if err != nil {
+		return nil, err
+	}
+	out := &ec2.DescribeAddressesOutput{}
+	for _, id := range ids {
+		addr := b.addresses[id]
+		ok, err := matchFilters(input.Filters, func(name string) ([]string, bool) {
+			switch name {
+			case "allocation-id":
+				return []string{id}, true
+			case "instance-id":
+				return values(addr.instanceID), true
+			case "public-ip":
+				return []string{addr.publicIP}, true
+			}
+			return tagAttributes(b.tags[id], name)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		a := &ec2.Address{
+			AllocationId: aws.String(id),
+			PublicIp:     aws.String(addr.publicIP),
+			Domain:       aws.String(ec2.DomainTypeVpc),
+			Tags:         ec2Tags(b.tags[id]),
+		}
+		if addr.instanceID != "" {
+			a.InstanceId = aws.String(addr.instanceID)
+		}
+		out.Addresses = append(out.Addresses, a)
+	}
+	return out, nil
+}
+
+// DescribeSnapshotsWithContext returns the Backend's snapshots for the owner
+// self or the Backend's account, and supports the snapshot-id, volume-id,
+// status and tag filters.
+func (c *EC2) DescribeSnapshotsWithContext(ctx aws.Context, input *ec2.DescribeSnapshotsInput, opts ...request.Option) (*ec2.DescribeSnapshotsOutput, error) {
+	b := c.backend
+	if err := b.call(ctx, "DescribeSnapshots"); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.describeSnapshots(input)
+}
+
+func (b *Backend) describeSnapshots(input *ec2.DescribeSnapshotsInput) (*ec2.DescribeSnapshotsOutput, error) {
+	out := &ec2.DescribeSnapshotsOutput{}
+	for _, owner := range aws.StringValueSlice(input.OwnerIds) {
+		if owner != "self" && owner != b.account {
+			return out, nil
+		}
+	}
+	all := make([]string, 0, len(b.snapshots))
+	for id := range b.snapshots {
+		all = append(all, id)
+	}
+	ids, err := b.selectIDs(aws.StringValueSlice(input.SnapshotIds), all)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		snap := b.snapshots[id]
+		ok, err := matchFilters(input.Filters, func(name string) ([]string, bool) {
+			switch name {
+			case "snapshot-id":
+				return []string{id}, true
+			case "volume-id":
+				return []string{snap.volumeID}, true
+			case "status":
+				return []string{ec2.SnapshotStateCompleted}, true
+			}
+			return tagAttributes(b.tags[id], name)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			out.Snapshots = append(out.Snapshots, &ec2.Snapshot{
+				SnapshotId:  aws.String(id),
+				VolumeId:    aws.String(snap.volumeID),
+				VolumeSize:  aws.Int64(snap.size),
+				Description: aws.String(snap.description),
+				State:       aws.String(ec2.SnapshotStateCompleted),
+				Progress:    aws.String("100%"),
+				StartTime:   aws.Time(snap.started),
+				OwnerId:     aws.String(b.account),
+				Tags:        ec2Tags(b.tags[id]),
+			})
+		}
+	}
+	return out, nil
+}
+
+// DescribeSnapshotsPagesWithContext returns all snapshots in a single page.
+func (c *EC2) DescribeSnapshotsPagesWithContext(ctx aws.Context, input *ec2.DescribeSnapshotsInput, fn func(*ec2.DescribeSnapshotsOutput, bool) bool, opts ...request.Option) error {
+	out, err := c.DescribeSnapshotsWithContext(ctx, input, opts...)
+	if err != nil {
+		return err
+	}
+	fn(out, true)
+	return nil
+}
+
+// CreateSnapshotWithContext creates a snapshot that is completed right away,
+// tagged with the snapshot TagSpecifications.
+func (c *EC2) CreateSnapshotWithContext(ctx aws.Context, input *ec2.CreateSnapshotInput, opts ...request.Option) (*ec2.Snapshot, error) {
+	b := c.backend
+	if err := b.call(ctx, "CreateSnapshot"); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := aws.StringValue(input.VolumeId)
+	vol, ok := b.volumes[id]
+	if !ok {
+		return nil, notFound(id)
+	}
+	snap := b.createSnapshot(vol, "", aws.StringValue(input.Description))
+	for _, spec := range input.TagSpecifications {
+		if aws.StringValue(spec.ResourceType) != ec2.ResourceTypeSnapshot {
+			continue
+		}
+		for _, t := range spec.Tags {
+			b.tags[snap.id][aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+		}
+	}
+	return &ec2.Snapshot{
+		SnapshotId:  aws.String(snap.id),
+		VolumeId:    aws.String(id),
+		VolumeSize:  aws.Int64(snap.size),
+		Description: aws.String(snap.description),
+		State:       aws.String(ec2.SnapshotStatePending),
+		StartTime:   aws.Time(snap.started),
+		OwnerId:     aws.String(b.account),
+		Tags:        ec2Tags(b.tags[snap.id]),
+	}, nil
+}
+
+// WaitUntilSnapshotCompletedWithContext returns once the snapshots exist, as
+// they complete right away.
+func (c *EC2) WaitUntilSnapshotCompletedWithContext(ctx aws.Context, input *ec2.DescribeSnapshotsInput, opts ...request.WaiterOption) error {
+	b := c.backend
+	if err := b.call(ctx, "DescribeSnapshots"); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, err := b.describeSnapshots(input)
+	return err
+}
+
+// selectIDs returns the requested IDs, which must all exist, or all IDs if none
+// are requested, sorted.
+func (b *Backend) selectIDs(requested, all []string) ([]string, error) {
+	if len(requested) == 0 {
+		sort.Strings(all)
+		return all, nil
+	}
+	for _, id := range requested {
+		if !b.exists(id) {
+			return nil, notFound(id)
+		}
+	}
+	ids := append([]string(nil), requested...)
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (b *Backend) instanceIDs() []string {
+	ids := make([]string, 0, len(b.instances))
+	for id := range b.instances {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func ec2Tags(tags map[string]string) []*ec2.Tag {
+	if len(tags) == 0 {
+		return nil
+	}
+	result := make([]*ec2.Tag, 0, len(tags))
+	for _, k := range sortedKeys(tags) {
+		result = append(result, &ec2.Tag{Key: aws.String(k), Value: aws.String(tags[k])})
+	}
+	return result
+}
+
+func sortedKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,106 @@
+package tagdtest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func errorCode(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	return ""
+}
+
+func TestEC2VolumeFilters(t *testing.T) {
+	b := NewBackend("", "")
+	if err := b.CreateASG("web", nil); err != nil {
+		t.Fatal(err)
+	}
+	id, err := b.LaunchInstance("web", InstanceSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := b.Volumes(id)[0]
+	spare := b.CreateVolume(VolumeSpec{Size: 100, Tags: map[string]string{"team": "db"}})
+
+	tests := []struct {
+		name   string
+		filter *ec2.Filter
+		want   []string
+	}{
+		{"attached", &ec2.Filter{Name: aws.String("attachment.instance-id"), Values: aws.StringSlice([]string{id})}, []string{root}},
+		{"available", &ec2.Filter{Name: aws.String("status"), Values: aws.StringSlice([]string{"available"})}, []string{spare}},
+		{"device", &ec2.Filter{Name: aws.String("attachment.device"), Values: aws.StringSlice([]string{"/dev/xvd*"})}, []string{root}},
+		{"tag", &ec2.Filter{Name: aws.String("tag:team"), Values: aws.StringSlice([]string{"d*"})}, []string{spare}},
+		{"tag-key", &ec2.Filter{Name: aws.String("tag-key"), Values: aws.StringSlice([]string{"team"})}, []string{spare}},
+		{"size", &ec2.Filter{Name: aws.String("size"), Values: aws.StringSlice([]string{"100"})}, []string{spare}},
+	}
+	for _, tt := range tests {
+		out, err := b.EC2().DescribeVolumesWithContext(context.Background(), &ec2.DescribeVolumesInput{Filters: []*ec2.Filter{tt.filter}})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var got []string
+		for _, v := range out.Volumes {
+			got = append(got, aws.StringValue(v.VolumeId))
+		}
+		if len(got) != len(tt.want) || (len(got) > 0 && got[0] != tt.want[0]) {
+			t.Errorf("%s: volumes = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	_, err = b.EC2().DescribeVolumesWithContext(context.Background(), &ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{{Name: aws.String("encrypted"), Values: aws.StringSlice([]string{"true"})}},
+	})
+	if errorCode(err) != "InvalidParameterValue" {
+		t.Errorf("unsupported filter error = %v, want InvalidParameterValue", err)
+	}
+	_, err = b.EC2().DescribeVolumesWithContext(context.Background(), &ec2.DescribeVolumesInput{VolumeIds: aws.StringSlice([]string{"vol-missing"})})
+	if errorCode(err) != "InvalidVolume.NotFound" {
+		t.Errorf("missing volume error = %v, want InvalidVolume.NotFound", err)
+	}
+}
+
+func TestEC2CreateTags(t *testing.T) {
+	b := NewBackend("", "")
+	vol := b.CreateVolume(VolumeSpec{})
+	svc := b.EC2()
+	ctx := context.Background()
+
+	_, err := svc.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: aws.StringSlice([]string{vol}),
+		Tags:      []*ec2.Tag{{Key: aws.String("aws:owner"), Value: aws.String("x")}},
+	})
+	if errorCode(err) != "InvalidParameterValue" {
+		t.Errorf("aws: tag key error = %v, want InvalidParameterValue", err)
+	}
+	_, err = svc.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: aws.StringSlice([]string{vol, "vol-missing"}),
+		Tags:      []*ec2.Tag{{Key: aws.String("team"), Value: aws.String("web")}},
+	})
+	if errorCode(err) != "InvalidVolume.NotFound" {
+		t.Errorf("missing resource error = %v, want InvalidVolume.NotFound", err)
+	}
+	if tags := b.Tags(vol); len(tags) != 0 {
+		t.Errorf("tags after failed calls = %v, want none", tags)
+	}
+
+	_, err = svc.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: aws.StringSlice([]string{vol}),
+		Tags:      []*ec2.Tag{{Key: aws.String("team"), Value: aws.String("web")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := svc.DescribeTagsWithContext(ctx, &ec2.DescribeTagsInput{
+		Filters: []*ec2.Filter{{Name: aws.String("resource-id"), Values: aws.StringSlice([]string{vol})}},
+	})
+	if err != nil || len(out.Tags) != 1 || aws.StringValue(out.Tags[0].Value) != "web" {
+		t.Errorf("DescribeTags() = %v, %v", out, err)
+	}
+}
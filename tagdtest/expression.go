@@ -0,0 +1,353 @@
+package tagdtest
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const errCodeValidation = "ValidationException"
+
+// reservedWords are some of DynamoDB's reserved words, which can't be used as
+// attribute names in expressions without ExpressionAttributeNames.
+var reservedWords = map[string]bool{
+	"ACTION": true, "ADD": true, "ALL": true, "AND": true, "ATTRIBUTE": true, "BETWEEN": true,
+	"BY": true, "COUNT": true, "DATA": true, "DATE": true, "DELETE": true, "EXISTS": true,
+	"FROM": true, "GROUP": true, "IN": true, "INDEX": true, "KEY": true, "LIMIT": true,
+	"NAME": true, "NOT": true, "NULL": true, "OR": true, "ORDER": true, "OWNER": true,
+	"REGION": true, "SET": true, "SIZE": true, "STATE": true, "STATUS": true, "TABLE": true,
+	"TIME": true, "TIMESTAMP": true, "TTL": true, "TYPE": true, "USER": true, "VALUE": true,
+	"VALUES": true, "ZONE": true,
+}
+
+type item map[string]*dynamodb.AttributeValue
+
+// condition is a parsed ConditionExpression.
+type condition interface {
+	eval(it item) bool
+}
+
+type orCondition struct{ left, right condition }
+
+func (c orCondition) eval(it item) bool { return c.left.eval(it) || c.right.eval(it) }
+
+type andCondition struct{ left, right condition }
+
+func (c andCondition) eval(it item) bool { return c.left.eval(it) && c.right.eval(it) }
+
+type notCondition struct{ c condition }
+
+func (c notCondition) eval(it item) bool { return !c.c.eval(it) }
+
+type existsCondition struct {
+	name   string
+	exists bool
+}
+
+func (c existsCondition) eval(it item) bool {
+	_, ok := it[c.name]
+	return ok == c.exists
+}
+
+// operand is an attribute name or a value.
+type operand struct {
+	name  string
+	value *dynamodb.AttributeValue
+}
+
+func (o operand) resolve(it item) *dynamodb.AttributeValue {
+	if o.value != nil {
+		return o.value
+	}
+	return it[o.name]
+}
+
+type compareCondition struct {
+	op          string
+	left, right operand
+}
+
+// eval compares strings and numbers. Missing attributes and values of different
+// types compare false, except for <>.
+func (c compareCondition) eval(it item) bool {
+	l, r := c.left.resolve(it), c.right.resolve(it)
+	if l == nil || r == nil {
+		return false
+	}
+	var cmp int
+	switch {
+	case l.N != nil && r.N != nil:
+		ln, _ := strconv.ParseFloat(*l.N, 64)
+		rn, _ := strconv.ParseFloat(*r.N, 64)
+		switch {
+		case ln < rn:
+			cmp = -1
+		case ln > rn:
+			cmp = 1
+		}
+	case l.S != nil && r.S != nil:
+		cmp = strings.Compare(*l.S, *r.S)
+	default:
+		return c.op == "<>"
+	}
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case "<>":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	}
+	return cmp >= 0
+}
+
+// parseCondition parses a ConditionExpression with comparisons, AND, OR, NOT,
+// parentheses, attribute_exists and attribute_not_exists of top-level attributes.
+// Like DynamoDB, it rejects reserved words used as attribute names, undefined
+// and unused ExpressionAttributeNames and ExpressionAttributeValues.
+func parseCondition(expr *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (condition, error) {
+	if expr == nil {
+		if len(names) > 0 || len(values) > 0 {
+			return nil, awserr.New(errCodeValidation, "ExpressionAttributeNames and ExpressionAttributeValues can only be specified when using expressions", nil)
+		}
+		return nil, nil
+	}
+	tokens, err := tokenize(*expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{
+		tokens:     tokens,
+		names:      names,
+		values:     values,
+		usedNames:  make(map[string]bool),
+		usedValues: make(map[string]bool),
+	}
+	c, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, invalidExpression("unexpected token %s", p.tokens[p.pos])
+	}
+	if unused := unusedKeys(names, p.usedNames); unused != "" {
+		return nil, awserr.New(errCodeValidation, "Value provided in ExpressionAttributeNames unused in expressions: keys: {"+unused+"}", nil)
+	}
+	if unused := unusedValueKeys(values, p.usedValues); unused != "" {
+		return nil, awserr.New(errCodeValidation, "Value provided in ExpressionAttributeValues unused in expressions: keys: {"+unused+"}", nil)
+	}
+	return c, nil
+}
+
+func tokenize(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')' || c == '=':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '<' || c == '>':
+			if i+1 < len(expr) && (expr[i+1] == '=' || (c == '<' && expr[i+1] == '>')) {
+				tokens = append(tokens, expr[i:i+2])
+				i += 2
+			} else {
+				tokens = append(tokens, string(c))
+				i++
+			}
+		case c == '#' || c == ':' || isWordChar(c):
+			j := i + 1
+			for j < len(expr) && isWordChar(expr[j]) {
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		default:
+			return nil, invalidExpression("unexpected character %q", c)
+		}
+	}
+	return tokens, nil
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+type parser struct {
+	tokens     []string
+	pos        int
+	names      map[string]*string
+	values     map[string]*dynamodb.AttributeValue
+	usedNames  map[string]bool
+	usedValues map[string]bool
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *parser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *parser) expect(token string) error {
+	if t := p.next(); t != token {
+		return invalidExpression("expected %s, found %q", token, t)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (condition, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orCondition{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (condition, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "AND") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andCondition{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (condition, error) {
+	switch t := p.peek(); {
+	case strings.EqualFold(t, "NOT"):
+		p.next()
+		c, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notCondition{c}, nil
+	case t == "(":
+		p.next()
+		c, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return c, p.expect(")")
+	case t == "attribute_exists" || t == "attribute_not_exists":
+		p.next()
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		name, err := p.parseName()
+		if err != nil {
+			return nil, err
+		}
+		return existsCondition{name: name, exists: t == "attribute_exists"}, p.expect(")")
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	op := p.next()
+	switch op {
+	case "=", "<>", "<", "<=", ">", ">=":
+	default:
+		return nil, invalidExpression("expected a comparison, found %q", op)
+	}
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return compareCondition{op: op, left: left, right: right}, nil
+}
+
+// parseName parses an attribute name, resolving #names.
+func (p *parser) parseName() (string, error) {
+	t := p.next()
+	switch {
+	case t == "":
+		return "", invalidExpression("unexpected end of expression")
+	case strings.HasPrefix(t, "#"):
+		name, ok := p.names[t]
+		if !ok {
+			return "", awserr.New(errCodeValidation, "An expression attribute name used in the document path is not defined; attribute name: "+t, nil)
+		}
+		p.usedNames[t] = true
+		return aws.StringValue(name), nil
+	case strings.HasPrefix(t, ":") || !isWordChar(t[0]):
+		return "", invalidExpression("expected an attribute name, found %q", t)
+	case reservedWords[strings.ToUpper(t)]:
+		return "", awserr.New(errCodeValidation, "Invalid ConditionExpression: Attribute name is a reserved keyword; reserved keyword: "+t, nil)
+	}
+	return t, nil
+}
+
+func (p *parser) parseOperand() (operand, error) {
+	t := p.peek()
+	if !strings.HasPrefix(t, ":") {
+		name, err := p.parseName()
+		return operand{name: name}, err
+	}
+	p.next()
+	v, ok := p.values[t]
+	if !ok {
+		return operand{}, awserr.New(errCodeValidation, "An expression attribute value used in expression is not defined; attribute value: "+t, nil)
+	}
+	p.usedValues[t] = true
+	return operand{value: v}, nil
+}
+
+func invalidExpression(format string, args ...interface{}) error {
+	return awserr.New(errCodeValidation, "Invalid ConditionExpression: "+fmt.Sprintf(format, args...), nil)
+}
+
+func unusedKeys(names map[string]*string, used map[string]bool) string {
+	var unused []string
+	for k := range names {
+		if !used[k] {
+			unused = append(unused, k)
+		}
+	}
+	sort.Strings(unused)
+	return strings.Join(unused, ", ")
+}
+
+func unusedValueKeys(values map[string]*dynamodb.AttributeValue, used map[string]bool) string {
+	var unused []string
+	for k := range values {
+		if !used[k] {
+			unused = append(unused, k)
+		}
+	}
+	sort.Strings(unused)
+	return strings.Join(unused, ", ")
+}
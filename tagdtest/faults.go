@@ -0,0 +1,111 @@
+package tagdtest
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// Fault makes calls of an operation fail or hang.
+type Fault struct {
+	// Err is returned by the call instead of its result, after Delay. The call
+	// succeeds after Delay if Err is nil.
+	Err error
+	// Delay holds the call, e.g. to simulate a slow or hung call. If the call's
+	// context is cancelled first, it returns a RequestCanceled error like the SDK.
+	Delay time.Duration
+	// Times is the number of calls the Fault applies to, every call if 0.
+	Times int
+}
+
+// InjectFault applies a Fault to the calls of op, the name of the API operation
+// such as CreateTags or ReceiveMessage. Paginated calls count once per call and
+// waiters as their describe operation. Faults of an operation apply in the order
+// they were injected, each for its number of calls.
+func (b *Backend) InjectFault(op string, f Fault) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.faults[op] = append(b.faults[op], &f)
+}
+
+// ClearFaults removes the faults of every operation.
+func (b *Backend) ClearFaults() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.faults = make(map[string][]*Fault)
+}
+
+// Calls returns the number of calls of op, including the failed ones.
+func (b *Backend) Calls(op string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.calls[op]
+}
+
+// Error returns an AWS error with code, e.g. RequestLimitExceeded or
+// InternalError, to inject as a Fault.
+func Error(code, message string) error {
+	return awserr.New(code, message, nil)
+}
+
+// call counts a call of op and applies its next Fault, returning the error the
+// call must fail with.
+func (b *Backend) call(ctx context.Context, op string) error {
+	b.mu.Lock()
+	b.calls[op]++
+	var fault *Fault
+	if faults := b.faults[op]; len(faults) > 0 {
+		f := *faults[0]
+		fault = &f
+		if faults[0].Times > 0 {
+			faults[0].Times--
+			if faults[0].Times == 0 {
+				b.faults[op] = faults[1:]
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return canceled(err)
+	}
+	if fault == nil {
+		return nil
+	}
+	if fault.Delay > 0 {
+		timer := time.NewTimer(fault.Delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return canceled(ctx.Err())
+		case <-timer.C:
+		}
+	}
+	return fault.Err
+}
+
+// canceled returns the error the SDK returns for a call whose context is done.
+func canceled(err error) error {
+	return awserr.New(request.CanceledErrorCode, "request context canceled", err)
+}
+
+// notFound returns the error EC2 returns for a missing resource.
+func notFound(resourceID string) error {
+	code := "InvalidID"
+	switch resourceType(resourceID) {
+	case "instance":
+		code = "InvalidInstanceID.NotFound"
+	case "volume":
+		code = "InvalidVolume.NotFound"
+	case "network-interface":
+		code = "InvalidNetworkInterfaceID.NotFound"
+	case "elastic-ip":
+		code = "InvalidAllocationID.NotFound"
+	case "snapshot":
+		code = "InvalidSnapshot.NotFound"
+	}
+	return awserr.New(code, fmt.Sprintf("The ID '%s' does not exist", resourceID), nil)
+}
@@ -0,0 +1,44 @@
+package tagdtest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestInjectFault(t *testing.T) {
+	b := NewBackend("", "")
+	vol := b.CreateVolume(VolumeSpec{})
+	describe := func(ctx context.Context) error {
+		_, err := b.EC2().DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{VolumeIds: aws.StringSlice([]string{vol})})
+		return err
+	}
+	ctx := context.Background()
+
+	// Faults apply in order, each for its number of calls
+	b.InjectFault("DescribeVolumes", Fault{Err: Error("RequestLimitExceeded", ""), Times: 2})
+	b.InjectFault("DescribeVolumes", Fault{Err: Error("InternalError", ""), Times: 1})
+	for i, want := range []string{"RequestLimitExceeded", "RequestLimitExceeded", "InternalError", ""} {
+		if got := errorCode(describe(ctx)); got != want {
+			t.Errorf("call %d error code = %q, want %q", i+1, got, want)
+		}
+	}
+	if got := b.Calls("DescribeVolumes"); got != 4 {
+		t.Errorf("Calls() = %d, want 4", got)
+	}
+
+	// A hung call returns once its context is done
+	b.InjectFault("DescribeVolumes", Fault{Delay: time.Hour})
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if got := errorCode(describe(timeout)); got != "RequestCanceled" {
+		t.Errorf("hung call error code = %q, want RequestCanceled", got)
+	}
+	b.ClearFaults()
+	if err := describe(ctx); err != nil {
+		t.Errorf("call after ClearFaults() error = %v", err)
+	}
+}
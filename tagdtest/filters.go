@@ -0,0 +1,69 @@
+package tagdtest
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/ryanuber/go-glob"
+)
+
+// attributes returns the values of a resource for a filter name, and false if
+// the filter isn't supported for the resource.
+type attributes func(name string) ([]string, bool)
+
+// matchFilters returns true if the resource matches all filters. A filter matches
+// if any of its values, which may contain * wildcards, matches any of the resource's.
+// Unsupported filters fail like EC2 does, so calls tagd can't make are noticed.
+func matchFilters(filters []*ec2.Filter, attrs attributes) (bool, error) {
+	for _, f := range filters {
+		name := aws.StringValue(f.Name)
+		have, ok := attrs(name)
+		if !ok {
+			return false, awserr.New("InvalidParameterValue", fmt.Sprintf("The filter '%s' is invalid", name), nil)
+		}
+		if !matchAny(aws.StringValueSlice(f.Values), have) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func matchAny(patterns, values []string) bool {
+	for _, p := range patterns {
+		for _, v := range values {
+			if glob.Glob(p, v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tagAttributes supports the tag:<key> and tag-key filters on the tags of a resource.
+func tagAttributes(tags map[string]string, name string) ([]string, bool) {
+	if name == "tag-key" {
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		return keys, true
+	}
+	if strings.HasPrefix(name, "tag:") {
+		if v, ok := tags[strings.TrimPrefix(name, "tag:")]; ok {
+			return []string{v}, true
+		}
+		return nil, true
+	}
+	return nil, false
+}
+
+// values returns a single non-empty value as a filter value.
+func values(v string) []string {
+	if v == "" {
+		return nil
+	}
+	return []string{v}
+}
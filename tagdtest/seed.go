@@ -0,0 +1,179 @@
+package tagdtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const snapshotEventType = "EBS Snapshot Notification"
+
+// seedMessage holds the fields of the queue messages Seed understands: Auto
+// Scaling notifications and EventBridge events.
+type seedMessage struct {
+	AutoScalingGroupName string          `json:"AutoScalingGroupName"`
+	Event                string          `json:"Event"`
+	EC2InstanceID        string          `json:"EC2InstanceId"`
+	DetailType           string          `json:"detail-type"`
+	Detail               json.RawMessage `json:"detail"`
+}
+
+type seedAttachDetail struct {
+	EventName         string `json:"eventName"`
+	RequestParameters struct {
+		VolumeID   string `json:"volumeId"`
+		InstanceID string `json:"instanceId"`
+		Device     string `json:"device"`
+	} `json:"requestParameters"`
+}
+
+type seedSnapshotDetail struct {
+	SnapshotID string `json:"snapshot_id"`
+	Source     string `json:"source"`
+	Snapshots  []struct {
+		SnapshotID string `json:"snapshot_id"`
+		Source     string `json:"source"`
+	} `json:"snapshots"`
+}
+
+// Seed creates the ASGs, instances, volumes and snapshots a queue message refers
+// to, unless they exist, so a recorded message can be replayed against the Backend.
+// Launched instances join their ASG with a root volume, volumes of AttachVolume
+// events are attached as the event says, and snapshots are taken of their source
+// volume. Nothing is published. It returns the IDs of the EC2 resources the message
+// concerns, including the volumes and network interfaces of a launched instance.
+// Messages of other kinds are ignored.
+func (b *Backend) Seed(body string) ([]string, error) {
+	var env envelope
+	if err := json.Unmarshal([]byte(body), &env); err == nil && env.Type == "Notification" {
+		body = env.Message
+	}
+	var msg seedMessage
+	if err := json.Unmarshal([]byte(body), &msg); err != nil {
+		return nil, fmt.Errorf("failed to parse message: %w", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case msg.AutoScalingGroupName != "":
+		return b.seedNotification(&msg)
+	case msg.DetailType == cloudTrailEventType:
+		var detail seedAttachDetail
+		if err := json.Unmarshal(msg.Detail, &detail); err != nil {
+			return nil, fmt.Errorf("failed to parse event detail: %w", err)
+		}
+		if detail.EventName != "AttachVolume" {
+			return nil, nil
+		}
+		return b.seedAttachment(detail.RequestParameters.InstanceID, detail.RequestParameters.VolumeID, detail.RequestParameters.Device)
+	case msg.DetailType == snapshotEventType:
+		var detail seedSnapshotDetail
+		if err := json.Unmarshal(msg.Detail, &detail); err != nil {
+			return nil, fmt.Errorf("failed to parse event detail: %w", err)
+		}
+		var ids []string
+		if detail.SnapshotID != "" {
+			id, err := b.seedSnapshot(detail.SnapshotID, detail.Source)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+		for _, s := range detail.Snapshots {
+			id, err := b.seedSnapshot(s.SnapshotID, s.Source)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+		return ids, nil
+	}
+	return nil, nil
+}
+
+func (b *Backend) seedNotification(msg *seedMessage) ([]string, error) {
+	if _, ok := b.asgs[msg.AutoScalingGroupName]; !ok {
+		b.asgs[msg.AutoScalingGroupName] = &asg{
+			name:          msg.AutoScalingGroupName,
+			tags:          make(map[string]string),
+			notifications: make(map[string][]string),
+		}
+	}
+	if msg.Event != eventLaunch || msg.EC2InstanceID == "" {
+		return nil, nil
+	}
+	if _, ok := b.instances[msg.EC2InstanceID]; !ok {
+		if _, err := b.launchInstance(msg.AutoScalingGroupName, InstanceSpec{ID: msg.EC2InstanceID}); err != nil {
+			return nil, err
+		}
+	}
+	return b.instanceResources(msg.EC2InstanceID), nil
+}
+
+func (b *Backend) seedAttachment(instanceID, volumeID, device string) ([]string, error) {
+	if instanceID == "" || volumeID == "" {
+		return nil, fmt.Errorf("AttachVolume event without an instance or volume ID")
+	}
+	if _, ok := b.instances[instanceID]; !ok {
+		if _, err := b.launchInstance("", InstanceSpec{ID: instanceID}); err != nil {
+			return nil, err
+		}
+	}
+	vol, ok := b.volumes[volumeID]
+	if !ok {
+		vol = b.createVolume(VolumeSpec{ID: volumeID})
+	}
+	if vol.instanceID == "" {
+		vol.instanceID, vol.device = instanceID, device
+	}
+	return []string{instanceID, volumeID}, nil
+}
+
+// seedSnapshot creates the snapshot with the ARN snapshotARN of the volume with
+// the ARN sourceARN and returns its ID.
+func (b *Backend) seedSnapshot(snapshotARN, sourceARN string) (string, error) {
+	snapshotID := arnResourceID(snapshotARN)
+	if _, ok := b.snapshots[snapshotID]; ok {
+		return snapshotID, nil
+	}
+	volumeID := arnResourceID(sourceARN)
+	if volumeID == "" {
+		return "", fmt.Errorf("snapshot %s without a source volume", snapshotID)
+	}
+	vol, ok := b.volumes[volumeID]
+	if !ok {
+		vol = b.createVolume(VolumeSpec{ID: volumeID})
+	}
+	b.createSnapshot(vol, snapshotID, "")
+	return snapshotID, nil
+}
+
+// instanceResources returns the ID of an instance and of the volumes, network
+// interfaces and Elastic IPs attached to it.
+func (b *Backend) instanceResources(instanceID string) []string {
+	ids := []string{instanceID}
+	for _, vol := range b.attached(instanceID) {
+		ids = append(ids, vol.id)
+	}
+	var others []string
+	for id, eni := range b.interfaces {
+		if eni.instanceID == instanceID {
+			others = append(others, id)
+		}
+	}
+	for id, addr := range b.addresses {
+		if addr.instanceID == instanceID {
+			others = append(others, id)
+		}
+	}
+	sort.Strings(others)
+	return append(ids, others...)
+}
+
+// arnResourceID returns the resource ID of an ARN such as
+// arn:aws:ec2::us-west-2:snapshot/snap-0123, or the ID itself.
+func arnResourceID(arn string) string {
+	return arn[strings.LastIndex(arn, "/")+1:]
+}
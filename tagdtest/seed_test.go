@@ -0,0 +1,76 @@
+package tagdtest
+
+import "testing"
+
+func TestSeedLaunchNotification(t *testing.T) {
+	b := NewBackend("", "")
+	b.CreateQueue("tagd")
+	body := `{"Type":"Notification","Message":"{\"AutoScalingGroupName\":\"web\",\"Event\":\"autoscaling:EC2_INSTANCE_LAUNCH\",\"EC2InstanceId\":\"i-0598c7d356eba48d7\"}"}`
+	ids, err := b.Seed(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 || ids[0] != "i-0598c7d356eba48d7" {
+		t.Fatalf("Seed returned %v, want the instance, its root volume and network interface", ids)
+	}
+	if got := b.Instances("web"); len(got) != 1 || got[0] != "i-0598c7d356eba48d7" {
+		t.Errorf("ASG instances = %v", got)
+	}
+	if got := b.Volumes("i-0598c7d356eba48d7"); len(got) != 1 || got[0] != ids[1] {
+		t.Errorf("instance volumes = %v, want %s", got, ids[1])
+	}
+
+	// Seeding again changes nothing
+	again, err := b.Seed(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again) != len(ids) {
+		t.Errorf("Seed returned %v the second time, want %v", again, ids)
+	}
+	if len(b.Messages("tagd")) != 0 {
+		t.Error("Seed published a notification")
+	}
+}
+
+func TestSeedAttachVolumeEvent(t *testing.T) {
+	b := NewBackend("", "")
+	ids, err := b.Seed(b.AttachVolumeEvent("vol-0123456789abcdef0", "i-0123456789abcdef0", "/dev/xvdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || ids[0] != "i-0123456789abcdef0" || ids[1] != "vol-0123456789abcdef0" {
+		t.Fatalf("Seed returned %v", ids)
+	}
+	volumes := b.Volumes("i-0123456789abcdef0")
+	if len(volumes) != 2 || volumes[1] != "vol-0123456789abcdef0" {
+		t.Errorf("instance volumes = %v, want the root volume and vol-0123456789abcdef0", volumes)
+	}
+}
+
+func TestSeedSnapshotEvent(t *testing.T) {
+	b := NewBackend("", "")
+	body := `{"detail-type":"EBS Snapshot Notification","detail":{"event":"createSnapshot","result":"succeeded",` +
+		`"snapshot_id":"arn:aws:ec2::us-east-1:snapshot/snap-01","source":"arn:aws:ec2::us-east-1:volume/vol-01"}}`
+	ids, err := b.Seed(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != "snap-01" {
+		t.Fatalf("Seed returned %v, want snap-01", ids)
+	}
+	if got := b.Snapshots("vol-01"); len(got) != 1 || got[0] != "snap-01" {
+		t.Errorf("volume snapshots = %v, want snap-01", got)
+	}
+}
+
+func TestSeedIgnoresOtherMessages(t *testing.T) {
+	b := NewBackend("", "")
+	ids, err := b.Seed(`{"detail-type":"EC2 Instance State-change Notification","detail":{}}`)
+	if err != nil || ids != nil {
+		t.Errorf("Seed() = %v, %v, want nothing", ids, err)
+	}
+	if _, err := b.Seed("not json"); err == nil {
+		t.Error("Seed accepted an invalid message")
+	}
+}
@@ -0,0 +1,179 @@
+package tagdtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+)
+
+// SNS is a fake SNS client of a Backend. Calls tagd doesn't make panic.
+type SNS struct {
+	snsiface.SNSAPI
+	backend *Backend
+}
+
+var _ snsiface.SNSAPI = (*SNS)(nil)
+
+type topic struct {
+	arn           string
+	subscriptions []*subscription
+}
+
+// subscription of a queue to a topic, the only protocol the Backend delivers.
+type subscription struct {
+	arn      string
+	queueARN string
+}
+
+// envelope is a message delivered by SNS to a queue without raw message delivery.
+type envelope struct {
+	Type      string `json:"Type"`
+	MessageID string `json:"MessageId"`
+	TopicARN  string `json:"TopicArn"`
+	Subject   string `json:"Subject,omitempty"`
+	Message   string `json:"Message"`
+	Timestamp string `json:"Timestamp"`
+}
+
+// CreateTopic creates a topic, if it doesn't exist, and returns its ARN.
+func (b *Backend) CreateTopic(name string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	arn := fmt.Sprintf("arn:aws:sns:%s:%s:%s", b.region, b.account, name)
+	if _, ok := b.topics[arn]; !ok {
+		b.topics[arn] = &topic{arn: arn}
+	}
+	return arn
+}
+
+// Publish publishes a message to a topic, delivering it to the subscribed queues
+// in an SNS envelope.
+func (b *Backend) Publish(topicARN, subject, message string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.topics[topicARN]; !ok {
+		return fmt.Errorf("topic %s doesn't exist", topicARN)
+	}
+	b.publish(topicARN, subject, message)
+	return nil
+}
+
+// Subscriptions returns the ARNs of the queues subscribed to a topic.
+func (b *Backend) Subscriptions(topicARN string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, ok := b.topics[topicARN]
+	if !ok {
+		return nil
+	}
+	arns := make([]string, len(t.subscriptions))
+	for i, s := range t.subscriptions {
+		arns[i] = s.queueARN
+	}
+	return arns
+}
+
+// GetTopicAttributesWithContext supports the TopicArn, Owner and
+// SubscriptionsConfirmed attributes.
+func (c *SNS) GetTopicAttributesWithContext(ctx aws.Context, input *sns.GetTopicAttributesInput, opts ...request.Option) (*sns.GetTopicAttributesOutput, error) {
+	b := c.backend
+	if err := b.call(ctx, "GetTopicAttributes"); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, err := b.topic(aws.StringValue(input.TopicArn))
+	if err != nil {
+		return nil, err
+	}
+	return &sns.GetTopicAttributesOutput{
+		Attributes: aws.StringMap(map[string]string{
+			"TopicArn":               t.arn,
+			"Owner":                  b.account,
+			"SubscriptionsConfirmed": strconv.Itoa(len(t.subscriptions)),
+		}),
+	}, nil
+}
+
+// SubscribeWithContext subscribes a queue to a topic. Subscribing again returns
+// the existing subscription, and protocols other than sqs are invalid.
+func (c *SNS) SubscribeWithContext(ctx aws.Context, input *sns.SubscribeInput, opts ...request.Option) (*sns.SubscribeOutput, error) {
+	b := c.backend
+	if err := b.call(ctx, "Subscribe"); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, err := b.topic(aws.StringValue(input.TopicArn))
+	if err != nil {
+		return nil, err
+	}
+	if protocol := aws.StringValue(input.Protocol); protocol != "sqs" {
+		return nil, awserr.New(sns.ErrCodeInvalidParameterException, fmt.Sprintf("Invalid parameter: Protocol %s isn't supported by tagdtest", protocol), nil)
+	}
+	queueARN := aws.StringValue(input.Endpoint)
+	for _, s := range t.subscriptions {
+		if s.queueARN == queueARN {
+			return &sns.SubscribeOutput{SubscriptionArn: aws.String(s.arn)}, nil
+		}
+	}
+	s := &subscription{arn: t.arn + ":" + b.newUUID(), queueARN: queueARN}
+	t.subscriptions = append(t.subscriptions, s)
+	return &sns.SubscribeOutput{SubscriptionArn: aws.String(s.arn)}, nil
+}
+
+// PublishWithContext publishes a message to a topic.
+func (c *SNS) PublishWithContext(ctx aws.Context, input *sns.PublishInput, opts ...request.Option) (*sns.PublishOutput, error) {
+	b := c.backend
+	if err := b.call(ctx, "Publish"); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.topic(aws.StringValue(input.TopicArn)); err != nil {
+		return nil, err
+	}
+	id := b.publish(aws.StringValue(input.TopicArn), aws.StringValue(input.Subject), aws.StringValue(input.Message))
+	return &sns.PublishOutput{MessageId: aws.String(id)}, nil
+}
+
+// publish delivers a message to the queues subscribed to topicARN and returns
+// its message ID. Subscriptions of missing queues are skipped.
+func (b *Backend) publish(topicARN, subject, msg string) string {
+	id := b.newUUID()
+	t, ok := b.topics[topicARN]
+	if !ok {
+		return id
+	}
+	body, _ := json.Marshal(envelope{
+		Type:      "Notification",
+		MessageID: id,
+		TopicARN:  topicARN,
+		Subject:   subject,
+		Message:   msg,
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	for _, s := range t.subscriptions {
+		for _, q := range b.queues {
+			if q.arn == s.queueARN {
+				b.enqueue(q, string(body))
+			}
+		}
+	}
+	return id
+}
+
+func (b *Backend) topic(arn string) (*topic, error) {
+	t, ok := b.topics[arn]
+	if !ok {
+		return nil, awserr.New(sns.ErrCodeNotFoundException, "Topic does not exist", nil)
+	}
+	return t, nil
+}
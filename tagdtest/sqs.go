@@ -0,0 +1,332 @@
+package tagdtest
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+const (
+	defaultVisibilityTimeout = 30 * time.Second
+	maxReceiveMessages       = 10
+)
+
+// SQS is a fake SQS client of a Backend. Calls tagd doesn't make panic.
+type SQS struct {
+	sqsiface.SQSAPI
+	backend *Backend
+}
+
+var _ sqsiface.SQSAPI = (*SQS)(nil)
+
+type queue struct {
+	name     string
+	url      string
+	arn      string
+	messages []*message
+	// receipts maps the receipt handles to the IDs of the messages received with them
+	receipts map[string]string
+	// arrived is closed and replaced when a message is sent
+	arrived chan struct{}
+}
+
+type message struct {
+	id           string
+	body         string
+	visibleAt    time.Time
+	receiveCount int
+}
+
+// CreateQueue creates a queue, if it doesn't exist, and returns its URL.
+func (b *Backend) CreateQueue(name string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if q, ok := b.queues[name]; ok {
+		return q.url
+	}
+	q := &queue{
+		name:     name,
+		url:      fmt.Sprintf("https://sqs.%s.amazonaws.com/%s/%s", b.region, b.account, name),
+		arn:      fmt.Sprintf("arn:aws:sqs:%s:%s:%s", b.region, b.account, name),
+		receipts: make(map[string]string),
+		arrived:  make(chan struct{}),
+	}
+	b.queues[name] = q
+	return q.url
+}
+
+// SendMessage sends a message to a queue, e.g. an event returned by AttachVolumeEvent.
+func (b *Backend) SendMessage(queueName, body string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[queueName]
+	if !ok {
+		return fmt.Errorf("queue %s doesn't exist", queueName)
+	}
+	b.enqueue(q, body)
+	return nil
+}
+
+// Messages returns the bodies of the messages in a queue, including the ones
+// received but not deleted yet.
+func (b *Backend) Messages(queueName string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[queueName]
+	if !ok {
+		return nil
+	}
+	bodies := make([]string, len(q.messages))
+	for i, m := range q.messages {
+		bodies[i] = m.body
+	}
+	return bodies
+}
+
+// GetQueueUrlWithContext returns the URL of a queue by name.
+func (c *SQS) GetQueueUrlWithContext(ctx aws.Context, input *sqs.GetQueueUrlInput, opts ...request.Option) (*sqs.GetQueueUrlOutput, error) {
+	b := c.backend
+	if err := b.call(ctx, "GetQueueUrl"); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[aws.StringValue(input.QueueName)]
+	if !ok {
+		return nil, queueNotFound()
+	}
+	return &sqs.GetQueueUrlOutput{QueueUrl: aws.String(q.url)}, nil
+}
+
+// GetQueueAttributesWithContext supports the QueueArn, VisibilityTimeout,
+// ApproximateNumberOfMessages and ApproximateNumberOfMessagesNotVisible attributes.
+func (c *SQS) GetQueueAttributesWithContext(ctx aws.Context, input *sqs.GetQueueAttributesInput, opts ...request.Option) (*sqs.GetQueueAttributesOutput, error) {
+	b := c.backend
+	if err := b.call(ctx, "GetQueueAttributes"); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, err := b.queueByURL(aws.StringValue(input.QueueUrl))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	visible := 0
+	for _, m := range q.messages {
+		if !m.visibleAt.After(now) {
+			visible++
+		}
+	}
+	all := map[string]string{
+		sqs.QueueAttributeNameQueueArn:                              q.arn,
+		sqs.QueueAttributeNameVisibilityTimeout:                     strconv.Itoa(int(defaultVisibilityTimeout / time.Second)),
+		sqs.QueueAttributeNameApproximateNumberOfMessages:           strconv.Itoa(visible),
+		sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible: strconv.Itoa(len(q.messages) - visible),
+	}
+	out := &sqs.GetQueueAttributesOutput{Attributes: make(map[string]*string)}
+	for _, name := range aws.StringValueSlice(input.AttributeNames) {
+		if name == sqs.QueueAttributeNameAll {
+			out.Attributes = aws.StringMap(all)
+			break
+		}
+		if v, ok := all[name]; ok {
+			out.Attributes[name] = aws.String(v)
+		}
+	}
+	return out, nil
+}
+
+// ReceiveMessageWithContext receives up to MaxNumberOfMessages visible messages
+// in the order they were sent, hiding them for the VisibilityTimeout, 30 seconds
+// by default. It long polls for WaitTimeSeconds if the queue is empty.
+func (c *SQS) ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	b := c.backend
+	if err := b.call(ctx, "ReceiveMessage"); err != nil {
+		return nil, err
+	}
+	max := int(aws.Int64Value(input.MaxNumberOfMessages))
+	if max <= 0 {
+		max = 1
+	}
+	if max > maxReceiveMessages {
+		max = maxReceiveMessages
+	}
+	visibility := defaultVisibilityTimeout
+	if input.VisibilityTimeout != nil {
+		visibility = time.Duration(*input.VisibilityTimeout) * time.Second
+	}
+	deadline := time.NewTimer(time.Duration(aws.Int64Value(input.WaitTimeSeconds)) * time.Second)
+	defer deadline.Stop()
+
+	for {
+		b.mu.Lock()
+		q, err := b.queueByURL(aws.StringValue(input.QueueUrl))
+		if err != nil {
+			b.mu.Unlock()
+			return nil, err
+		}
+		out := &sqs.ReceiveMessageOutput{}
+		now := time.Now()
+		// wait until the next hidden message reappears, or a second at most
+		wait := time.Second
+		for _, m := range q.messages {
+			if len(out.Messages) == max {
+				break
+			}
+			if m.visibleAt.After(now) {
+				if d := m.visibleAt.Sub(now); d < wait {
+					wait = d
+				}
+				continue
+			}
+			m.visibleAt = now.Add(visibility)
+			m.receiveCount++
+			receipt := b.newUUID()
+			q.receipts[receipt] = m.id
+			out.Messages = append(out.Messages, &sqs.Message{
+				MessageId:     aws.String(m.id),
+				ReceiptHandle: aws.String(receipt),
+				Body:          aws.String(m.body),
+				MD5OfBody:     aws.String(md5Hex(m.body)),
+				Attributes: aws.StringMap(map[string]string{
+					sqs.MessageSystemAttributeNameApproximateReceiveCount: strconv.Itoa(m.receiveCount),
+				}),
+			})
+		}
+		arrived := q.arrived
+		b.mu.Unlock()
+		if len(out.Messages) > 0 {
+			return out, nil
+		}
+
+		// Messages hidden by a visibility timeout reappear without an arrival,
+		// so poll for them when they do
+		tick := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			tick.Stop()
+			return nil, canceled(ctx.Err())
+		case <-deadline.C:
+			tick.Stop()
+			return out, nil
+		case <-arrived:
+		case <-tick.C:
+		}
+		tick.Stop()
+	}
+}
+
+// DeleteMessageWithContext deletes a received message. Like SQS, deleting a
+// message that is already gone succeeds, but unknown receipt handles fail.
+func (c *SQS) DeleteMessageWithContext(ctx aws.Context, input *sqs.DeleteMessageInput, opts ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	b := c.backend
+	if err := b.call(ctx, "DeleteMessage"); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, err := b.queueByURL(aws.StringValue(input.QueueUrl))
+	if err != nil {
+		return nil, err
+	}
+	receipt := aws.StringValue(input.ReceiptHandle)
+	id, ok := q.receipts[receipt]
+	if !ok {
+		return nil, awserr.New(sqs.ErrCodeReceiptHandleIsInvalid, fmt.Sprintf("The receipt handle %s is not valid", receipt), nil)
+	}
+	for i, m := range q.messages {
+		if m.id == id {
+			q.messages = append(q.messages[:i], q.messages[i+1:]...)
+			break
+		}
+	}
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+// ChangeMessageVisibilityWithContext hides a received message for the
+// VisibilityTimeout from now, or makes it visible right away with 0. Like SQS,
+// messages that are already gone or unknown receipt handles fail.
+func (c *SQS) ChangeMessageVisibilityWithContext(ctx aws.Context, input *sqs.ChangeMessageVisibilityInput, opts ...request.Option) (*sqs.ChangeMessageVisibilityOutput, error) {
+	b := c.backend
+	if err := b.call(ctx, "ChangeMessageVisibility"); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, err := b.queueByURL(aws.StringValue(input.QueueUrl))
+	if err != nil {
+		return nil, err
+	}
+	receipt := aws.StringValue(input.ReceiptHandle)
+	id, ok := q.receipts[receipt]
+	if !ok {
+		return nil, awserr.New(sqs.ErrCodeReceiptHandleIsInvalid, fmt.Sprintf("The receipt handle %s is not valid", receipt), nil)
+	}
+	for _, m := range q.messages {
+		if m.id == id {
+			m.visibleAt = time.Now().Add(time.Duration(aws.Int64Value(input.VisibilityTimeout)) * time.Second)
+			if !m.visibleAt.After(time.Now()) {
+				close(q.arrived)
+				q.arrived = make(chan struct{})
+			}
+			return &sqs.ChangeMessageVisibilityOutput{}, nil
+		}
+	}
+	return nil, awserr.New(sqs.ErrCodeMessageNotInflight, "Value "+receipt+" for parameter ReceiptHandle is invalid. Reason: Message does not exist or is not available for visibility timeout change.", nil)
+}
+
+// SendMessageWithContext sends a message to a queue.
+func (c *SQS) SendMessageWithContext(ctx aws.Context, input *sqs.SendMessageInput, opts ...request.Option) (*sqs.SendMessageOutput, error) {
+	b := c.backend
+	if err := b.call(ctx, "SendMessage"); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, err := b.queueByURL(aws.StringValue(input.QueueUrl))
+	if err != nil {
+		return nil, err
+	}
+	m := b.enqueue(q, aws.StringValue(input.MessageBody))
+	return &sqs.SendMessageOutput{
+		MessageId:        aws.String(m.id),
+		MD5OfMessageBody: aws.String(md5Hex(m.body)),
+	}, nil
+}
+
+// enqueue adds a visible message to q and wakes up its long polls.
+func (b *Backend) enqueue(q *queue, body string) *message {
+	m := &message{id: b.newUUID(), body: body}
+	q.messages = append(q.messages, m)
+	close(q.arrived)
+	q.arrived = make(chan struct{})
+	return m
+}
+
+func (b *Backend) queueByURL(url string) (*queue, error) {
+	for _, q := range b.queues {
+		if q.url == url {
+			return q, nil
+		}
+	}
+	return nil, queueNotFound()
+}
+
+func queueNotFound() error {
+	return awserr.New(sqs.ErrCodeQueueDoesNotExist, "The specified queue does not exist for this wsdl version.", nil)
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
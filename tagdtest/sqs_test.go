@@ -0,0 +1,98 @@
+package tagdtest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+func TestSQSVisibility(t *testing.T) {
+	b := NewBackend("", "")
+	url := b.CreateQueue("tagd")
+	svc := b.SQS()
+	ctx := context.Background()
+	if err := b.SendMessage("tagd", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	receive := func() []*sqs.Message {
+		out, err := svc.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{QueueUrl: aws.String(url)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out.Messages
+	}
+
+	first := receive()
+	if len(first) != 1 || aws.StringValue(first[0].Body) != "hello" {
+		t.Fatalf("ReceiveMessage() = %v", first)
+	}
+	if got := receive(); len(got) != 0 {
+		t.Fatal("received message is visible")
+	}
+	_, err := svc.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(url),
+		ReceiptHandle:     first[0].ReceiptHandle,
+		VisibilityTimeout: aws.Int64(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := receive()
+	if len(second) != 1 {
+		t.Fatal("message isn't visible after ChangeMessageVisibility to 0")
+	}
+	if got := aws.StringValue(second[0].Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]); got != "2" {
+		t.Errorf("ApproximateReceiveCount = %s, want 2", got)
+	}
+
+	// Both receipts stay valid, like SQS
+	for _, m := range []*sqs.Message{second[0], first[0]} {
+		if _, err := svc.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{QueueUrl: aws.String(url), ReceiptHandle: m.ReceiptHandle}); err != nil {
+			t.Errorf("DeleteMessage() error = %v", err)
+		}
+	}
+	if got := b.Messages("tagd"); len(got) != 0 {
+		t.Errorf("messages after delete = %v", got)
+	}
+	_, err = svc.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{QueueUrl: aws.String(url), ReceiptHandle: aws.String("bogus")})
+	if errorCode(err) != sqs.ErrCodeReceiptHandleIsInvalid {
+		t.Errorf("unknown receipt error = %v, want %s", err, sqs.ErrCodeReceiptHandleIsInvalid)
+	}
+	_, err = svc.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(url),
+		ReceiptHandle:     first[0].ReceiptHandle,
+		VisibilityTimeout: aws.Int64(0),
+	})
+	if errorCode(err) != sqs.ErrCodeMessageNotInflight {
+		t.Errorf("deleted message error = %v, want %s", err, sqs.ErrCodeMessageNotInflight)
+	}
+}
+
+func TestSQSLongPolling(t *testing.T) {
+	b := NewBackend("", "")
+	url := b.CreateQueue("tagd")
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		b.SendMessage("tagd", "late")
+	}()
+	out, err := b.SQS().ReceiveMessageWithContext(context.Background(), &sqs.ReceiveMessageInput{
+		QueueUrl:        aws.String(url),
+		WaitTimeSeconds: aws.Int64(5),
+	})
+	if err != nil || len(out.Messages) != 1 {
+		t.Fatalf("ReceiveMessage() = %v, %v, want the late message", out, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = b.SQS().ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:        aws.String(url),
+		WaitTimeSeconds: aws.Int64(5),
+	})
+	if errorCode(err) != "RequestCanceled" {
+		t.Errorf("cancelled ReceiveMessage() error = %v, want RequestCanceled", err)
+	}
+}
@@ -0,0 +1,218 @@
+package tagd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ryanuber/go-glob"
+)
+
+const (
+	// MaxTags is the maximum number of tags EC2 allows on a resource.
+	MaxTags = 50
+
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+	reservedTagPrefix = "aws:"
+	markerTagPrefix   = "tagd:"
+)
+
+// Tag ranks, lower ranks are kept first when a TagSet is truncated.
+const (
+	rankMarker = iota
+	rankStatic
+	rankCopied
+)
+
+// TagViolation describes a tag that was dropped or would be rejected by EC2.
+type TagViolation struct {
+	Key    string
+	Reason string
+}
+
+func (v TagViolation) String() string {
+	return fmt.Sprintf("%s: %s", v.Key, v.Reason)
+}
+
+func violationStrings(violations []TagViolation) []string {
+	s := make([]string, len(violations))
+	for i, v := range violations {
+		s[i] = v.String()
+	}
+	return s
+}
+
+// checkTag returns a violation if EC2 would reject the tag.
+func checkTag(key, value string) *TagViolation {
+	switch {
+	case key == "":
+		return &TagViolation{Key: key, Reason: "empty key"}
+	case strings.HasPrefix(strings.ToLower(key), reservedTagPrefix):
+		return &TagViolation{Key: key, Reason: "reserved aws: prefix"}
+	case utf8.RuneCountInString(key) > maxTagKeyLength:
+		return &TagViolation{Key: key, Reason: fmt.Sprintf("key longer than %d characters", maxTagKeyLength)}
+	case utf8.RuneCountInString(value) > maxTagValueLength:
+		return &TagViolation{Key: key, Reason: fmt.Sprintf("value longer than %d characters", maxTagValueLength)}
+	}
+	return nil
+}
+
+// TagSet is a set of tags ranked for truncation to EC2's tag limit.
+type TagSet struct {
+	tags map[string]string
+	rank map[string]int
+}
+
+// NewTagSet returns an empty TagSet.
+func NewTagSet() *TagSet {
+	return &TagSet{
+		tags: make(map[string]string),
+		rank: make(map[string]int),
+	}
+}
+
+// Set adds a tag with a rank. Lower ranks are kept first when truncating.
+func (s *TagSet) Set(key, value string, rank int) {
+	s.tags[key] = value
+	s.rank[key] = rank
+}
+
+// Len returns the number of tags in the set.
+func (s *TagSet) Len() int {
+	return len(s.tags)
+}
+
+// Map returns the tags as a map.
+func (s *TagSet) Map() map[string]string {
+	m := make(map[string]string, len(s.tags))
+	for k, v := range s.tags {
+		m[k] = v
+	}
+	return m
+}
+
+// Normalize drops tags EC2 would reject and truncates the set, dropping the highest
+// ranked tags first, so that no resource ends up with more than maxTags tags. existing
+// holds the current tags of each resource the set is written to, keyed by resource ID;
+// the ones the set doesn't overwrite count towards the limit. It returns a violation
+// for every dropped tag.
+func (s *TagSet) Normalize(maxTags int, existing map[string]map[string]string) []TagViolation {
+	var violations []TagViolation
+	for k, v := range s.tags {
+		if violation := checkTag(k, v); violation != nil {
+			violations = append(violations, *violation)
+			s.remove(k)
+		}
+	}
+	if len(existing) == 0 {
+		existing = map[string]map[string]string{"": nil}
+	}
+
+	keys := make([]string, 0, len(s.tags))
+	for k := range s.tags {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if s.rank[keys[i]] != s.rank[keys[j]] {
+			return s.rank[keys[i]] < s.rank[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	// Keep tags in rank order while every resource has room for them. Tags a
+	// resource already has take no room on it, they are only overwritten.
+	counts := make(map[string]int, len(existing))
+	for id, tags := range existing {
+		counts[id] = len(tags)
+	}
+	for _, k := range keys {
+		fits := true
+		for id, tags := range existing {
+			if _, ok := tags[k]; !ok && counts[id] >= maxTags {
+				fits = false
+				break
+			}
+		}
+		if !fits {
+			violations = append(violations, TagViolation{Key: k, Reason: fmt.Sprintf("more than %d tags", maxTags)})
+			s.remove(k)
+			continue
+		}
+		for id, tags := range existing {
+			if _, ok := tags[k]; !ok {
+				counts[id]++
+			}
+		}
+	}
+	return violations
+}
+
+func (s *TagSet) remove(key string) {
+	delete(s.tags, key)
+	delete(s.rank, key)
+}
+
+// maxTags returns the configured tag limit, or MaxTags if unset.
+func (c *TaggingConfig) maxTags() int {
+	if c.MaxTags == 0 {
+		return MaxTags
+	}
+	return c.MaxTags
+}
+
+// tagRank ranks a tag for truncation. tagd's marker tags rank first, then tags
+// matching TagPriority in the order of the patterns, then static and volume
+// selector tags, then everything else.
+func (c *TaggingConfig) tagRank(key string) int {
+	if strings.HasPrefix(key, markerTagPrefix) {
+		return rankMarker
+	}
+	for i, pattern := range c.TagPriority {
+		if glob.Glob(pattern, key) {
+			return rankStatic + i
+		}
+	}
+	rank := rankStatic + len(c.TagPriority)
+	if _, static := c.Tags[key]; static {
+		return rank
+	}
+	for _, s := range c.Volumes {
+		if _, static := s.Tags[key]; static {
+			return rank
+		}
+	}
+	return rank + rankCopied - rankStatic
+}
+
+// tagSet returns tags as a TagSet ranked by the TaggingConfig.
+func (c *TaggingConfig) tagSet(tags map[string]string) *TagSet {
+	s := NewTagSet()
+	for k, v := range tags {
+		s.Set(k, v, c.tagRank(k))
+	}
+	return s
+}
+
+// validateTags reports static tags EC2 would reject, and static tag sets exceeding the tag limit.
+func (c *TaggingConfig) validateTags() error {
+	if c.MaxTags < 0 || c.MaxTags > MaxTags {
+		return fmt.Errorf("maxTags must be between 1 and %d", MaxTags)
+	}
+	static := []map[string]string{c.Tags}
+	for _, s := range c.Volumes {
+		static = append(static, s.Tags)
+	}
+	for _, tags := range static {
+		for k, v := range tags {
+			if violation := checkTag(k, v); violation != nil {
+				return fmt.Errorf("invalid tag %s", violation)
+			}
+		}
+	}
+	// Leave room for the marker tags
+	if n := len(c.Tags) + 2; n > c.maxTags() {
+		return fmt.Errorf("%d static tags and tagd's marker tags exceed the limit of %d tags", len(c.Tags), c.maxTags())
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package tagd
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNormalizeDropsInvalidTags(t *testing.T) {
+	s := NewTagSet()
+	s.Set("aws:foo", "bar", rankStatic)
+	s.Set("", "empty", rankStatic)
+	s.Set("team", "infra", rankStatic)
+	if violations := s.Normalize(MaxTags, nil); len(violations) != 2 {
+		t.Errorf("got violations %v, want 2", violations)
+	}
+	if m := s.Map(); len(m) != 1 || m["team"] != "infra" {
+		t.Errorf("tags = %v, want only team", m)
+	}
+}
+
+func TestNormalizeTruncatesByRank(t *testing.T) {
+	s := NewTagSet()
+	s.Set(MarkerTagInstance, "i-1", rankMarker)
+	s.Set("static", "v", rankStatic)
+	s.Set("copied-a", "v", rankCopied)
+	s.Set("copied-b", "v", rankCopied)
+	violations := s.Normalize(3, nil)
+	if len(violations) != 1 || violations[0].Key != "copied-b" {
+		t.Errorf("got violations %v, want copied-b", violations)
+	}
+}
+
+func TestNormalizeCountsExistingTags(t *testing.T) {
+	existing := make(map[string]string)
+	for i := 0; i < 47; i++ {
+		existing[fmt.Sprintf("existing-%d", i)] = "v"
+	}
+	// existing-0 is overwritten so it takes no extra room
+	s := NewTagSet()
+	s.Set(MarkerTagInstance, "i-1", rankMarker)
+	s.Set("existing-0", "new", rankStatic)
+	s.Set("static", "v", rankStatic)
+	s.Set("copied-a", "v", rankCopied)
+	s.Set("copied-b", "v", rankCopied)
+
+	violations := s.Normalize(MaxTags, map[string]map[string]string{"vol-1": existing, "vol-2": {}})
+	m := s.Map()
+	for _, k := range []string{MarkerTagInstance, "existing-0", "static", "copied-a"} {
+		if _, ok := m[k]; !ok {
+			t.Errorf("tag %s was dropped", k)
+		}
+	}
+	if len(violations) != 1 || violations[0].Key != "copied-b" {
+		t.Errorf("got violations %v, want copied-b", violations)
+	}
+}
+
+func TestNormalizeKeepsExistingKeysOverLimit(t *testing.T) {
+	existing := map[string]string{"a": "1", "b": "2", "c": "3"}
+	s := NewTagSet()
+	s.Set("b", "new", rankCopied)
+	s.Set("d", "4", rankStatic)
+	violations := s.Normalize(3, map[string]map[string]string{"vol-1": existing})
+	if m := s.Map(); len(m) != 1 || m["b"] != "new" {
+		t.Errorf("tags = %v, want only b", m)
+	}
+	if len(violations) != 1 || violations[0].Key != "d" {
+		t.Errorf("got violations %v, want d", violations)
+	}
+}
@@ -0,0 +1,67 @@
+package tagd
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultDescribeTimeout      = 30 * time.Second
+	defaultTagTimeout           = 30 * time.Second
+	defaultNotificationsTimeout = 30 * time.Second
+	defaultEventTimeout         = 5 * time.Minute
+)
+
+// TimeoutConfig bounds AWS API calls, so a hung call fails instead of blocking
+// its handler and shutdown. Each call is also bounded by the deadline of the
+// event being handled.
+type TimeoutConfig struct {
+	// Describe bounds each lookup, e.g. DescribeTags or DescribeVolumes, defaults to 30 seconds.
+	Describe time.Duration `yaml:"describe,omitempty"`
+	// Tag bounds each change, e.g. CreateTags, DeleteTags or a node label patch,
+	// including looking up the previous tags for the audit journal, defaults to
+	// 30 seconds. Snapshotting and deleting orphaned volumes are bounded by it too.
+	Tag time.Duration `yaml:"tag,omitempty"`
+	// Notifications bounds enabling the notifications of an ASG, defaults to 30 seconds.
+	Notifications time.Duration `yaml:"notifications,omitempty"`
+	// Event bounds handling a single event or re-check, including waiting for
+	// volumes to attach on launch, and cleaning up an orphaned volume, including
+	// waiting for its snapshot, defaults to 5 minutes.
+	Event time.Duration `yaml:"event,omitempty"`
+}
+
+func (c *TimeoutConfig) validate() error {
+	if c.Describe < 0 || c.Tag < 0 || c.Notifications < 0 || c.Event < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	return nil
+}
+
+func (c *TimeoutConfig) describe() time.Duration {
+	return durationOr(c.Describe, defaultDescribeTimeout)
+}
+
+func (c *TimeoutConfig) tag() time.Duration {
+	return durationOr(c.Tag, defaultTagTimeout)
+}
+
+func (c *TimeoutConfig) notifications() time.Duration {
+	return durationOr(c.Notifications, defaultNotificationsTimeout)
+}
+
+func (c *TimeoutConfig) event() time.Duration {
+	return durationOr(c.Event, defaultEventTimeout)
+}
+
+// eventContext bounds ctx by the event timeout.
+func (c *TimeoutConfig) eventContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, c.event())
+}
+
+func durationOr(d, fallback time.Duration) time.Duration {
+	if d == 0 {
+		return fallback
+	}
+	return d
+}
@@ -0,0 +1,90 @@
+package tagd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/leosunmo/tagd/tagdtest"
+	"go.uber.org/zap"
+)
+
+// testTimeouts are short enough for a hung call to fail a test quickly.
+var testTimeouts = TimeoutConfig{
+	Describe:      50 * time.Millisecond,
+	Tag:           50 * time.Millisecond,
+	Notifications: 50 * time.Millisecond,
+	Event:         200 * time.Millisecond,
+}
+
+// hang makes every call of op hang until its context is done.
+func hang(backend *tagdtest.Backend, op string) {
+	backend.InjectFault(op, tagdtest.Fault{Delay: time.Hour})
+}
+
+// within fails the test if f takes longer than a second.
+func within(t *testing.T, what string, f func()) {
+	t.Helper()
+	start := time.Now()
+	f()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("%s took %s, want it bounded by the timeouts", what, elapsed)
+	}
+}
+
+func TestOrphanReaperTimeouts(t *testing.T) {
+	for _, op := range []string{"DescribeVolumes", "DescribeInstances", "CreateSnapshot", "DescribeSnapshots", "DeleteVolume"} {
+		t.Run(op, func(t *testing.T) {
+			backend := tagdtest.NewBackend("", "")
+			vol := backend.CreateVolume(tagdtest.VolumeSpec{Tags: map[string]string{
+				MarkerTagASG:           "web",
+				MarkerTagInstance:      "i-0123456789abcdef0",
+				MarkerTagOrphanedSince: time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339),
+			}})
+			config := &Config{
+				Orphans:  OrphanConfig{Retention: time.Hour, Snapshot: true, Delete: true},
+				Timeouts: testTimeouts,
+			}
+			reaper := NewOrphanReaper(config, backend.EC2(), zap.NewNop())
+			hang(backend, op)
+
+			var orphans []*Orphan
+			var err error
+			within(t, "Run", func() { orphans, err = reaper.Run(context.Background()) })
+			if err == nil && (len(orphans) != 1 || orphans[0].Action != OrphanActionNone) {
+				t.Errorf("Run() = %v, want a failed cleanup", orphans)
+			}
+			if op == "DeleteVolume" && !backend.VolumeExists(vol) {
+				t.Error("volume deleted despite the hung call")
+			}
+		})
+	}
+}
+
+func TestScanSnapshotsTimeouts(t *testing.T) {
+	for _, op := range []string{"DescribeSnapshots", "DescribeVolumes", "DescribeTags"} {
+		t.Run(op, func(t *testing.T) {
+			backend := tagdtest.NewBackend("", "")
+			if err := backend.CreateASG("web", nil); err != nil {
+				t.Fatal(err)
+			}
+			id, err := backend.LaunchInstance("web", tagdtest.InstanceSpec{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := backend.CreateSnapshot(backend.Volumes(id)[0]); err != nil {
+				t.Fatal(err)
+			}
+			d := newTestDaemon(t, backend, &Config{
+				TaggingConfigs: []TaggingConfig{{ASGName: "web", Tags: map[string]string{"team": "web"}}},
+				Timeouts:       testTimeouts,
+			})
+			hang(backend, op)
+
+			within(t, "scanSnapshots", func() { err = d.scanSnapshots(context.Background()) })
+			if err == nil {
+				t.Error("scanSnapshots() succeeded despite the hung call")
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package tagd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/ryanuber/go-glob"
+)
+
+// VolumeSelector selects volumes of an instance to exclude or to tag with extra tags.
+// All conditions set must match. Volumes not matching any selector get the TaggingConfig's tags.
+type VolumeSelector struct {
+	// Device is a glob on the device name, e.g. /dev/xvdb*.
+	Device string `yaml:"device,omitempty"`
+	// Root selects the root volume if true, or all other volumes if false.
+	Root *bool `yaml:"root,omitempty"`
+	// Type is a glob on the volume type, e.g. gp3 or io*.
+	Type string `yaml:"type,omitempty"`
+	// MinSize and MaxSize are inclusive bounds on the volume size in GiB.
+	MinSize int64 `yaml:"minSize,omitempty"`
+	MaxSize int64 `yaml:"maxSize,omitempty"`
+	// Exclude matching volumes from tagging entirely.
+	Exclude bool `yaml:"exclude,omitempty"`
+	// Tags override the TaggingConfig's tags on matching volumes.
+	Tags map[string]string `yaml:"tags,omitempty"`
+}
+
+func (s *VolumeSelector) validate() error {
+	if s.MinSize < 0 || s.MaxSize < 0 {
+		return fmt.Errorf("volume selector sizes must not be negative")
+	}
+	if s.MaxSize > 0 && s.MinSize > s.MaxSize {
+		return fmt.Errorf("volume selector minSize %d larger than maxSize %d", s.MinSize, s.MaxSize)
+	}
+	return nil
+}
+
+// matches returns true if the volume, attached as device, matches the selector.
+func (s *VolumeSelector) matches(vol *ec2.Volume, device, rootDevice string) bool {
+	if s.Device != "" && !glob.Glob(s.Device, device) {
+		return false
+	}
+	if s.Root != nil && *s.Root != (device != "" && device == rootDevice) {
+		return false
+	}
+	if s.Type != "" && !glob.Glob(s.Type, aws.StringValue(vol.VolumeType)) {
+		return false
+	}
+	size := aws.Int64Value(vol.Size)
+	if s.MinSize > 0 && size < s.MinSize {
+		return false
+	}
+	if s.MaxSize > 0 && size > s.MaxSize {
+		return false
+	}
+	return true
+}
+
+// usesRoot returns true if any volume selector needs the instance's root device name.
+func (c *TaggingConfig) usesRoot() bool {
+	for _, s := range c.Volumes {
+		if s.Root != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// volumeTags returns the tags for a single volume by applying the matching volume
+// selectors in order over tags. It returns false if the volume is excluded.
+func (c *TaggingConfig) volumeTags(vol *ec2.Volume, device, rootDevice string, tags map[string]string) (map[string]string, bool) {
+	result := make(map[string]string, len(tags))
+	for k, v := range tags {
+		result[k] = v
+	}
+	for i := range c.Volumes {
+		s := &c.Volumes[i]
+		if !s.matches(vol, device, rootDevice) {
+			continue
+		}
+		if s.Exclude {
+			return nil, false
+		}
+		for k, v := range s.Tags {
+			result[k] = v
+		}
+	}
+	return result, true
+}
+
+// attachmentDevice returns the device name the volume is attached to instanceID as.
+func attachmentDevice(vol *ec2.Volume, instanceID string) string {
+	for _, a := range vol.Attachments {
+		if aws.StringValue(a.InstanceId) == instanceID {
+			return aws.StringValue(a.Device)
+		}
+	}
+	return ""
+}
+
+// rootDeviceName returns the root device name of the instance.
+func (l *AutoscalingTagger) rootDeviceName(ctx context.Context, instanceID string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, l.timeouts.describe())
+	defer cancel()
+	out, err := l.ec2Client.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: aws.StringSlice([]string{instanceID}),
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(out.Reservations) == 0 || len(out.Reservations[0].Instances) == 0 {
+		return "", nil
+	}
+	return aws.StringValue(out.Reservations[0].Instances[0].RootDeviceName), nil
+}
+
+// tagSetKey returns a string uniquely identifying a set of tags, to batch
+// resources getting the same tags into one call.
+func tagSetKey(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%q=%q,", k, tags[k])
+	}
+	return b.String()
+}